@@ -12,14 +12,20 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
 
 	"github.com/jessevdk/go-flags"
 
 	"operese/cedar/internal/commands"
 	"operese/cedar/internal/helper"
+	"operese/cedar/internal/logger"
 	"operese/cedar/internal/statemachine"
 )
 
@@ -27,9 +33,25 @@ import (
 // this is usually overridden at build time
 var Version string = ""
 
+// exit codes used when the build is stopped by a signal
+const (
+	// the build was cancelled and cedar cleaned up after itself
+	exitCodeInterrupted = 130
+	// a second signal was received and cedar exited without cleaning up
+	exitCodeForced = 131
+)
+
 // helper variables for unit testing
 var osExit = os.Exit
 var captureStd = helper.CaptureStd
+var signalNotify = signal.Notify
+
+// exit closes the log file, which deferred calls would leave unflushed, and
+// exits with the given code
+func exit(code int) {
+	_ = logger.Close()
+	osExit(code)
+}
 
 var stateMachineLongDesc = `Options for controlling the internal state machine.
 Other than -w, these options are mutually exclusive. When -u or -t is given,
@@ -39,8 +61,25 @@ case since the state is saved in a cedar.json file in the working directory.`
 func initStateMachine(commonOpts *commands.CommonOpts, stateMachineOpts *commands.StateMachineOpts, classicCommand *commands.ClassicCommand, cedarOpts *commands.ClassicOpts) (statemachine.SmInterface, error) {
 	var stateMachine statemachine.SmInterface
 	stateMachine = &statemachine.ClassicStateMachine{
-		Args:    classicCommand.ClassicArgsPassed,
-		Preseed: cedarOpts.Preseed,
+		Args:              classicCommand.ClassicArgsPassed,
+		Preseed:           cedarOpts.Preseed,
+		Wait:              cedarOpts.Wait,
+		Rootless:          statemachine.InRootlessNamespace(),
+		SkipPreflight:     cedarOpts.SkipPreflight,
+		SetDefaultLocale:  cedarOpts.SetDefaultLocale,
+		CleanRootfs:       cedarOpts.CleanRootfs,
+		ReportPath:        cedarOpts.Report,
+		AuditLogPath:      cedarOpts.AuditLog,
+		ManifestPath:      cedarOpts.Manifest,
+		ManifestFormat:    cedarOpts.ManifestFormat,
+		SPDXPath:          cedarOpts.SBOMSPDX,
+		CycloneDXPath:     cedarOpts.SBOMCycloneDX,
+		ProvenancePath:    cedarOpts.Provenance,
+		ProvenanceKeyPath: cedarOpts.ProvenanceKey,
+		CommandLine:       os.Args[1:],
+		Reproducible:      cedarOpts.Reproducible,
+		MaxSeedSize:       cedarOpts.MaxSeedSize,
+		Version:           Version,
 	}
 
 	stateMachine.SetCommonOpts(commonOpts, stateMachineOpts)
@@ -48,20 +87,113 @@ func initStateMachine(commonOpts *commands.CommonOpts, stateMachineOpts *command
 	return stateMachine, nil
 }
 
-func executeStateMachine(sm statemachine.SmInterface) error {
+func executeStateMachine(sm statemachine.SmInterface) (err error) {
 	if err := sm.Setup(); err != nil {
 		return err
 	}
 
-	if err := sm.Run(); err != nil {
-		return err
+	// always tear down once set up, even if the build failed or was interrupted
+	defer func() {
+		teardownErr := sm.Teardown()
+		if teardownErr == nil {
+			return
+		}
+		if err == nil {
+			err = teardownErr
+			return
+		}
+		err = fmt.Errorf("%w\n%s", err, teardownErr.Error())
+	}()
+
+	return sm.Run()
+}
+
+// setupEvents returns the writer of the JSON progress events, if they were
+// requested. When they are written to stdout, the usual output is moved to
+// stderr so the events can be parsed.
+func setupEvents(commonOpts *commands.CommonOpts) (*statemachine.EventWriter, error) {
+	if commonOpts.Output != "json" {
+		if commonOpts.EventsFD != 0 {
+			return nil, fmt.Errorf("--events-fd can only be used with --output json")
+		}
+		return nil, nil
 	}
 
-	if err := sm.Teardown(); err != nil {
-		return err
+	if commonOpts.EventsFD == 0 {
+		events := statemachine.NewEventWriter(os.Stdout)
+		os.Stdout = os.Stderr
+		return events, nil
+	}
+
+	eventsFile := os.NewFile(uintptr(commonOpts.EventsFD), "events")
+	if eventsFile == nil {
+		return nil, fmt.Errorf("Invalid file descriptor %d given to --events-fd", commonOpts.EventsFD)
+	}
+	if _, err := eventsFile.Stat(); err != nil {
+		return nil, fmt.Errorf("Invalid file descriptor %d given to --events-fd: %s", commonOpts.EventsFD, err.Error())
+	}
+	return statemachine.NewEventWriter(eventsFile), nil
+}
+
+// runRootless re-executes cedar in a user namespace, forwarding the signals it
+// receives, and returns the exit code of the build
+func runRootless(eventsFD int) int {
+	if err := statemachine.CheckUserNamespaces(); err != nil {
+		logger.Errorf("%s", err.Error())
+		return 1
+	}
+
+	var extraFiles []*os.File
+	if eventsFD > 2 {
+		// only the standard streams are inherited by default. The file
+		// descriptor at index i of ExtraFiles is 3+i in the child.
+		extraFiles = make([]*os.File, eventsFD-2)
+		extraFiles[eventsFD-3] = os.NewFile(uintptr(eventsFD), "events")
+	}
+	cmd, err := statemachine.StartRootless(os.Args[1:], extraFiles)
+	if err != nil {
+		logger.Errorf("%s", err.Error())
+		return 1
+	}
+
+	signals := make(chan os.Signal, 2)
+	signalNotify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		for sig := range signals {
+			_ = cmd.Process.Signal(sig)
+		}
+	}()
+
+	if err := cmd.Wait(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if exitErr.ExitCode() < 0 {
+				// killed by a signal
+				return exitCodeForced
+			}
+			return exitErr.ExitCode()
+		}
+		logger.Errorf("%s", err.Error())
+		return 1
 	}
+	return 0
+}
+
+// handleSignals cancels the build on the first SIGINT/SIGTERM so the running
+// state can stop its child processes and clean up. A second signal forces
+// cedar to exit immediately.
+func handleSignals(cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 2)
+	signalNotify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		logger.Warningf("Received %s, stopping the build and cleaning up. Send it again to force exit.", sig)
+		cancel()
 
-	return nil
+		sig = <-signals
+		logger.Warningf("Received %s again, exiting without cleaning up", sig)
+		exit(exitCodeForced)
+	}()
 }
 
 // parseFlags parses received flags and returns error code accordingly
@@ -74,7 +206,7 @@ func parseFlags(parser *flags.Parser, restoreStdout, restoreStderr func(), stdou
 				restoreStderr()
 				readStdout, err := io.ReadAll(stdout)
 				if err != nil {
-					fmt.Printf("Error reading from stdout: %s\n", err.Error())
+					logger.Errorf("reading from stdout: %s", err.Error())
 					return err, 1
 				}
 				fmt.Println(string(readStdout))
@@ -85,16 +217,16 @@ func parseFlags(parser *flags.Parser, restoreStdout, restoreStderr func(), stdou
 					restoreStderr()
 					readStderr, err := io.ReadAll(stderr)
 					if err != nil {
-						fmt.Printf("Error reading from stderr: %s\n", err.Error())
+						logger.Errorf("reading from stderr: %s", err.Error())
 						return err, 1
 					}
-					fmt.Printf("Error: %s\n", string(readStderr))
+					logger.Errorf("%s", string(readStderr))
 					return e, 1
 				}
 			default:
 				restoreStdout()
 				restoreStderr()
-				fmt.Printf("Error: %s\n", err.Error())
+				logger.Errorf("%s", err.Error())
 				return e, 1
 			}
 		}
@@ -103,6 +235,17 @@ func parseFlags(parser *flags.Parser, restoreStdout, restoreStderr func(), stdou
 }
 
 func main() { //nolint: gocyclo
+	subcommandParser, err := newSubcommandParser()
+	if err != nil {
+		logger.Errorf("%s", err.Error())
+		exit(1)
+		return
+	}
+	if isSubcommand(subcommandParser, os.Args[1:]) {
+		exit(runSubcommand(subcommandParser, os.Args[1:]))
+		return
+	}
+
 	commonOpts := new(commands.CommonOpts)
 	stateMachineOpts := new(commands.StateMachineOpts)
 	cedarOpts := new(commands.ClassicOpts)
@@ -110,23 +253,24 @@ func main() { //nolint: gocyclo
 
 	// set up the go-flags parser for command line options
 	parser := flags.NewParser(classicCommand, flags.Default)
-	_, err := parser.AddGroup("State Machine Options", stateMachineLongDesc, stateMachineOpts)
+	parser.LongDescription = subcommandsHelp(subcommandParser)
+	_, err = parser.AddGroup("State Machine Options", stateMachineLongDesc, stateMachineOpts)
 	if err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
-		osExit(1)
+		logger.Errorf("%s", err.Error())
+		exit(1)
 		return
 	}
 	_, err = parser.AddGroup("Common Options", "Options common to every command", commonOpts)
 	if err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
-		osExit(1)
+		logger.Errorf("%s", err.Error())
+		exit(1)
 		return
 	}
 
 	_, err = parser.AddGroup("Cedar Options", "Options determining which Cedar stages will be executed.", cedarOpts)
 	if err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
-		osExit(1)
+		logger.Errorf("%s", err.Error())
+		exit(1)
 		return
 	}
 
@@ -134,16 +278,16 @@ func main() { //nolint: gocyclo
 	// so we capture stdout/stderr while parsing and later decide whether to print
 	stdout, restoreStdout, err := captureStd(&os.Stdout)
 	if err != nil {
-		fmt.Printf("Failed to capture stdout: %s\n", err.Error())
-		osExit(1)
+		logger.Errorf("Failed to capture stdout: %s", err.Error())
+		exit(1)
 		return
 	}
 	defer restoreStdout()
 
 	stderr, restoreStderr, err := captureStd(&os.Stderr)
 	if err != nil {
-		fmt.Printf("Failed to capture stderr: %s\n", err.Error())
-		osExit(1)
+		logger.Errorf("Failed to capture stderr: %s", err.Error())
+		exit(1)
 		return
 	}
 	defer restoreStderr()
@@ -151,7 +295,7 @@ func main() { //nolint: gocyclo
 	// Parse the options provided and handle specific errors
 	err, code := parseFlags(parser, restoreStdout, restoreStderr, stdout, stderr, commonOpts.Version)
 	if err != nil {
-		osExit(code)
+		exit(code)
 		return
 	}
 
@@ -159,30 +303,72 @@ func main() { //nolint: gocyclo
 	restoreStdout()
 	restoreStderr()
 
+	// we expect Version to be supplied at build time or fetched from the snap environment
+	if Version == "" {
+		Version = os.Getenv("SNAP_VERSION")
+	}
+
 	// in case user only requested version number, print and exit
 	if commonOpts.Version {
-		// we expect Version to be supplied at build time or fetched from the snap environment
-		if Version == "" {
-			Version = os.Getenv("SNAP_VERSION")
-		}
 		fmt.Printf("cedar %s\n", Version)
-		osExit(0)
+		exit(0)
+		return
+	}
+
+	logger.Configure(logger.LevelFromFlags(commonOpts.Debug, commonOpts.Verbose, commonOpts.Quiet), commonOpts.LogTimestamps)
+	if commonOpts.LogFile != "" {
+		if err := logger.SetLogFile(commonOpts.LogFile); err != nil {
+			logger.Errorf("%s", err.Error())
+			exit(1)
+			return
+		}
+		defer logger.Close()
+	}
+	statemachine.RouteSnapdOutput()
+
+	if cedarOpts.Rootless && os.Geteuid() != 0 && !statemachine.InRootlessNamespace() {
+		exit(runRootless(commonOpts.EventsFD))
+		return
+	}
+	if statemachine.InRootlessNamespace() {
+		if err := statemachine.WaitForIDMappings(); err != nil {
+			logger.Errorf("%s", err.Error())
+			exit(1)
+			return
+		}
+	}
+
+	events, err := setupEvents(commonOpts)
+	if err != nil {
+		logger.Errorf("%s", err.Error())
+		exit(1)
 		return
 	}
 
 	// init the state machine
 	sm, err := initStateMachine(commonOpts, stateMachineOpts, classicCommand, cedarOpts)
 	if err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
-		osExit(1)
+		logger.Errorf("%s", err.Error())
+		exit(1)
 		return
 	}
+	sm.SetEvents(events)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handleSignals(cancel)
+	sm.SetContext(ctx)
 
 	// let the state machine handle the image build
 	err = executeStateMachine(sm)
+	events.Result(err)
 	if err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
-		osExit(1)
+		logger.Errorf("%s", err.Error())
+		if errors.Is(err, statemachine.ErrInterrupted) {
+			exit(exitCodeInterrupted)
+			return
+		}
+		exit(1)
 		return
 	}
 }
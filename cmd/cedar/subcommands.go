@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jessevdk/go-flags"
+
+	"operese/cedar/internal/commands"
+	"operese/cedar/internal/helper"
+	"operese/cedar/internal/logger"
+	"operese/cedar/internal/statemachine"
+)
+
+// helper variables for unit testing
+var statemachineCleanup = statemachine.Cleanup
+var statemachineRunChecks = statemachine.RunChecks
+
+var cleanupLongDesc = `Recover an image tree left behind by a cedar run that crashed or was killed.
+Everything still mounted in the tree is unmounted, the files cedar
+temporarily replaced are restored, the qemu interpreter copied for
+emulation is removed and a stale lock file is removed.
+A tree currently used by a running cedar process is left untouched.`
+
+// cleanupCommand implements the "cleanup" subcommand
+type cleanupCommand struct {
+	commands.CleanupCommand
+}
+
+// Execute is called by go-flags once the cleanup command line was parsed
+func (c *cleanupCommand) Execute(args []string) error {
+	imagePath := c.CleanupArgsPassed.ImagePath
+	fixed, err := statemachineCleanup(imagePath, c.Debug)
+	for _, fix := range fixed {
+		fmt.Println(fix)
+	}
+	if err != nil {
+		return err
+	}
+	if len(fixed) == 0 {
+		fmt.Printf("Nothing to clean up in %s\n", imagePath)
+	}
+	return nil
+}
+
+var doctorLongDesc = `Check that the host meets the prerequisites of a build: privileges,
+AppArmor, cgroup v2, securityfs, ability to mount filesystems, free disk space,
+snap-preseed in the image tree and store reachability.
+The same checks are run automatically before every build.`
+
+// doctorCommand implements the "doctor" subcommand
+type doctorCommand struct {
+	commands.DoctorCommand
+}
+
+// Execute is called by go-flags once the doctor command line was parsed
+func (c *doctorCommand) Execute(args []string) error {
+	results := statemachineRunChecks(statemachine.DoctorOptions{
+		ImagePath: c.DoctorArgsPassed.ImagePath,
+		Preseed:   c.Preseed,
+		Rootless:  c.Rootless,
+	})
+
+	failed := 0
+	for _, result := range results {
+		fmt.Printf("[%s] %s: %s\n", result.Status, result.Name, result.Message)
+		if result.Status == statemachine.CheckFail {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d check(s) failed", failed)
+	}
+	return nil
+}
+
+var hashLongDesc = `Compute the digest of a file, or the stable digest of a directory such as the
+seed of an image tree. The digest of a directory is the digest of the sorted
+"<digest>  <relative path>" lines of its files, as printed by sha256sum.
+With --check, the path is verified against a declared checksum instead.`
+
+// hashCommand implements the "hash" subcommand
+type hashCommand struct {
+	commands.HashCommand
+}
+
+// Execute is called by go-flags once the hash command line was parsed
+func (c *hashCommand) Execute(args []string) error {
+	path := c.HashArgsPassed.Path
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("Error hashing %s: %s", path, err.Error())
+	}
+
+	if c.Check == "" {
+		algorithm := helper.HashAlgorithm(c.Algorithm)
+		digest, err := hashPath(path, info.IsDir(), algorithm)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s  %s\n", helper.Checksum{Algorithm: algorithm, Digest: digest}, path)
+		return nil
+	}
+
+	checksum, err := helper.ParseChecksum(c.Check)
+	if err != nil {
+		return fmt.Errorf("Invalid checksum: %s", err.Error())
+	}
+	if info.IsDir() {
+		digest, err := hashPath(path, true, checksum.Algorithm)
+		if err != nil {
+			return err
+		}
+		if digest != checksum.Digest {
+			return fmt.Errorf("%s: %w: expected %s, got %s:%s", path, helper.ErrChecksumMismatch,
+				checksum, checksum.Algorithm, digest)
+		}
+	} else if err := helper.VerifyFile(path, checksum); err != nil {
+		return err
+	}
+	fmt.Printf("%s: OK\n", path)
+	return nil
+}
+
+// hashPath returns the digest of a file or directory
+func hashPath(path string, isDir bool, algorithm helper.HashAlgorithm) (string, error) {
+	if isDir {
+		return helper.HashDir(path, algorithm)
+	}
+	return helper.HashFile(path, algorithm)
+}
+
+var verifyLongDesc = `Compare two image trees byte for byte, to prove that a build is reproducible.
+Paths present in only one tree and differences of type, mode, ownership,
+modification time, content or symlink target are listed.
+Build with --reproducible and the same SOURCE_DATE_EPOCH to get identical trees.`
+
+// verifyCommand implements the "verify" subcommand
+type verifyCommand struct {
+	commands.VerifyCommand
+}
+
+// Execute is called by go-flags once the verify command line was parsed
+func (c *verifyCommand) Execute(args []string) error {
+	differences, err := helper.DiffTrees(c.VerifyArgsPassed.FirstTree, c.VerifyArgsPassed.SecondTree)
+	if err != nil {
+		return err
+	}
+	for _, difference := range differences {
+		fmt.Println(difference)
+	}
+	if len(differences) > 0 {
+		return fmt.Errorf("the trees differ: %d difference(s)", len(differences))
+	}
+	fmt.Println("The trees are identical")
+	return nil
+}
+
+// newSubcommandParser returns the parser handling the commands that can be
+// given instead of the image path to build
+func newSubcommandParser() (*flags.Parser, error) {
+	parser := flags.NewNamedParser("cedar", flags.HelpFlag|flags.PassDoubleDash)
+	_, err := parser.AddCommand("cleanup", "Recover an image tree after a crashed run",
+		cleanupLongDesc, &cleanupCommand{})
+	if err != nil {
+		return nil, err
+	}
+	_, err = parser.AddCommand("doctor", "Check the host prerequisites of a build",
+		doctorLongDesc, &doctorCommand{})
+	if err != nil {
+		return nil, err
+	}
+	_, err = parser.AddCommand("hash", "Compute or verify the digest of a file or directory",
+		hashLongDesc, &hashCommand{})
+	if err != nil {
+		return nil, err
+	}
+	_, err = parser.AddCommand("verify", "Check that two image trees are identical",
+		verifyLongDesc, &verifyCommand{})
+	if err != nil {
+		return nil, err
+	}
+	return parser, nil
+}
+
+// subcommandsHelp lists the available subcommands, to be added to the
+// help of the main command
+func subcommandsHelp(parser *flags.Parser) string {
+	help := []string{"Other commands (run \"cedar COMMAND --help\" for details):"}
+	for _, cmd := range parser.Commands() {
+		help = append(help, fmt.Sprintf("  %-10s %s", cmd.Name, cmd.ShortDescription))
+	}
+	return strings.Join(help, "\n")
+}
+
+// isSubcommand checks whether the first argument names a subcommand rather
+// than an image path. To build an image in a directory with the same name
+// as a subcommand, a path such as ./cleanup must be used.
+func isSubcommand(parser *flags.Parser, args []string) bool {
+	return len(args) > 0 && parser.Find(args[0]) != nil
+}
+
+// runSubcommand parses the arguments, executes the matching subcommand
+// and returns the exit code
+func runSubcommand(parser *flags.Parser, args []string) int {
+	_, err := parser.ParseArgs(args)
+	if err == nil {
+		return 0
+	}
+	if e, ok := err.(*flags.Error); ok && e.Type == flags.ErrHelp {
+		fmt.Println(e.Message)
+		return 0
+	}
+	logger.Errorf("%s", err.Error())
+	return 1
+}
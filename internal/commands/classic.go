@@ -1,5 +1,7 @@
 package commands
 
+import "time"
+
 // ClassicArgs holds the gadget tree. positional arguments need their own struct
 type ClassicArgs struct {
 	ImagePath string `positional-arg-name:"image_path" description:"The path to the Ubuntu image where the snaps are to be preseeded. It could have been created with cedar or another tool."`
@@ -7,7 +9,22 @@ type ClassicArgs struct {
 }
 
 type ClassicOpts struct {
-	Preseed bool `long:"preseed" required:"false" description:"Whether or not to run snap-preseed in the image to speed up first boot. Only works on hosts using AppArmor."`
+	Preseed          bool          `long:"preseed" required:"false" description:"Whether or not to run snap-preseed in the image to speed up first boot. Only works on hosts using AppArmor."`
+	Wait             time.Duration `long:"wait" description:"If another cedar process is working on the image tree, wait up to DURATION (e.g. 10m) for it to finish instead of failing." value-name:"DURATION"`
+	Rootless         bool          `long:"rootless" description:"When not run as root, run the build in a user namespace where the current user is mapped to root and its subordinate IDs of /etc/subuid and /etc/subgid to the other users and groups. The image tree must be owned by the current user."`
+	SkipPreflight    bool          `long:"skip-preflight" description:"Do not check the host prerequisites before starting the build."`
+	SetDefaultLocale bool          `long:"set-default-locale" description:"Set the default locale of the image to C.UTF-8 if none is configured. Can also be enabled with set-default-locale in the snap list."`
+	CleanRootfs      bool          `long:"clean-rootfs" description:"Remove secrets and generated values (machine-id, SSH host keys...) from the image tree at the end of the build. Can also be enabled with clean-rootfs in the snap list."`
+	Report           string        `long:"report" description:"Write a JSON report of the build to FILE: snap list hash, host, detected architecture and series, seeded snaps with their revision, channel, digest, size, publisher and why they were included, state durations and store endpoints." value-name:"FILE"`
+	Manifest         string        `long:"manifest" description:"Write the manifest of the seeded snaps to FILE after prepare_image, with their name, revision, channel and SHA3-384 digest." value-name:"FILE"`
+	ManifestFormat   string        `long:"manifest-format" description:"Format of the manifest written with --manifest" choice:"text" choice:"json" default:"text"` //nolint:staticcheck,SA5008
+	SBOMSPDX         string        `long:"sbom-spdx" description:"Write an SPDX 2.3 JSON SBOM of the seeded snaps to FILE after prepare_image" value-name:"FILE"`
+	SBOMCycloneDX    string        `long:"sbom-cyclonedx" description:"Write a CycloneDX 1.5 JSON SBOM of the seeded snaps to FILE after prepare_image" value-name:"FILE"`
+	Provenance       string        `long:"provenance" description:"Write an in-toto statement with a SLSA provenance predicate of the build to FILE. Its subject is the digest of the seed directory." value-name:"FILE"`
+	ProvenanceKey    string        `long:"provenance-key" description:"Sign the provenance with the PKCS #8 PEM private key in FILE (ed25519, ECDSA or RSA) and write it as a DSSE envelope" value-name:"FILE"`
+	AuditLog         string        `long:"audit-log" description:"Write to FILE a JSON list of the paths the build added, modified or deleted in the image tree, with their size, mode, owner, SHA256 and the states that changed them." value-name:"FILE"`
+	MaxSeedSize      string        `long:"max-seed-size" description:"Fail the build if the seed is larger than SIZE or if the build grows the image tree by more than SIZE, listing the largest contributors. The growth is not checked when --skip or --only leaves out the first state. SIZE is in bytes or has a M or G suffix. Takes precedence over max-seed-size in the snap list." value-name:"SIZE"`
+	Reproducible     bool          `long:"reproducible" description:"Make the image tree reproducible: sort the seed, and clamp the timestamps of the preseeded state and the modification times of the files the build wrote to the SOURCE_DATE_EPOCH environment variable. The other files of the tree keep their times."`
 }
 
 type ClassicCommand struct {
@@ -0,0 +1,12 @@
+package commands
+
+// CleanupArgs holds the positional arguments of the cleanup command
+type CleanupArgs struct {
+	ImagePath string `positional-arg-name:"image_path" description:"The path to the image tree left behind by a cedar run that did not complete."`
+}
+
+// CleanupCommand holds the arguments and options of the cleanup command
+type CleanupCommand struct {
+	CleanupArgsPassed CleanupArgs `positional-args:"true" required:"true"`
+	Debug             bool        `long:"debug" description:"Enable debugging output"`
+}
@@ -12,11 +12,17 @@ type CommonOpts struct {
 	Validation string `long:"validation" description:"Control whether validations should be ignored or enforced" choice:"ignore" choice:"enforce"` //nolint:staticcheck,SA5008
 	// The library we use to handle command-line flags (github.com/jessevdk/go-flags) relies on this method to list valid values for a flag, even though this is not a recommended way.
 	// Ignore these warnings until we use another library.
-	DryRun bool `long:"dry-run" description:"Print the states to be executed to build the image and return."`
+	DryRun        bool   `long:"dry-run" description:"Print the states to be executed to build the image and return."`
+	Output        string `long:"output" description:"Format of the progress output. With json, newline-delimited JSON events are written to stdout and the usual output to stderr, unless --events-fd is given." choice:"text" choice:"json" default:"text"` //nolint:staticcheck,SA5008
+	EventsFD      int    `long:"events-fd" description:"Write the JSON events of --output json to the already open file descriptor FD instead of stdout." value-name:"FD"`
+	LogTimestamps bool   `long:"log-timestamps" description:"Prefix every line of output with a timestamp"`
+	LogFile       string `long:"log-file" description:"Also write the complete debug output, with timestamps, to FILE" value-name:"FILE"`
 }
 
 // StateMachineOpts stores the options that are related to the state machine
 type StateMachineOpts struct {
-	Until string `short:"u" long:"until" description:"Run the state machine until the given STEP, non-inclusively. STEP must be the name of the step." value-name:"STEP" default:""`
-	Thru  string `short:"t" long:"thru" description:"Run the state machine through the given STEP, inclusively. STEP must be the name of the step." value-name:"STEP" default:""`
+	Until string   `short:"u" long:"until" description:"Run the state machine until the given STEP, non-inclusively. STEP must be the name of the step." value-name:"STEP" default:""`
+	Thru  string   `short:"t" long:"thru" description:"Run the state machine through the given STEP, inclusively. STEP must be the name of the step." value-name:"STEP" default:""`
+	Skip  []string `long:"skip" description:"Do not run the given STEP. Can be repeated to skip several steps." value-name:"STEP"`
+	Only  string   `long:"only" description:"Only run the given STEP. The image tree must already contain what the previous steps produce." value-name:"STEP" default:""`
 }
@@ -0,0 +1,13 @@
+package commands
+
+// DoctorArgs holds the positional arguments of the doctor command
+type DoctorArgs struct {
+	ImagePath string `positional-arg-name:"image_path" description:"The path to the Ubuntu image to check. Checks of the image tree are skipped if not given."`
+}
+
+// DoctorCommand holds the arguments and options of the doctor command
+type DoctorCommand struct {
+	DoctorArgsPassed DoctorArgs `positional-args:"true"`
+	Preseed          bool       `long:"preseed" description:"Check the prerequisites of a build using --preseed"`
+	Rootless         bool       `long:"rootless" description:"Check the prerequisites of a build using --rootless"`
+}
@@ -0,0 +1,13 @@
+package commands
+
+// HashArgs holds the positional arguments of the hash command
+type HashArgs struct {
+	Path string `positional-arg-name:"path" description:"The file or directory to hash, for example the var/lib/snapd/seed directory of an image tree."`
+}
+
+// HashCommand holds the arguments and options of the hash command
+type HashCommand struct {
+	HashArgsPassed HashArgs `positional-args:"true" required:"true"`
+	Algorithm      string   `long:"algorithm" description:"The hash algorithm to use" choice:"sha256" choice:"sha512" choice:"sha3-384" default:"sha256"` //nolint:staticcheck,SA5008
+	Check          string   `long:"check" description:"Verify the path against CHECKSUM, in the algorithm:digest form, instead of printing its digest. The algorithm of the checksum is used." value-name:"CHECKSUM"`
+}
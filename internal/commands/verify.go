@@ -0,0 +1,12 @@
+package commands
+
+// VerifyArgs holds the positional arguments of the verify command
+type VerifyArgs struct {
+	FirstTree  string `positional-arg-name:"first_tree" description:"The image tree of a first build."`
+	SecondTree string `positional-arg-name:"second_tree" description:"The image tree of a second build of the same snap list."`
+}
+
+// VerifyCommand holds the arguments of the verify command
+type VerifyCommand struct {
+	VerifyArgsPassed VerifyArgs `positional-args:"true" required:"true"`
+}
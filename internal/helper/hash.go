@@ -0,0 +1,204 @@
+package helper
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// HashAlgorithm is the name of a supported hash algorithm
+type HashAlgorithm string
+
+const (
+	SHA256   HashAlgorithm = "sha256"
+	SHA512   HashAlgorithm = "sha512"
+	SHA3_384 HashAlgorithm = "sha3-384"
+)
+
+// HashAlgorithms lists the supported hash algorithms
+var HashAlgorithms = []HashAlgorithm{SHA256, SHA512, SHA3_384}
+
+// ErrChecksumMismatch is returned when content does not match its declared checksum
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// NewHash returns a hash.Hash for the given algorithm
+func NewHash(algorithm HashAlgorithm) (hash.Hash, error) {
+	switch algorithm {
+	case SHA256:
+		return sha256.New(), nil
+	case SHA512:
+		return sha512.New(), nil
+	case SHA3_384:
+		return sha3.New384(), nil
+	}
+	return nil, fmt.Errorf("unsupported hash algorithm \"%s\"", algorithm)
+}
+
+// HashReader returns the hex encoded digest of everything read from r
+func HashReader(r io.Reader, algorithm HashAlgorithm) (string, error) {
+	hasher, err := NewHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(hasher, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// HashFile returns the hex encoded digest of a file
+func HashFile(path string, algorithm HashAlgorithm) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("Error opening file \"%s\" to calculate %s sum: \"%s\"", path, algorithm, err.Error())
+	}
+	defer f.Close()
+
+	digest, err := HashReader(f, algorithm)
+	if err != nil {
+		return "", fmt.Errorf("Error calculating %s sum of file \"%s\": \"%s\"", algorithm, path, err.Error())
+	}
+	return digest, nil
+}
+
+// HashDir returns a stable digest of a directory: the digest of the sorted
+// "<digest of the file>  <path relative to the directory>" lines of its
+// regular files, like the output of sha256sum. Symlinks are listed with the
+// digest of their target path, other special files are ignored.
+func HashDir(dir string, algorithm HashAlgorithm) (string, error) {
+	return HashDirReusing(dir, algorithm, nil)
+}
+
+// HashDirReusing is HashDir, reusing the digests already computed for some
+// of the regular files of the directory, keyed by their path
+func HashDirReusing(dir string, algorithm HashAlgorithm, known map[string]string) (string, error) {
+	lines := make([]string, 0)
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		var digest string
+		switch {
+		case entry.Type().IsRegular():
+			var found bool
+			if digest, found = known[path]; !found {
+				digest, err = HashFile(path, algorithm)
+			}
+		case entry.Type()&fs.ModeSymlink != 0:
+			var target string
+			target, err = os.Readlink(path)
+			if err == nil {
+				digest, err = HashReader(strings.NewReader(target), algorithm)
+			}
+		default:
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		lines = append(lines, fmt.Sprintf("%s  %s\n", digest, relPath))
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("Error calculating %s sum of directory \"%s\": \"%s\"", algorithm, dir, err.Error())
+	}
+
+	sort.Strings(lines)
+	return HashReader(strings.NewReader(strings.Join(lines, "")), algorithm)
+}
+
+// Checksum is a declared digest of some content
+type Checksum struct {
+	Algorithm HashAlgorithm
+	// Digest is hex encoded
+	Digest string
+}
+
+// String returns the checksum in the algorithm:digest form
+func (c Checksum) String() string {
+	return string(c.Algorithm) + ":" + c.Digest
+}
+
+// ParseChecksum parses a checksum in the algorithm:digest form, e.g.
+// sha256:4f2c... A digest without algorithm is a sha256 one.
+func ParseChecksum(checksum string) (Checksum, error) {
+	algorithm, digest, found := strings.Cut(checksum, ":")
+	if !found {
+		algorithm, digest = string(SHA256), checksum
+	}
+	hasher, err := NewHash(HashAlgorithm(algorithm))
+	if err != nil {
+		return Checksum{}, err
+	}
+	decoded, err := hex.DecodeString(digest)
+	if err != nil || len(decoded) != hasher.Size() {
+		return Checksum{}, fmt.Errorf("invalid %s digest \"%s\"", algorithm, digest)
+	}
+	return Checksum{Algorithm: HashAlgorithm(algorithm), Digest: strings.ToLower(digest)}, nil
+}
+
+// verifyingReader hashes what is read through it and fails at the end of
+// the content if it does not match the expected checksum
+type verifyingReader struct {
+	r        io.Reader
+	hasher   hash.Hash
+	expected Checksum
+}
+
+// NewVerifyingReader returns a reader verifying the content of r against
+// the checksum while it is read, so large files such as tarballs and snaps
+// are only read once. Reading the end of a mismatching content returns an
+// error wrapping ErrChecksumMismatch instead of io.EOF.
+func NewVerifyingReader(r io.Reader, expected Checksum) (io.Reader, error) {
+	hasher, err := NewHash(expected.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return &verifyingReader{r: r, hasher: hasher, expected: expected}, nil
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.hasher.Write(p[:n])
+	if err != io.EOF {
+		return n, err
+	}
+	digest := hex.EncodeToString(v.hasher.Sum(nil))
+	if digest != v.expected.Digest {
+		return n, fmt.Errorf("%w: expected %s, got %s:%s", ErrChecksumMismatch, v.expected, v.expected.Algorithm, digest)
+	}
+	return n, io.EOF
+}
+
+// VerifyFile checks that a file matches its declared checksum
+func VerifyFile(path string, expected Checksum) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Error opening file \"%s\" to verify its checksum: \"%s\"", path, err.Error())
+	}
+	defer f.Close()
+
+	r, err := NewVerifyingReader(f, expected)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return fmt.Errorf("Error verifying file \"%s\": %w", path, err)
+	}
+	return nil
+}
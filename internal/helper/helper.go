@@ -2,7 +2,7 @@ package helper
 
 import (
 	"bytes"
-	"crypto/sha256"
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -10,6 +10,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"strings"
+	"syscall"
 
 	"github.com/invopop/jsonschema"
 	"github.com/snapcore/snapd/gadget/quantity"
@@ -17,6 +18,7 @@ import (
 	"github.com/xeipuuv/gojsonschema"
 
 	"operese/cedar/internal/commands"
+	"operese/cedar/internal/logger"
 )
 
 // define some functions that can be mocked by test cases
@@ -58,13 +60,21 @@ func InitCommonOpts() (*commands.CommonOpts, *commands.StateMachineOpts) {
 	return commonOpts, new(commands.StateMachineOpts)
 }
 
-// RunScript runs scripts from disk. Currently only used for hooks
-func RunScript(hookScript string) error {
+// RunScript runs scripts from disk. Currently only used for hooks.
+// The given variables are added to the environment of cedar, and the script
+// is terminated if the context is cancelled.
+func RunScript(ctx context.Context, hookScript string, env []string) error {
 	hookScriptCmd := exec.Command(hookScript)
-	hookScriptCmd.Env = os.Environ()
-	hookScriptCmd.Stdout = os.Stdout
-	hookScriptCmd.Stderr = os.Stderr
-	if err := hookScriptCmd.Run(); err != nil {
+	hookScriptCmd.Env = append(os.Environ(), env...)
+	hookScriptCmd.Stdout = logger.Writer(logger.LevelInfo)
+	hookScriptCmd.Stderr = logger.Writer(logger.LevelInfo)
+	hookScriptCmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	err := hookScriptCmd.Start()
+	if err == nil {
+		err = waitCmd(ctx, hookScriptCmd)
+	}
+	if err != nil {
 		return fmt.Errorf("Error running hook script %s: %s", hookScript, err.Error())
 	}
 	return nil
@@ -329,21 +339,25 @@ func SliceHasElement(haystack []string, needle string) bool {
 	return found
 }
 
-// SetCommandOutput sets the output of a command to either use a multiwriter
-// or behave as a normal command and store the output in a buffer
+// SetCommandOutput sends the output of a command to the logger, printed
+// live by default if liveOutput is set or only with --debug otherwise, and
+// stores it in a buffer
 func SetCommandOutput(cmd *exec.Cmd, liveOutput bool) (cmdOutput *bytes.Buffer) {
 	var cmdOutputBuffer bytes.Buffer
 	cmdOutput = &cmdOutputBuffer
-	cmd.Stdout = cmdOutput
-	cmd.Stderr = cmdOutput
+	level := logger.LevelDebug
 	if liveOutput {
-		mwriter := io.MultiWriter(os.Stdout, cmdOutput)
-		cmd.Stdout = mwriter
-		cmd.Stderr = mwriter
+		level = logger.LevelInfo
 	}
+	mwriter := io.MultiWriter(logger.Writer(level), cmdOutput)
+	cmd.Stdout = mwriter
+	cmd.Stderr = mwriter
 	return cmdOutput
 }
 
+// RunCmd runs a command in the process group of cedar, so it receives the
+// signals sent to cedar from the terminal. Commands that must be stopped when
+// the build is cancelled are run with RunCmdContext instead.
 func RunCmd(cmd *exec.Cmd, debug bool) error {
 	output := SetCommandOutput(cmd, debug)
 	err := cmd.Run()
@@ -354,6 +368,48 @@ func RunCmd(cmd *exec.Cmd, debug bool) error {
 	return nil
 }
 
+// RunCmdContext runs a command in its own process group. If the context is
+// cancelled before the command exits, the whole process group is sent SIGTERM
+// and the command is waited for, so no child process outlives the call.
+// Being in its own process group, the command does not receive the signals
+// sent to cedar from the terminal: only the cancellation of ctx stops it.
+func RunCmdContext(ctx context.Context, cmd *exec.Cmd, debug bool) error {
+	output := SetCommandOutput(cmd, debug)
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+
+	err := cmd.Start()
+	if err == nil {
+		err = waitCmd(ctx, cmd)
+	}
+	if err != nil {
+		return fmt.Errorf("Error running command \"%s\". Error: %s. Output:\n%s",
+			cmd.String(), err.Error(), output.String())
+	}
+	return nil
+}
+
+// waitCmd waits for a started command, terminating its process group if the
+// context is cancelled in the meantime
+func waitCmd(ctx context.Context, cmd *exec.Cmd) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		// a negative pid targets the process group
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+		<-done
+		return ctx.Err()
+	}
+}
+
 // RunCmds runs a list of commands and returns the error
 // It stops at the first error
 func RunCmds(cmds []*exec.Cmd, debug bool) error {
@@ -375,21 +431,9 @@ func SafeQuantitySubtraction(orig, subtract quantity.Size) quantity.Size {
 	return orig - subtract
 }
 
-// CalculateSHA256 calculates the SHA256 sum of the file provided as an argument
+// CalculateSHA256 calculates the hex encoded SHA256 sum of the file provided as an argument
 func CalculateSHA256(fileName string) (string, error) {
-	f, err := os.Open(fileName)
-	if err != nil {
-		return "", fmt.Errorf("Error opening file \"%s\" to calculate SHA256 sum: \"%s\"", fileName, err.Error())
-	}
-	defer f.Close()
-
-	hasher := sha256.New()
-	_, err = io.Copy(hasher, f)
-	if err != nil {
-		return "", fmt.Errorf("Error calculating SHA256 sum of file \"%s\": \"%s\"", fileName, err.Error())
-	}
-
-	return string(hasher.Sum(nil)), nil
+	return HashFile(fileName, SHA256)
 }
 
 // CheckTags iterates through the keys in a struct and looks for
@@ -491,7 +535,8 @@ func RestoreResolvConf(chroot string) error {
 const backupExt = ".REAL"
 
 // BackupReplace backup the target file and replace it with the given content
-// Returns the restore function.
+// Returns the restore function. If the target does not exist, it is created
+// and the restore function removes it.
 func BackupReplace(target string, content string) (func(error) error, error) {
 	backup := target + backupExt
 	if osutilFileExists(backup) {
@@ -499,6 +544,13 @@ func BackupReplace(target string, content string) (func(error) error, error) {
 		return nil, nil
 	}
 
+	if !osutilFileExists(target) {
+		if err := osWriteFile(target, []byte(content), 0755); err != nil {
+			return nil, fmt.Errorf("Error writing to %s : %s", target, err.Error())
+		}
+		return genRemoveFile(target), nil
+	}
+
 	if err := osRename(target, backup); err != nil {
 		return nil, fmt.Errorf("Error moving file \"%s\" to \"%s\": %s", target, backup, err.Error())
 	}
@@ -510,6 +562,35 @@ func BackupReplace(target string, content string) (func(error) error, error) {
 	return genRestoreFile(target), nil
 }
 
+// BackupPath returns the path of the backup BackupReplace makes of target
+func BackupPath(target string) string {
+	return target + backupExt
+}
+
+// RestoreBackup restores the target file from the backup created by
+// BackupReplace, if there is one
+func RestoreBackup(target string) error {
+	backup := BackupPath(target)
+	if !osutilFileExists(backup) {
+		return nil
+	}
+	if err := osRename(backup, target); err != nil {
+		return fmt.Errorf("Error moving file \"%s\" to \"%s\": %s", backup, target, err.Error())
+	}
+	return nil
+}
+
+// genRemoveFile returns the function to be called to remove a file created
+// by BackupReplace
+func genRemoveFile(target string) func(err error) error {
+	return func(err error) error {
+		if removeErr := osRemove(target); removeErr != nil && !os.IsNotExist(removeErr) {
+			return joinErr(err, fmt.Errorf("Error removing %s: %s", target, removeErr.Error()))
+		}
+		return err
+	}
+}
+
 // genRestoreFile returns the function to be called to restore the backuped file
 func genRestoreFile(target string) func(err error) error {
 	return func(err error) error {
@@ -520,9 +601,71 @@ func genRestoreFile(target string) func(err error) error {
 
 		if tmpErr := osRename(src, target); tmpErr != nil {
 			tmpErr = fmt.Errorf("Error moving file \"%s\" to \"%s\": %s", src, target, tmpErr.Error())
-			return fmt.Errorf("%s\n%s", err, tmpErr)
+			return joinErr(err, tmpErr)
 		}
 
 		return err
 	}
 }
+
+// joinErr adds the error of a function restoring a file to an already
+// existing error, which may be nil
+func joinErr(err error, restoreErr error) error {
+	if err == nil {
+		return restoreErr
+	}
+	return fmt.Errorf("%w\n%s", err, restoreErr.Error())
+}
+
+// maxSymlinks is the number of symlinks followed by ResolveInRoot before
+// giving up, like the kernel does with ELOOP
+const maxSymlinks = 255
+
+// ResolveInRoot resolves path inside root the way it would be from a chroot:
+// symlinks are followed, but absolute ones and ".." are interpreted relative
+// to root, so the result can never be outside of it. Missing components are
+// kept as is.
+func ResolveInRoot(root string, path string) (string, error) {
+	resolved := "/"
+	remaining := path
+	links := 0
+	for remaining != "" {
+		var component string
+		component, remaining, _ = strings.Cut(strings.TrimLeft(remaining, "/"), "/")
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, component)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return "", fmt.Errorf("Error resolving \"%s\" in \"%s\": %s", path, root, err.Error())
+			}
+			resolved = next
+			continue
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("Error resolving \"%s\" in \"%s\": too many levels of symbolic links", path, root)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", fmt.Errorf("Error resolving \"%s\" in \"%s\": %s", path, root, err.Error())
+		}
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		remaining = target + "/" + remaining
+	}
+	return filepath.Join(root, resolved), nil
+}
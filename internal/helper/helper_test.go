@@ -1,13 +1,20 @@
 package helper
 
 import (
+	"context"
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/invopop/jsonschema"
+	"github.com/snapcore/snapd/gadget/quantity"
 	"github.com/snapcore/snapd/osutil"
 	"github.com/xeipuuv/gojsonschema"
 )
@@ -510,6 +517,464 @@ func TestBackupReplace(t *testing.T) {
 	})
 	err = restoreFunc(nil)
 	asserter.AssertErrContains(err, "Error moving file")
+	if strings.Contains(err.Error(), "<nil>") {
+		t.Errorf("Unexpected nil error in \"%s\"", err.Error())
+	}
 
 	osRename = os.Rename
 }
+
+// TestGenRemoveFile tests that the error of the removal is joined to the previous one
+func TestGenRemoveFile(t *testing.T) {
+	asserter := Asserter{T: t}
+	target := filepath.Join(t.TempDir(), "policy-rc.d")
+	asserter.AssertErrNil(os.WriteFile(target, nil, 0755), true)
+
+	osRemove = mockRemove
+	t.Cleanup(func() {
+		osRemove = os.Remove
+	})
+	removeFunc := genRemoveFile(target)
+
+	err := removeFunc(nil)
+	asserter.AssertErrContains(err, "Error removing "+target)
+	if strings.Contains(err.Error(), "<nil>") {
+		t.Errorf("Unexpected nil error in \"%s\"", err.Error())
+	}
+
+	buildErr := errors.New("build failed")
+	err = removeFunc(buildErr)
+	asserter.AssertErrContains(err, "build failed\nError removing "+target)
+	if !errors.Is(err, buildErr) {
+		t.Errorf("The previous error is not wrapped in \"%s\"", err.Error())
+	}
+
+	osRemove = os.Remove
+	asserter.AssertErrNil(removeFunc(nil), true)
+	asserter.AssertErrNil(removeFunc(nil), true)
+	asserter.AssertEqual(false, osutil.FileExists(target))
+}
+
+// TestRunCmdContext tests that a running command is stopped when the context is cancelled
+func TestRunCmdContext(t *testing.T) {
+	t.Parallel()
+	asserter := Asserter{T: t}
+
+	err := RunCmdContext(context.Background(), exec.Command("true"), false)
+	asserter.AssertErrNil(err, true)
+
+	err = RunCmdContext(context.Background(), exec.Command("false"), false)
+	asserter.AssertErrContains(err, "Error running command")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	t.Cleanup(cancel)
+	start := time.Now()
+	// the sleep is a grandchild of the command, so this also checks
+	// that the whole process group is terminated
+	err = RunCmdContext(ctx, exec.Command("sh", "-c", "sleep 30; true"), false)
+	asserter.AssertErrContains(err, context.DeadlineExceeded.Error())
+	if time.Since(start) > 10*time.Second {
+		t.Errorf("Command was not stopped when the context was cancelled")
+	}
+}
+
+// TestRunCmd tests that commands run without a context stay in the process group of cedar
+func TestRunCmd(t *testing.T) {
+	t.Parallel()
+	asserter := Asserter{T: t}
+
+	cmd := exec.Command("true")
+	asserter.AssertErrNil(RunCmd(cmd, false), true)
+	if cmd.SysProcAttr != nil && cmd.SysProcAttr.Setpgid {
+		t.Errorf("Command was run in its own process group")
+	}
+
+	err := RunCmd(exec.Command("false"), false)
+	asserter.AssertErrContains(err, "Error running command")
+}
+
+// TestRestoreBackup tests that backups made by BackupReplace are found and restored
+func TestRestoreBackup(t *testing.T) {
+	asserter := Asserter{T: t}
+	workDir := filepath.Join("/tmp", "cedar-"+uuid.NewString())
+	err := os.Mkdir(workDir, 0755)
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(workDir) })
+
+	mainTargetPath, err := prepareMainFileToBackup(workDir)
+	asserter.AssertErrNil(err, true)
+	_, err = BackupReplace(mainTargetPath, "Replaced")
+	asserter.AssertErrNil(err, true)
+
+	asserter.AssertEqual(mainTargetPath+backupExt, BackupPath(mainTargetPath))
+
+	err = RestoreBackup(mainTargetPath)
+	asserter.AssertErrNil(err, true)
+	content, err := os.ReadFile(mainTargetPath)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("Main", string(content))
+	if osutil.FileExists(mainTargetPath + backupExt) {
+		t.Errorf("Backup file has not been removed")
+	}
+
+	// nothing to restore anymore
+	err = RestoreBackup(mainTargetPath)
+	asserter.AssertErrNil(err, true)
+
+	// a failed rename is reported as is
+	_, err = BackupReplace(mainTargetPath, "Replaced")
+	asserter.AssertErrNil(err, true)
+	osRename = mockRename
+	t.Cleanup(func() { osRename = os.Rename })
+	err = RestoreBackup(mainTargetPath)
+	asserter.AssertErrContains(err, "Error moving file")
+	if strings.HasPrefix(err.Error(), "%!") {
+		t.Errorf("Unexpected error format: %s", err.Error())
+	}
+}
+
+// TestRunScript tests that hook scripts get the given environment
+func TestRunScript(t *testing.T) {
+	asserter := Asserter{T: t}
+	workDir := filepath.Join("/tmp", "cedar-"+uuid.NewString())
+	err := os.Mkdir(workDir, 0755)
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(workDir) })
+
+	script := filepath.Join(workDir, "hook.sh")
+	err = os.WriteFile(script, []byte("#!/bin/sh\necho \"$CEDAR_TEST\" > \"$0.out\"\n"), 0755)
+	asserter.AssertErrNil(err, true)
+
+	err = RunScript(context.Background(), script, []string{"CEDAR_TEST=value"})
+	asserter.AssertErrNil(err, true)
+	content, err := os.ReadFile(script + ".out")
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("value\n", string(content))
+
+	err = RunScript(context.Background(), filepath.Join(workDir, "missing.sh"), nil)
+	asserter.AssertErrContains(err, "Error running hook script")
+}
+
+// TestBackupReplaceMissingTarget tests that a missing target is created and removed on restore
+func TestBackupReplaceMissingTarget(t *testing.T) {
+	asserter := Asserter{T: t}
+	workDir := filepath.Join("/tmp", "cedar-"+uuid.NewString())
+	err := os.Mkdir(workDir, 0755)
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(workDir) })
+
+	target := filepath.Join(workDir, "policy-rc.d")
+	restoreFunc, err := BackupReplace(target, "Replaced")
+	asserter.AssertErrNil(err, true)
+	content, err := os.ReadFile(target)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("Replaced", string(content))
+	if osutil.FileExists(target + backupExt) {
+		t.Errorf("Backup file should not have been created")
+	}
+
+	err = restoreFunc(nil)
+	asserter.AssertErrNil(err, true)
+	if osutil.FileExists(target) {
+		t.Errorf("Created file has not been removed")
+	}
+}
+
+// TestResolveInRoot tests that paths are resolved without escaping the root
+func TestResolveInRoot(t *testing.T) {
+	asserter := Asserter{T: t}
+	root := filepath.Join("/tmp", "cedar-"+uuid.NewString())
+	err := os.MkdirAll(filepath.Join(root, "usr", "lib"), 0755)
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(root) })
+
+	asserter.AssertErrNil(os.Symlink("/usr/lib", filepath.Join(root, "lib")), true)
+	asserter.AssertErrNil(os.Symlink("../../../../etc", filepath.Join(root, "usr", "escape")), true)
+	asserter.AssertErrNil(os.Symlink("loop", filepath.Join(root, "loop")), true)
+
+	testCases := []struct {
+		name     string
+		path     string
+		expected string
+	}{
+		{"plain", "/usr/lib/file", filepath.Join(root, "usr", "lib", "file")},
+		{"relative", "usr/lib", filepath.Join(root, "usr", "lib")},
+		{"absolute_symlink", "/lib/file", filepath.Join(root, "usr", "lib", "file")},
+		{"dotdot", "/../../etc/passwd", filepath.Join(root, "etc", "passwd")},
+		{"escaping_symlink", "/usr/escape/passwd", filepath.Join(root, "etc", "passwd")},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := Asserter{T: t}
+			resolved, err := ResolveInRoot(root, tc.path)
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.expected, resolved)
+		})
+	}
+
+	_, err = ResolveInRoot(root, "/loop/file")
+	asserter.AssertErrContains(err, "too many levels of symbolic links")
+}
+
+// TestCalculateSHA256 tests that the SHA256 sum is hex encoded
+func TestCalculateSHA256(t *testing.T) {
+	asserter := Asserter{T: t}
+	path := filepath.Join(t.TempDir(), "file")
+	asserter.AssertErrNil(os.WriteFile(path, []byte("cedar\n"), 0644), true)
+
+	digest, err := CalculateSHA256(path)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("1759c09d8e232488f01cdeec8b11bb8c51beee226beb70b0667590f1b06b1f81", digest)
+}
+
+// TestHashFile tests the digests of the supported algorithms
+func TestHashFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	err := os.WriteFile(path, []byte("abc"), 0644)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	testCases := []struct {
+		algorithm HashAlgorithm
+		expected  string
+	}{
+		{SHA256, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{SHA512, "ddaf35a193617abacc417349ae20413112e6fa4e89a97ea20a9eeee64b55d39a2192992a274fc1a836ba3c23a3feebbd454d4423643ce80e2a9ac94fa54ca49f"},
+		{SHA3_384, "ec01498288516fc926459f58e2c6ad8df9b473cb0fc08c2596da7cf0e49be4b298d88cea927ac7f539f1edf228376d25"},
+	}
+	for _, tc := range testCases {
+		t.Run(string(tc.algorithm), func(t *testing.T) {
+			asserter := Asserter{T: t}
+			digest, err := HashFile(path, tc.algorithm)
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.expected, digest)
+		})
+	}
+
+	_, err = HashFile(path, "md5")
+	if err == nil {
+		t.Error("Expected an error for an unsupported algorithm, but got none")
+	}
+}
+
+// TestHashDir tests that the digest of a directory only depends on its content
+func TestHashDir(t *testing.T) {
+	asserter := Asserter{T: t}
+	createTree := func(dir string, content string) {
+		asserter.AssertErrNil(os.MkdirAll(filepath.Join(dir, "snaps"), 0755), true)
+		asserter.AssertErrNil(os.WriteFile(filepath.Join(dir, "seed.yaml"), []byte("snaps:\n"), 0644), true)
+		asserter.AssertErrNil(os.WriteFile(filepath.Join(dir, "snaps", "hello_42.snap"), []byte(content), 0600), true)
+		asserter.AssertErrNil(os.Symlink("seed.yaml", filepath.Join(dir, "link")), true)
+	}
+	first := filepath.Join(t.TempDir(), "first")
+	second := filepath.Join(t.TempDir(), "second")
+	third := filepath.Join(t.TempDir(), "third")
+	createTree(first, "hello")
+	createTree(second, "hello")
+	createTree(third, "world")
+
+	firstDigest, err := HashDir(first, SHA256)
+	asserter.AssertErrNil(err, true)
+	secondDigest, err := HashDir(second, SHA256)
+	asserter.AssertErrNil(err, true)
+	thirdDigest, err := HashDir(third, SHA256)
+	asserter.AssertErrNil(err, true)
+
+	asserter.AssertEqual(firstDigest, secondDigest)
+	if firstDigest == thirdDigest {
+		t.Errorf("Expected different digests for different content, got %s twice", firstDigest)
+	}
+}
+
+// TestHashDirReusing tests that the known digests of files are used instead
+// of reading the files again
+func TestHashDirReusing(t *testing.T) {
+	asserter := Asserter{T: t}
+	dir := t.TempDir()
+	snapPath := filepath.Join(dir, "hello_42.snap")
+	asserter.AssertErrNil(os.WriteFile(filepath.Join(dir, "seed.yaml"), []byte("snaps:\n"), 0644), true)
+	asserter.AssertErrNil(os.WriteFile(snapPath, []byte("hello"), 0600), true)
+	expected, err := HashDir(dir, SHA256)
+	asserter.AssertErrNil(err, true)
+	snapDigest, err := HashFile(snapPath, SHA256)
+	asserter.AssertErrNil(err, true)
+
+	digest, err := HashDirReusing(dir, SHA256, map[string]string{snapPath: snapDigest})
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(expected, digest)
+
+	// the file is not read again, so a stale digest is used as is
+	digest, err = HashDirReusing(dir, SHA256, map[string]string{snapPath: strings.Repeat("0", 64)})
+	asserter.AssertErrNil(err, true)
+	if digest == expected {
+		t.Errorf("Expected the known digest of %s to be used", snapPath)
+	}
+}
+
+// TestParseChecksum tests the parsing of declared checksums
+func TestParseChecksum(t *testing.T) {
+	sha256Digest := "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+	testCases := []struct {
+		name     string
+		checksum string
+		expected Checksum
+		wantErr  bool
+	}{
+		{"with_algorithm", "sha256:" + sha256Digest, Checksum{SHA256, sha256Digest}, false},
+		{"without_algorithm", sha256Digest, Checksum{SHA256, sha256Digest}, false},
+		{"uppercase", "sha256:" + strings.ToUpper(sha256Digest), Checksum{SHA256, sha256Digest}, false},
+		{"wrong_length", "sha512:" + sha256Digest, Checksum{}, true},
+		{"not_hex", "sha256:xyz", Checksum{}, true},
+		{"unknown_algorithm", "md5:" + sha256Digest, Checksum{}, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := Asserter{T: t}
+			checksum, err := ParseChecksum(tc.checksum)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("Expected an error for %s, but got none", tc.checksum)
+				}
+				return
+			}
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.expected, checksum)
+		})
+	}
+}
+
+// TestVerifyFile tests the streaming verification of files
+func TestVerifyFile(t *testing.T) {
+	asserter := Asserter{T: t}
+	path := filepath.Join(t.TempDir(), "file")
+	asserter.AssertErrNil(os.WriteFile(path, []byte("abc"), 0644), true)
+
+	err := VerifyFile(path, Checksum{SHA256, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"})
+	asserter.AssertErrNil(err, true)
+
+	err = VerifyFile(path, Checksum{SHA256, strings.Repeat("0", 64)})
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Expected a checksum mismatch, got %v", err)
+	}
+}
+
+// TestClampMtimes tests that only the paths modified after the epoch are clamped
+func TestClampMtimes(t *testing.T) {
+	asserter := Asserter{T: t}
+	root := t.TempDir()
+	epoch := time.Unix(1700000000, 0)
+	older := epoch.Add(-time.Hour)
+
+	asserter.AssertErrNil(os.WriteFile(filepath.Join(root, "new"), []byte("new"), 0644), true)
+	asserter.AssertErrNil(os.WriteFile(filepath.Join(root, "old"), []byte("old"), 0644), true)
+	asserter.AssertErrNil(os.Chtimes(filepath.Join(root, "old"), older, older), true)
+	asserter.AssertErrNil(os.Symlink("old", filepath.Join(root, "link")), true)
+
+	_, err := ClampMtimes(root, epoch)
+	asserter.AssertErrNil(err, true)
+
+	testCases := []struct {
+		path     string
+		expected time.Time
+	}{
+		{"new", epoch},
+		{"old", older},
+		{"link", epoch},
+		{".", epoch},
+	}
+	for _, tc := range testCases {
+		info, err := os.Lstat(filepath.Join(root, tc.path))
+		asserter.AssertErrNil(err, true)
+		if !info.ModTime().Equal(tc.expected) {
+			t.Errorf("Unexpected modification time %s for %s, expected %s", info.ModTime(), tc.path, tc.expected)
+		}
+	}
+}
+
+// TestClampPathMtimes tests that only the given paths modified after the
+// epoch are clamped
+func TestClampPathMtimes(t *testing.T) {
+	asserter := Asserter{T: t}
+	root := t.TempDir()
+	epoch := time.Unix(1700000000, 0)
+	older := epoch.Add(-time.Hour)
+	for _, name := range []string{"written", "untouched", "old"} {
+		asserter.AssertErrNil(os.WriteFile(filepath.Join(root, name), []byte(name), 0644), true)
+	}
+	asserter.AssertErrNil(os.Chtimes(filepath.Join(root, "old"), older, older), true)
+
+	clamped, err := ClampPathMtimes(root, []string{"written", "old", "missing"}, epoch)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(1, clamped)
+
+	for name, expectClamped := range map[string]bool{"written": true, "untouched": false} {
+		info, err := os.Lstat(filepath.Join(root, name))
+		asserter.AssertErrNil(err, true)
+		asserter.AssertEqual(expectClamped, info.ModTime().Equal(epoch))
+	}
+	info, err := os.Lstat(filepath.Join(root, "old"))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(true, info.ModTime().Equal(older))
+}
+
+// TestDiffTrees tests that the differences between two trees are all reported
+func TestDiffTrees(t *testing.T) {
+	asserter := Asserter{T: t}
+	first := t.TempDir()
+	second := t.TempDir()
+	mtime := time.Unix(1700000000, 0)
+
+	for _, root := range []string{first, second} {
+		asserter.AssertErrNil(os.WriteFile(filepath.Join(root, "same"), []byte("same"), 0644), true)
+		asserter.AssertErrNil(os.WriteFile(filepath.Join(root, "content"), []byte(root), 0644), true)
+		asserter.AssertErrNil(os.WriteFile(filepath.Join(root, "mode"), []byte("mode"), 0644), true)
+		asserter.AssertErrNil(os.Symlink(filepath.Base(root), filepath.Join(root, "link")), true)
+	}
+	asserter.AssertErrNil(os.Chmod(filepath.Join(second, "mode"), 0600), true)
+	asserter.AssertErrNil(os.WriteFile(filepath.Join(second, "extra"), []byte("extra"), 0644), true)
+	for _, root := range []string{first, second} {
+		_, err := ClampMtimes(root, mtime)
+		asserter.AssertErrNil(err, true)
+	}
+
+	differences, err := DiffTrees(first, second)
+	asserter.AssertErrNil(err, true)
+	expected := []string{
+		"content: content differs",
+		"extra: only in " + second,
+		fmt.Sprintf("link: symlink target %s != %s", filepath.Base(first), filepath.Base(second)),
+		"mode: mode -rw-r--r-- != -rw-------",
+	}
+	asserter.AssertEqual(expected, differences)
+
+	differences, err = DiffTrees(first, first)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual([]string{}, differences)
+}
+
+// TestDu tests that the disk usage of a directory includes its files, and
+// that measuring a missing path fails
+func TestDu(t *testing.T) {
+	asserter := Asserter{T: t}
+	root := t.TempDir()
+
+	empty, err := Du(root)
+	asserter.AssertErrNil(err, true)
+
+	content := make([]byte, 1<<20)
+	_, err = rand.Read(content)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertErrNil(os.WriteFile(filepath.Join(root, "file"), content, 0644), true)
+
+	size, err := Du(root)
+	asserter.AssertErrNil(err, true)
+	if size < empty+quantity.SizeMiB {
+		t.Errorf("Unexpected disk usage %d, expected at least %d", size, empty+quantity.SizeMiB)
+	}
+
+	_, err = Du(filepath.Join(root, "missing"))
+	if err == nil {
+		t.Error("Expected an error measuring a missing path, got nil")
+	}
+}
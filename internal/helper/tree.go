@@ -0,0 +1,204 @@
+package helper
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ClampMtimes sets the access and modification times of every entry of the
+// tree modified after epoch to epoch, without following symlinks. It returns
+// the number of entries it changed.
+func ClampMtimes(root string, epoch time.Time) (int, error) {
+	clamped := 0
+	times := []unix.Timespec{unix.NsecToTimespec(epoch.UnixNano()), unix.NsecToTimespec(epoch.UnixNano())}
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if !info.ModTime().After(epoch) {
+			return nil
+		}
+		if err := unix.UtimesNanoAt(unix.AT_FDCWD, path, times, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return err
+		}
+		clamped++
+		return nil
+	})
+	if err != nil {
+		return clamped, fmt.Errorf("Error clamping modification times in \"%s\": \"%s\"", root, err.Error())
+	}
+	return clamped, nil
+}
+
+// ClampPathMtimes is ClampMtimes for the given paths of the tree only,
+// relative to its root. Missing paths are skipped.
+func ClampPathMtimes(root string, relPaths []string, epoch time.Time) (int, error) {
+	clamped := 0
+	times := []unix.Timespec{unix.NsecToTimespec(epoch.UnixNano()), unix.NsecToTimespec(epoch.UnixNano())}
+	for _, relPath := range relPaths {
+		path := filepath.Join(root, relPath)
+		info, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return clamped, fmt.Errorf("Error clamping modification times in \"%s\": \"%s\"", root, err.Error())
+		}
+		if !info.ModTime().After(epoch) {
+			continue
+		}
+		if err := unix.UtimesNanoAt(unix.AT_FDCWD, path, times, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return clamped, fmt.Errorf("Error clamping modification times in \"%s\": \"%s\"", root, err.Error())
+		}
+		clamped++
+	}
+	return clamped, nil
+}
+
+// treeEntry is what DiffTrees compares for a path of a tree
+type treeEntry struct {
+	path string
+	info fs.FileInfo
+}
+
+// walkTree returns the entries of a tree, by path relative to its root
+func walkTree(root string) (map[string]treeEntry, error) {
+	entries := make(map[string]treeEntry)
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		entries[relPath] = treeEntry{path: path, info: info}
+		return nil
+	})
+	return entries, err
+}
+
+// DiffTrees compares two trees byte for byte: the paths they contain, and
+// the type, mode, ownership, modification time, content and symlink target
+// of each of them. It returns a description of every difference, sorted by path.
+func DiffTrees(first, second string) ([]string, error) {
+	firstEntries, err := walkTree(first)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading tree \"%s\": \"%s\"", first, err.Error())
+	}
+	secondEntries, err := walkTree(second)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading tree \"%s\": \"%s\"", second, err.Error())
+	}
+
+	paths := make([]string, 0, len(firstEntries))
+	for path := range firstEntries {
+		paths = append(paths, path)
+	}
+	for path := range secondEntries {
+		if _, found := firstEntries[path]; !found {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	differences := make([]string, 0)
+	for _, path := range paths {
+		firstEntry, inFirst := firstEntries[path]
+		secondEntry, inSecond := secondEntries[path]
+		switch {
+		case !inSecond:
+			differences = append(differences, fmt.Sprintf("%s: only in %s", path, first))
+		case !inFirst:
+			differences = append(differences, fmt.Sprintf("%s: only in %s", path, second))
+		default:
+			entryDifferences, err := diffEntries(firstEntry, secondEntry)
+			if err != nil {
+				return nil, err
+			}
+			for _, difference := range entryDifferences {
+				differences = append(differences, fmt.Sprintf("%s: %s", path, difference))
+			}
+		}
+	}
+	return differences, nil
+}
+
+// diffEntries compares two entries with the same relative path
+func diffEntries(first, second treeEntry) ([]string, error) {
+	differences := make([]string, 0)
+	firstMode, secondMode := first.info.Mode(), second.info.Mode()
+	if firstMode.Type() != secondMode.Type() {
+		// nothing else can be compared
+		return append(differences, fmt.Sprintf("type %s != %s", firstMode.Type(), secondMode.Type())), nil
+	}
+	if firstMode != secondMode {
+		differences = append(differences, fmt.Sprintf("mode %s != %s", firstMode, secondMode))
+	}
+
+	firstStat, firstOK := first.info.Sys().(*syscall.Stat_t)
+	secondStat, secondOK := second.info.Sys().(*syscall.Stat_t)
+	if firstOK && secondOK {
+		if firstStat.Uid != secondStat.Uid || firstStat.Gid != secondStat.Gid {
+			differences = append(differences, fmt.Sprintf("owner %d:%d != %d:%d",
+				firstStat.Uid, firstStat.Gid, secondStat.Uid, secondStat.Gid))
+		}
+		if firstMode&(fs.ModeDevice|fs.ModeCharDevice) != 0 && firstStat.Rdev != secondStat.Rdev {
+			differences = append(differences, fmt.Sprintf("device %d != %d", firstStat.Rdev, secondStat.Rdev))
+		}
+	}
+
+	// the modification time of directories changes with their entries,
+	// which are already compared
+	if !firstMode.IsDir() && !first.info.ModTime().Equal(second.info.ModTime()) {
+		differences = append(differences, fmt.Sprintf("modification time %s != %s",
+			first.info.ModTime().UTC().Format(time.RFC3339Nano), second.info.ModTime().UTC().Format(time.RFC3339Nano)))
+	}
+
+	switch {
+	case firstMode.IsRegular():
+		contentDiffers := first.info.Size() != second.info.Size()
+		if !contentDiffers {
+			firstDigest, err := HashFile(first.path, SHA256)
+			if err != nil {
+				return nil, err
+			}
+			secondDigest, err := HashFile(second.path, SHA256)
+			if err != nil {
+				return nil, err
+			}
+			contentDiffers = firstDigest != secondDigest
+		}
+		if contentDiffers {
+			differences = append(differences, "content differs")
+		}
+	case firstMode&fs.ModeSymlink != 0:
+		firstTarget, err := os.Readlink(first.path)
+		if err != nil {
+			return nil, err
+		}
+		secondTarget, err := os.Readlink(second.path)
+		if err != nil {
+			return nil, err
+		}
+		if firstTarget != secondTarget {
+			differences = append(differences, fmt.Sprintf("symlink target %s != %s", firstTarget, secondTarget))
+		}
+	}
+	return differences, nil
+}
@@ -0,0 +1,201 @@
+// Package logger provides the leveled logging used for all the output of
+// cedar, on the console and optionally in a log file
+package logger
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Level is the verbosity of a message. A message is printed on the console
+// when its level is lower or equal to the configured one.
+type Level int
+
+const (
+	LevelError Level = iota
+	LevelWarning
+	LevelInfo
+	LevelVerbose
+	LevelDebug
+)
+
+var levelNames = map[Level]string{
+	LevelError:   "ERROR",
+	LevelWarning: "WARNING",
+	LevelInfo:    "INFO",
+	LevelVerbose: "VERBOSE",
+	LevelDebug:   "DEBUG",
+}
+
+const timestampFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// define some functions that can be mocked by test cases
+var timeNow = time.Now
+
+// console returns where messages of the given level are printed. It is
+// looked up on every write, so that a redirection of os.Stdout is honored.
+var console = func(level Level) io.Writer {
+	if level <= LevelWarning {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// Logger writes messages up to its level on the console, and every message
+// to its log file, if any
+type Logger struct {
+	mu         sync.Mutex
+	level      Level
+	timestamps bool
+	file       io.WriteCloser
+}
+
+var std = &Logger{level: LevelInfo}
+
+// LevelFromFlags returns the level matching the common command line flags
+func LevelFromFlags(debug, verbose, quiet bool) Level {
+	switch {
+	case debug:
+		return LevelDebug
+	case verbose:
+		return LevelVerbose
+	case quiet:
+		return LevelError
+	}
+	return LevelInfo
+}
+
+// Configure sets the level of the messages printed on the console and
+// whether they are prefixed with a timestamp
+func Configure(level Level, timestamps bool) {
+	std.mu.Lock()
+	defer std.mu.Unlock()
+	std.level = level
+	std.timestamps = timestamps
+}
+
+// SetLogFile makes every message, whatever its level, also be written with
+// a timestamp to the given file
+func SetLogFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Error opening log file: %s", err.Error())
+	}
+	std.mu.Lock()
+	defer std.mu.Unlock()
+	std.file = f
+	return nil
+}
+
+// Close closes the log file, if any
+func Close() error {
+	std.mu.Lock()
+	defer std.mu.Unlock()
+	if std.file == nil {
+		return nil
+	}
+	err := std.file.Close()
+	std.file = nil
+	return err
+}
+
+// Enabled returns whether messages of the given level are printed on the console
+func Enabled(level Level) bool {
+	std.mu.Lock()
+	defer std.mu.Unlock()
+	return level <= std.level
+}
+
+// Errorf logs an error, printed even in quiet mode
+func Errorf(format string, args ...interface{}) {
+	std.logf(LevelError, "Error: "+format, args...)
+}
+
+// Warningf logs a warning
+func Warningf(format string, args ...interface{}) {
+	std.logf(LevelWarning, "WARNING: "+format, args...)
+}
+
+// Infof logs a message printed by default
+func Infof(format string, args ...interface{}) {
+	std.logf(LevelInfo, format, args...)
+}
+
+// Verbosef logs a message printed with --verbose or --debug
+func Verbosef(format string, args ...interface{}) {
+	std.logf(LevelVerbose, format, args...)
+}
+
+// Debugf logs a message printed with --debug
+func Debugf(format string, args ...interface{}) {
+	std.logf(LevelDebug, format, args...)
+}
+
+// Writer returns a writer logging what is written to it at the given level,
+// used to route the output of child processes and libraries
+func Writer(level Level) io.Writer {
+	return &levelWriter{logger: std, level: level, atLineStart: true}
+}
+
+func (l *Logger) logf(level Level, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	if len(message) == 0 || message[len(message)-1] != '\n' {
+		message += "\n"
+	}
+	atLineStart := true
+	l.write(level, []byte(message), &atLineStart)
+}
+
+// write writes p to the console and the log file, prefixing every line
+// as configured. atLineStart tracks whether the previous write of the same
+// writer ended a line.
+func (l *Logger) write(level Level, p []byte, atLineStart *bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var consoleOut, fileOut bytes.Buffer
+	now := timeNow()
+	start := *atLineStart
+	for len(p) > 0 {
+		line := p
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			line = p[:i+1]
+		}
+		p = p[len(line):]
+
+		if start {
+			if l.timestamps {
+				consoleOut.WriteString(now.Format(timestampFormat) + " ")
+			}
+			fmt.Fprintf(&fileOut, "%s %s ", now.Format(timestampFormat), levelNames[level])
+		}
+		consoleOut.Write(line)
+		fileOut.Write(line)
+		start = line[len(line)-1] == '\n'
+	}
+	*atLineStart = start
+
+	// logging must never fail the build
+	if level <= l.level {
+		_, _ = console(level).Write(consoleOut.Bytes())
+	}
+	if l.file != nil {
+		_, _ = l.file.Write(fileOut.Bytes())
+	}
+}
+
+// levelWriter is an io.Writer logging at a given level
+type levelWriter struct {
+	logger      *Logger
+	level       Level
+	atLineStart bool
+}
+
+func (w *levelWriter) Write(p []byte) (int, error) {
+	w.logger.write(w.level, p, &w.atLineStart)
+	return len(p), nil
+}
@@ -0,0 +1,106 @@
+package logger
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// mockConsole captures the console output for the duration of a test
+func mockConsole(t *testing.T) (stdout *bytes.Buffer, stderr *bytes.Buffer) {
+	stdout, stderr = &bytes.Buffer{}, &bytes.Buffer{}
+	oldConsole := console
+	console = func(level Level) io.Writer {
+		if level <= LevelWarning {
+			return stderr
+		}
+		return stdout
+	}
+	t.Cleanup(func() {
+		console = oldConsole
+		Configure(LevelInfo, false)
+	})
+	return stdout, stderr
+}
+
+// TestLevels tests that only the messages up to the configured level are printed
+func TestLevels(t *testing.T) {
+	testCases := []struct {
+		name           string
+		level          Level
+		expectedStdout string
+		expectedStderr string
+	}{
+		{"quiet", LevelFromFlags(false, false, true), "", "Error: error\n"},
+		{"default", LevelFromFlags(false, false, false), "info\n", "Error: error\nWARNING: warning\n"},
+		{"verbose", LevelFromFlags(false, true, false), "info\nverbose\n", "Error: error\nWARNING: warning\n"},
+		{"debug", LevelFromFlags(true, false, false), "info\nverbose\ndebug\n", "Error: error\nWARNING: warning\n"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stdout, stderr := mockConsole(t)
+			Configure(tc.level, false)
+
+			Errorf("error")
+			Warningf("warning")
+			Infof("info")
+			Verbosef("verbose")
+			Debugf("debug")
+
+			if stdout.String() != tc.expectedStdout {
+				t.Errorf("Unexpected stdout %q, expected %q", stdout.String(), tc.expectedStdout)
+			}
+			if stderr.String() != tc.expectedStderr {
+				t.Errorf("Unexpected stderr %q, expected %q", stderr.String(), tc.expectedStderr)
+			}
+		})
+	}
+}
+
+// TestWriter tests that partial lines written to a Writer are prefixed only once
+func TestWriter(t *testing.T) {
+	stdout, _ := mockConsole(t)
+	Configure(LevelInfo, true)
+	timeNow = func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) }
+	t.Cleanup(func() { timeNow = time.Now })
+
+	w := Writer(LevelInfo)
+	_, _ = w.Write([]byte("first "))
+	_, _ = w.Write([]byte("line\nsecond line\n"))
+	_, _ = Writer(LevelDebug).Write([]byte("hidden\n"))
+
+	expected := "2024-01-02T03:04:05.000Z first line\n2024-01-02T03:04:05.000Z second line\n"
+	if stdout.String() != expected {
+		t.Errorf("Unexpected output %q, expected %q", stdout.String(), expected)
+	}
+}
+
+// TestLogFile tests that every message is written to the log file
+func TestLogFile(t *testing.T) {
+	_, _ = mockConsole(t)
+	Configure(LevelError, false)
+	logPath := filepath.Join(t.TempDir(), "cedar.log")
+	if err := SetLogFile(logPath); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	timeNow = func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) }
+	t.Cleanup(func() { timeNow = time.Now })
+
+	Debugf("debug")
+	Errorf("error")
+	if err := Close(); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	content, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	expected := "2024-01-02T03:04:05.000Z DEBUG debug\n2024-01-02T03:04:05.000Z ERROR Error: error\n"
+	if string(content) != expected {
+		t.Errorf("Unexpected log file content %q, expected %q", string(content), expected)
+	}
+}
@@ -5,11 +5,26 @@ image definition that will be parsed from a YAML file.
 package snaplist
 
 // SnapList is the parent struct for the data
-// contained within a classic image definition file
+// contained within a classic image definition file.
+// Architecture and Series are detected from the image tree when not given.
 type SnapList struct {
-	Architecture string  `yaml:"architecture"    json:"Architecture"`
-	Series       string  `yaml:"series"          json:"Series"`
-	Snaps        []*Snap `yaml:"snaps"           json:"Snaps"`
+	Architecture     string       `yaml:"architecture"       json:"Architecture,omitempty"`
+	Series           string       `yaml:"series"             json:"Series,omitempty"`
+	Snaps            []*Snap      `yaml:"snaps"              json:"Snaps"`
+	SetDefaultLocale *bool        `yaml:"set-default-locale" json:"SetDefaultLocale,omitempty" default:"false"`
+	CleanRootfs      *CleanRootfs `yaml:"clean-rootfs"       json:"CleanRootfs,omitempty"`
+	Hooks            *Hooks       `yaml:"hooks"              json:"Hooks,omitempty"`
+	ChrootCommands   []string     `yaml:"chroot-commands"    json:"ChrootCommands,omitempty"`
+	// Packages are local .deb files, relative to the snap list, or names of
+	// packages to install from the archive
+	Packages []string `yaml:"packages" json:"Packages,omitempty"`
+	// PackageChecksums are the checksums of local .deb files, in the
+	// algorithm:digest form, keyed by their entry in Packages
+	PackageChecksums map[string]string `yaml:"package-checksums" json:"PackageChecksums,omitempty"`
+	Files            []*File           `yaml:"files"             json:"Files,omitempty"`
+	// MaxSeedSize is the budget of the seed size and of the growth of the
+	// image tree, in bytes or with a M or G suffix
+	MaxSeedSize string `yaml:"max-seed-size" json:"MaxSeedSize,omitempty"`
 }
 
 // Snap contains information about snaps
@@ -19,3 +34,42 @@ type Snap struct {
 	Store        string `yaml:"store"    json:"Store"                  default:"canonical"`
 	Channel      string `yaml:"channel"  json:"Channel"                default:"stable"`
 }
+
+// CleanRootfs enables the cleaning of secrets and generated values from the
+// image tree, so it is safe to redistribute. Patterns are relative to the root
+// of the image tree and extend the ones cleaned by default.
+type CleanRootfs struct {
+	Delete   []string `yaml:"delete"   json:"Delete,omitempty"`
+	Truncate []string `yaml:"truncate" json:"Truncate,omitempty"`
+}
+
+// Hooks lists the scripts run on the host around the states of the build
+type Hooks struct {
+	PrePrepare  []*Hook `yaml:"pre-prepare"  json:"PrePrepare,omitempty"`
+	PostPrepare []*Hook `yaml:"post-prepare" json:"PostPrepare,omitempty"`
+	PrePreseed  []*Hook `yaml:"pre-preseed"  json:"PrePreseed,omitempty"`
+	PostPreseed []*Hook `yaml:"post-preseed" json:"PostPreseed,omitempty"`
+	OnFailure   []*Hook `yaml:"on-failure"   json:"OnFailure,omitempty"`
+}
+
+// Hook is a script run on the host. A relative path is relative to the
+// directory of the snap list. OnError tells whether a failure of the script
+// fails the build, is only reported, or is ignored.
+type Hook struct {
+	Script  string `yaml:"script"   json:"Script"`
+	OnError string `yaml:"on-error" json:"OnError" default:"fail" jsonschema:"enum=fail,enum=warn,enum=ignore"`
+}
+
+// File is a file of the host copied to the image tree. Source is relative to
+// the snap list and Destination to the root of the image tree. Owner is
+// user:group, by name or ID, looked up in the image tree. When Template is
+// set, the content is rendered with text/template. When Checksum is set, in
+// the algorithm:digest form, the source must match it.
+type File struct {
+	Source      string `yaml:"source"      json:"Source"`
+	Destination string `yaml:"destination" json:"Destination"`
+	Mode        string `yaml:"mode"        json:"Mode"                default:"0644"`
+	Owner       string `yaml:"owner"       json:"Owner"               default:"root:root"`
+	Template    bool   `yaml:"template"    json:"Template,omitempty"`
+	Checksum    string `yaml:"checksum"    json:"Checksum,omitempty"`
+}
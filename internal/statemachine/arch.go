@@ -0,0 +1,285 @@
+package statemachine
+
+import (
+	"debug/elf"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/snapcore/snapd/osutil"
+
+	"operese/cedar/internal/helper"
+)
+
+// binfmtMiscDir is where the kernel exposes the registered binfmt_misc handlers
+var binfmtMiscDir = "/proc/sys/fs/binfmt_misc"
+
+// goArchToDebArch maps the GOARCH of cedar to the matching dpkg architecture
+var goArchToDebArch = map[string]string{
+	"amd64":   "amd64",
+	"386":     "i386",
+	"arm64":   "arm64",
+	"arm":     "armhf",
+	"ppc64le": "ppc64el",
+	"s390x":   "s390x",
+	"riscv64": "riscv64",
+}
+
+// debArchToQemuArch maps dpkg architectures to the name used by qemu-user
+var debArchToQemuArch = map[string]string{
+	"amd64":   "x86_64",
+	"i386":    "i386",
+	"arm64":   "aarch64",
+	"armhf":   "arm",
+	"ppc64el": "ppc64le",
+	"s390x":   "s390x",
+	"riscv64": "riscv64",
+}
+
+// nativeArchitectures lists, for a host architecture, the other
+// architectures it can execute without emulation
+var nativeArchitectures = map[string][]string{
+	"amd64": {"i386"},
+}
+
+// hostArchitecture returns the dpkg architecture of the host
+func hostArchitecture() string {
+	return goArchToDebArch[runtime.GOARCH]
+}
+
+// isNativeArchitecture tells whether binaries of the tree architecture run on
+// the host without emulation
+func isNativeArchitecture(hostArch string, treeArch string) bool {
+	return treeArch == hostArch || helper.SliceHasElement(nativeArchitectures[hostArch], treeArch)
+}
+
+// emulationEnv returns the environment needed to run a binary of the image
+// tree from the host, outside of the chroot. With emulation, qemu-user must
+// look up the ELF interpreter and the libraries of the binary in the tree
+// rather than in the root of the host.
+func emulationEnv(imagePath string) ([]string, error) {
+	treeArch, err := treeArchitecture(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	if isNativeArchitecture(hostArchitecture(), treeArch) {
+		return nil, nil
+	}
+	return []string{"QEMU_LD_PREFIX=" + imagePath}, nil
+}
+
+// treeArchitecture returns the architecture of the image tree. The dpkg
+// architecture is the reference for the whole build: the snap list is
+// checked against it and binaries of the tree are run with its emulation.
+func treeArchitecture(imagePath string) (string, error) {
+	packages, err := readDpkgStatus(imagePath)
+	if err != nil {
+		return "", err
+	}
+	return dpkgArchitecture(packages)
+}
+
+// binfmtHandler holds the settings of a binfmt_misc handler relevant to cedar
+type binfmtHandler struct {
+	enabled     bool
+	interpreter string
+	// with the F flag, the kernel opens the interpreter when the handler is
+	// registered, so it does not need to be reachable from the chroot
+	fixBinary bool
+}
+
+// findBinfmtHandler returns the binfmt_misc handler registered for the
+// given qemu architecture, or nil if there is none
+func findBinfmtHandler(qemuArch string) (*binfmtHandler, error) {
+	for _, name := range []string{"qemu-" + qemuArch, "qemu-" + qemuArch + "-static"} {
+		content, err := osReadFile(filepath.Join(binfmtMiscDir, name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("Error reading binfmt_misc handler %s: %s", name, err.Error())
+		}
+		return parseBinfmtHandler(string(content)), nil
+	}
+	return nil, nil
+}
+
+// parseBinfmtHandler parses the content of a file in /proc/sys/fs/binfmt_misc
+func parseBinfmtHandler(content string) *binfmtHandler {
+	handler := &binfmtHandler{}
+	for _, line := range strings.Split(content, "\n") {
+		switch {
+		case line == "enabled":
+			handler.enabled = true
+		case strings.HasPrefix(line, "interpreter "):
+			handler.interpreter = strings.TrimPrefix(line, "interpreter ")
+		case strings.HasPrefix(line, "flags: "):
+			handler.fixBinary = strings.Contains(strings.TrimPrefix(line, "flags: "), "F")
+		}
+	}
+	return handler
+}
+
+// setupEmulation makes sure the binaries of the image tree can be executed on
+// the host. When the tree is built for a foreign architecture, this relies on
+// a qemu-user binfmt_misc handler whose interpreter is made available in the
+// tree if needed. The returned function removes what was added to the tree.
+func setupEmulation(imagePath string) (restore func() error, err error) {
+	noop := func() error { return nil }
+
+	treeArch, err := treeArchitecture(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	hostArch := hostArchitecture()
+	if isNativeArchitecture(hostArch, treeArch) {
+		return noop, nil
+	}
+
+	qemuArch, found := debArchToQemuArch[treeArch]
+	if !found {
+		return nil, fmt.Errorf("Cannot run %s binaries from the image tree on this %s host: no emulation is known for this architecture",
+			treeArch, hostArch)
+	}
+	handler, err := findBinfmtHandler(qemuArch)
+	if err != nil {
+		return nil, err
+	}
+	if handler == nil {
+		return nil, fmt.Errorf("Cannot run %s binaries from the image tree on this %s host: "+
+			"no binfmt_misc handler is registered for qemu-%s. Install qemu-user-static to enable emulation.",
+			treeArch, hostArch, qemuArch)
+	}
+	if !handler.enabled {
+		return nil, fmt.Errorf("Cannot run %s binaries from the image tree on this %s host: "+
+			"the binfmt_misc handler for qemu-%s is disabled. Run \"update-binfmts --enable qemu-%s\" to enable it.",
+			treeArch, hostArch, qemuArch, qemuArch)
+	}
+	if handler.fixBinary {
+		return noop, nil
+	}
+
+	// the interpreter is looked up in the chroot when a binary is executed,
+	// so the symlinks of the tree are resolved in it, never on the host
+	chrootInterpreter, err := helperResolveInRoot(imagePath, handler.interpreter)
+	if err != nil {
+		return nil, err
+	}
+	if osutil.FileExists(chrootInterpreter) {
+		return noop, nil
+	}
+
+	hostInterpreter, err := findStaticInterpreter(handler.interpreter, qemuArch)
+	if err != nil {
+		return nil, err
+	}
+
+	return copyInterpreter(imagePath, hostInterpreter, chrootInterpreter)
+}
+
+// findStaticInterpreter returns the path of a statically linked qemu-user
+// binary that can be copied to the image tree
+func findStaticInterpreter(interpreter string, qemuArch string) (string, error) {
+	candidates := []string{interpreter}
+	if staticQemu, err := execLookPath("qemu-" + qemuArch + "-static"); err == nil {
+		candidates = append(candidates, staticQemu)
+	}
+
+	for _, candidate := range candidates {
+		f, err := elf.Open(candidate)
+		if err != nil {
+			continue
+		}
+		static := true
+		for _, prog := range f.Progs {
+			if prog.Type == elf.PT_INTERP {
+				static = false
+			}
+		}
+		f.Close()
+		if static {
+			return candidate, nil
+		}
+	}
+
+	return "", fmt.Errorf("The binfmt_misc handler for qemu-%s uses %s, which cannot be used in the image tree "+
+		"because it is not a static binary. Install qemu-user-static to enable emulation.", qemuArch, interpreter)
+}
+
+// copyInterpreter copies the interpreter to the image tree and returns the
+// function removing it along with the directories created for it. What is
+// removed is recorded next to the tree first, so the cleanup command can
+// remove it if cedar dies before restoring the tree.
+func copyInterpreter(imagePath string, hostInterpreter string, chrootInterpreter string) (func() error, error) {
+	// find the first missing directory to remove the whole created hierarchy afterwards
+	toRemove := chrootInterpreter
+	for dir := filepath.Dir(chrootInterpreter); !osutil.IsDirectory(dir); dir = filepath.Dir(dir) {
+		toRemove = dir
+	}
+
+	recordPath, err := sideFilePath(imagePath, interpreterRecordSuffix)
+	if err != nil {
+		return nil, err
+	}
+	relToRemove, err := filepathRel(imagePath, toRemove)
+	if err != nil {
+		return nil, fmt.Errorf("Error recording the qemu interpreter: %s", err.Error())
+	}
+	if err := osWriteFile(recordPath, []byte(relToRemove+"\n"), 0644); err != nil {
+		return nil, fmt.Errorf("Error recording the qemu interpreter: %s", err.Error())
+	}
+	restore := func() error {
+		if err := osRemoveAll(toRemove); err != nil {
+			return fmt.Errorf("Error removing qemu interpreter from the image tree: %s", err.Error())
+		}
+		if err := osRemove(recordPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Error removing %s: %s", recordPath, err.Error())
+		}
+		return nil
+	}
+
+	// the missing part of the path was not resolved, so it cannot contain
+	// any symlink
+	if err := osMkdirAll(filepath.Dir(chrootInterpreter), 0755); err != nil {
+		return nil, joinRestoreErr(fmt.Errorf("Error creating directory for the qemu interpreter: %s", err.Error()), restore())
+	}
+	if err := copyToTree(hostInterpreter, chrootInterpreter); err != nil {
+		return nil, joinRestoreErr(fmt.Errorf("Error copying qemu interpreter \"%s\" to \"%s\": %s",
+			hostInterpreter, chrootInterpreter, err.Error()), restore())
+	}
+
+	return restore, nil
+}
+
+// copyToTree copies a file of the host to a path of the image tree that does
+// not exist yet, without following a symlink that would replace it
+func copyToTree(source string, destination string) error {
+	in, err := osOpen(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := osOpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		// the mode given when creating the file is subject to the umask
+		err = out.Chmod(info.Mode().Perm())
+	}
+	closeErr := out.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
@@ -0,0 +1,265 @@
+package statemachine
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/snapcore/snapd/osutil"
+
+	"operese/cedar/internal/helper"
+)
+
+var cmpOptsBinfmtHandler = []cmp.Option{cmp.AllowUnexported(binfmtHandler{})}
+
+// writeELF writes a minimal ELF binary for the given class, byte order and
+// machine. With interp, it has a PT_INTERP program header like a
+// dynamically linked binary.
+func writeELF(t *testing.T, path string, class elf.Class, data elf.Data, machine elf.Machine, interp bool) {
+	t.Helper()
+	var byteOrder binary.ByteOrder = binary.LittleEndian
+	if data == elf.ELFDATA2MSB {
+		byteOrder = binary.BigEndian
+	}
+	ident := [elf.EI_NIDENT]byte{0x7f, 'E', 'L', 'F', byte(class), byte(data), byte(elf.EV_CURRENT)}
+
+	var phnum uint16
+	if interp {
+		phnum = 1
+	}
+	buf := new(bytes.Buffer)
+	var err error
+	if class == elf.ELFCLASS64 {
+		headerSize := uint16(binary.Size(elf.Header64{}))
+		err = binary.Write(buf, byteOrder, elf.Header64{
+			Ident: ident, Type: uint16(elf.ET_EXEC), Machine: uint16(machine), Version: uint32(elf.EV_CURRENT),
+			Phoff: uint64(headerSize), Ehsize: headerSize, Phentsize: uint16(binary.Size(elf.Prog64{})), Phnum: phnum,
+		})
+		if err == nil && interp {
+			err = binary.Write(buf, byteOrder, elf.Prog64{Type: uint32(elf.PT_INTERP)})
+		}
+	} else {
+		headerSize := uint16(binary.Size(elf.Header32{}))
+		err = binary.Write(buf, byteOrder, elf.Header32{
+			Ident: ident, Type: uint16(elf.ET_EXEC), Machine: uint16(machine), Version: uint32(elf.EV_CURRENT),
+			Phoff: uint32(headerSize), Ehsize: headerSize, Phentsize: uint16(binary.Size(elf.Prog32{})), Phnum: phnum,
+		})
+		if err == nil && interp {
+			err = binary.Write(buf, byteOrder, elf.Prog32{Type: uint32(elf.PT_INTERP)})
+		}
+	}
+	if err != nil {
+		t.Fatalf("Error encoding ELF binary: %s", err.Error())
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0755); err != nil {
+		t.Fatalf("Error writing ELF binary: %s", err.Error())
+	}
+}
+
+// TestTreeArchitecture tests that the architecture of the tree is the one of dpkg
+func TestTreeArchitecture(t *testing.T) {
+	testCases := []struct {
+		name        string
+		status      string
+		expected    string
+		expectedErr string
+	}{
+		{"arm64", dpkgStatusEntry("dpkg", "1.22.6", "arm64", true) + dpkgStatusEntry("libc6", "2.39", "i386", true), "arm64", ""},
+		{"dpkg_not_installed", dpkgStatusEntry("dpkg", "1.22.6", "amd64", false), "", "dpkg is not installed"},
+		{"no_dpkg", dpkgStatusEntry("libc6", "2.39", "amd64", true), "", "dpkg is not installed"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			imagePath := t.TempDir()
+			writeDpkgStatus(t, imagePath, tc.status)
+			arch, err := treeArchitecture(imagePath)
+			if tc.expectedErr != "" {
+				asserter.AssertErrContains(err, tc.expectedErr)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.expected, arch)
+		})
+	}
+
+	t.Run("no_dpkg_database", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		_, err := treeArchitecture(t.TempDir())
+		asserter.AssertErrContains(err, "Error opening the dpkg database of the image tree")
+	})
+}
+
+// TestParseBinfmtHandler tests the parsing of binfmt_misc handlers
+func TestParseBinfmtHandler(t *testing.T) {
+	testCases := []struct {
+		name     string
+		content  string
+		expected binfmtHandler
+	}{
+		{
+			"enabled_fix_binary",
+			"enabled\ninterpreter /usr/libexec/qemu-binfmt/aarch64-binfmt-P\nflags: PF\noffset 0\nmagic 7f454c46\n",
+			binfmtHandler{enabled: true, interpreter: "/usr/libexec/qemu-binfmt/aarch64-binfmt-P", fixBinary: true},
+		},
+		{
+			"disabled",
+			"disabled\ninterpreter /usr/bin/qemu-aarch64-static\nflags: OC\n",
+			binfmtHandler{enabled: false, interpreter: "/usr/bin/qemu-aarch64-static", fixBinary: false},
+		},
+		{
+			"no_flags",
+			"enabled\ninterpreter /usr/bin/qemu-arm\nflags: \n",
+			binfmtHandler{enabled: true, interpreter: "/usr/bin/qemu-arm"},
+		},
+		{"empty", "", binfmtHandler{}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			asserter.AssertEqual(tc.expected, *parseBinfmtHandler(tc.content), cmpOptsBinfmtHandler...)
+		})
+	}
+}
+
+// TestFindStaticInterpreter tests that only a static qemu-user can be used in the chroot
+func TestFindStaticInterpreter(t *testing.T) {
+	dir := t.TempDir()
+	static := filepath.Join(dir, "qemu-aarch64-static")
+	dynamic := filepath.Join(dir, "qemu-aarch64")
+	writeELF(t, static, elf.ELFCLASS64, elf.ELFDATA2LSB, elf.EM_X86_64, false)
+	writeELF(t, dynamic, elf.ELFCLASS64, elf.ELFDATA2LSB, elf.EM_X86_64, true)
+	t.Cleanup(func() { execLookPath = exec.LookPath })
+
+	testCases := []struct {
+		name        string
+		interpreter string
+		lookPath    string
+		expected    string
+		expectedErr string
+	}{
+		{"static_interpreter", static, "", static, ""},
+		{"static_fallback", dynamic, static, static, ""},
+		{"no_static", dynamic, "", "", "is not a static binary"},
+		{"missing_interpreter", filepath.Join(dir, "missing"), static, static, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			execLookPath = func(file string) (string, error) {
+				if tc.lookPath == "" {
+					return "", exec.ErrNotFound
+				}
+				return tc.lookPath, nil
+			}
+			interpreter, err := findStaticInterpreter(tc.interpreter, "aarch64")
+			if tc.expectedErr != "" {
+				asserter.AssertErrContains(err, tc.expectedErr)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.expected, interpreter)
+		})
+	}
+}
+
+// TestIsNativeArchitecture tests which architectures run without emulation
+func TestIsNativeArchitecture(t *testing.T) {
+	testCases := []struct {
+		hostArch string
+		treeArch string
+		expected bool
+	}{
+		{"amd64", "amd64", true},
+		{"amd64", "i386", true},
+		{"amd64", "arm64", false},
+		{"arm64", "armhf", false},
+		{"arm64", "arm64", true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.hostArch+"_"+tc.treeArch, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			asserter.AssertEqual(tc.expected, isNativeArchitecture(tc.hostArch, tc.treeArch))
+		})
+	}
+}
+
+// TestCopyInterpreter tests that the copied interpreter is recorded next to
+// the image tree until it is removed with the directories created for it
+func TestCopyInterpreter(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	imagePath := filepath.Join(t.TempDir(), "tree")
+	asserter.AssertErrNil(os.MkdirAll(filepath.Join(imagePath, "usr"), 0755), true)
+	hostInterpreter := filepath.Join(t.TempDir(), "qemu-aarch64-static")
+	writeELF(t, hostInterpreter, elf.ELFCLASS64, elf.ELFDATA2LSB, elf.EM_X86_64, false)
+
+	chrootInterpreter := filepath.Join(imagePath, "usr", "libexec", "qemu-binfmt", "aarch64-binfmt-P")
+	restore, err := copyInterpreter(imagePath, hostInterpreter, chrootInterpreter)
+	asserter.AssertErrNil(err, true)
+	if !osutil.FileExists(chrootInterpreter) {
+		t.Errorf("%s was not copied", chrootInterpreter)
+	}
+	record, err := os.ReadFile(imagePath + interpreterRecordSuffix)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("usr/libexec\n", string(record))
+
+	asserter.AssertErrNil(restore(), true)
+	if osutil.FileExists(filepath.Join(imagePath, "usr", "libexec")) {
+		t.Errorf("the directories created for the interpreter were not removed")
+	}
+	if !osutil.IsDirectory(filepath.Join(imagePath, "usr")) {
+		t.Errorf("the existing directories of the tree were removed")
+	}
+	if osutil.FileExists(imagePath + interpreterRecordSuffix) {
+		t.Errorf("the record of the interpreter was not removed")
+	}
+}
+
+// TestSetupEmulationSymlinks tests that the interpreter is looked up and
+// copied in the image tree even when a symlink of the tree points to a path
+// of the host
+func TestSetupEmulationSymlinks(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	treeArch := "riscv64"
+	if hostArchitecture() == treeArch {
+		treeArch = "amd64"
+	}
+	qemuArch := debArchToQemuArch[treeArch]
+
+	hostInterpreter := filepath.Join(t.TempDir(), "qemu-"+qemuArch+"-static")
+	writeELF(t, hostInterpreter, elf.ELFCLASS64, elf.ELFDATA2LSB, elf.EM_X86_64, false)
+	binfmtDir := t.TempDir()
+	err := os.WriteFile(filepath.Join(binfmtDir, "qemu-"+qemuArch),
+		[]byte("enabled\ninterpreter "+hostInterpreter+"\nflags: P\n"), 0644)
+	asserter.AssertErrNil(err, true)
+	binfmtMiscDir = binfmtDir
+	t.Cleanup(func() { binfmtMiscDir = "/proc/sys/fs/binfmt_misc" })
+
+	// the first directory of the interpreter is an absolute symlink to the
+	// root, which is the root of the tree in the chroot, not the host's
+	imagePath := filepath.Join(t.TempDir(), "tree")
+	writeDpkgStatus(t, imagePath, dpkgStatusEntry("dpkg", "1.22.6", treeArch, true))
+	firstDir, inFirstDir, _ := strings.Cut(strings.TrimPrefix(hostInterpreter, "/"), "/")
+	asserter.AssertErrNil(os.Symlink("/", filepath.Join(imagePath, firstDir)), true)
+
+	restore, err := setupEmulation(imagePath)
+	asserter.AssertErrNil(err, true)
+	chrootInterpreter := filepath.Join(imagePath, inFirstDir)
+	info, err := os.Lstat(chrootInterpreter)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(true, info.Mode().IsRegular())
+
+	asserter.AssertErrNil(restore(), true)
+	if osutil.FileExists(chrootInterpreter) {
+		t.Errorf("%s was not removed", chrootInterpreter)
+	}
+	if !osutil.FileExists(hostInterpreter) {
+		t.Errorf("the interpreter of the host was removed")
+	}
+}
@@ -0,0 +1,324 @@
+package statemachine
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"operese/cedar/internal/helper"
+)
+
+// auditEntry is the state of a path of the image tree
+type auditEntry struct {
+	mode     fs.FileMode
+	size     int64
+	uid      uint32
+	gid      uint32
+	mtime    int64
+	ctime    int64
+	inode    uint64
+	target   string
+	sha256   string
+	isHashed bool
+}
+
+// sameMetadata tells whether a path was left untouched. The change time is
+// compared as it cannot be set back, unlike the modification time. The
+// times of directories change with their entries, which are compared anyway.
+func (entry *auditEntry) sameMetadata(other *auditEntry) bool {
+	if entry.mode != other.mode || entry.uid != other.uid || entry.gid != other.gid || entry.inode != other.inode {
+		return false
+	}
+	if entry.mode.IsDir() {
+		return true
+	}
+	return entry.size == other.size && entry.mtime == other.mtime &&
+		entry.ctime == other.ctime && entry.target == other.target
+}
+
+// sameContent tells whether a path, hashed in both snapshots, has the same
+// type, mode, ownership and content. Files rewritten identically are not changes.
+func (entry *auditEntry) sameContent(other *auditEntry) bool {
+	if entry.mode != other.mode || entry.uid != other.uid || entry.gid != other.gid {
+		return false
+	}
+	if entry.mode.IsDir() {
+		return true
+	}
+	return entry.size == other.size && entry.target == other.target && entry.sha256 == other.sha256
+}
+
+// treeSnapshot maps the paths of the image tree, relative to its root, to their state
+type treeSnapshot map[string]*auditEntry
+
+// auditScope is the patterns, relative to the image tree, of the paths the
+// audit records: the whole tree, so the changes of the packages, of the
+// preseeding, of the hooks, of the chroot commands and of clean_rootfs are
+// recorded too. The pseudo-filesystems of the chroot are mounted in a private
+// mount namespace, so the audit only sees the files of /dev, /proc, /sys and
+// /run that are part of the tree. Only the initial and final snapshots hash the files, and the
+// final one reuses the hashes of the unmodified ones.
+var auditScope = []string{"*"}
+
+// auditRoots lists the paths of the tree matching the scope, leaving out
+// the ones under another path of the list
+func auditRoots(root string, scope []string) ([]string, error) {
+	matches, err := listWithPatterns(root, scope)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing the paths of the audit: %s", err.Error())
+	}
+	sort.Strings(matches)
+	roots := make([]string, 0, len(matches))
+	for _, match := range matches {
+		relPath, err := filepathRel(root, match)
+		if err != nil {
+			return nil, fmt.Errorf("Error listing the paths of the audit: %s", err.Error())
+		}
+		if relPath == "." {
+			continue
+		}
+		nested := false
+		for _, auditRoot := range roots {
+			if isSubPath(match, auditRoot) {
+				nested = true
+				break
+			}
+		}
+		if !nested {
+			roots = append(roots, match)
+		}
+	}
+	return roots, nil
+}
+
+// snapshotTree records the state of every path of the tree in the scope.
+// With hashes, the content of the regular files is hashed, unless previous
+// has a hash for the same unmodified file.
+func snapshotTree(root string, scope []string, hashes bool, previous treeSnapshot) (treeSnapshot, error) {
+	roots, err := auditRoots(root, scope)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := make(treeSnapshot)
+	walkFunc := func(path string, dirEntry fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			// removed while walking the tree
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		relPath, err := filepathRel(root, path)
+		if err != nil {
+			return err
+		}
+		info, err := dirEntry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		entry := &auditEntry{mode: info.Mode(), size: info.Size(), mtime: info.ModTime().UnixNano()}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			entry.uid = stat.Uid
+			entry.gid = stat.Gid
+			entry.ctime = stat.Ctim.Nano()
+			entry.inode = stat.Ino
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			entry.target, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		}
+		if hashes && info.Mode().IsRegular() {
+			if old, found := previous[relPath]; found && old.isHashed && old.sameMetadata(entry) {
+				entry.sha256 = old.sha256
+			} else if entry.sha256, err = helper.HashFile(path, helper.SHA256); err != nil {
+				return err
+			}
+			entry.isHashed = true
+		}
+		snapshot[relPath] = entry
+		return nil
+	}
+	for _, auditRoot := range roots {
+		if err := filepath.WalkDir(auditRoot, walkFunc); err != nil {
+			return nil, fmt.Errorf("Error recording the content of the image tree: %s", err.Error())
+		}
+	}
+	return snapshot, nil
+}
+
+// changedPaths returns the paths added, modified or deleted between two
+// snapshots, according to same
+func changedPaths(before, after treeSnapshot, same func(*auditEntry, *auditEntry) bool) []string {
+	paths := make([]string, 0)
+	for path, afterEntry := range after {
+		if beforeEntry, found := before[path]; !found || !same(beforeEntry, afterEntry) {
+			paths = append(paths, path)
+		}
+	}
+	for path := range before {
+		if _, found := after[path]; !found {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// treeAudit records the changes made to the image tree by the states
+type treeAudit struct {
+	root    string
+	scope   []string
+	started time.Time
+	initial treeSnapshot
+	last    treeSnapshot
+	// the states that changed each path
+	changedBy map[string][]string
+}
+
+// newTreeAudit records the initial state of the paths of the image tree in the scope
+func newTreeAudit(root string, scope []string) (*treeAudit, error) {
+	initial, err := snapshotTree(root, scope, true, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &treeAudit{
+		root:      root,
+		scope:     scope,
+		started:   time.Now(),
+		initial:   initial,
+		last:      initial,
+		changedBy: make(map[string][]string),
+	}, nil
+}
+
+// recordState attributes the changes made since the previous state to the
+// given one. A nil treeAudit records nothing.
+func (audit *treeAudit) recordState(state string) error {
+	if audit == nil {
+		return nil
+	}
+	snapshot, err := snapshotTree(audit.root, audit.scope, false, nil)
+	if err != nil {
+		return err
+	}
+	for _, path := range changedPaths(audit.last, snapshot, (*auditEntry).sameMetadata) {
+		audit.changedBy[path] = append(audit.changedBy[path], state)
+	}
+	audit.last = snapshot
+	return nil
+}
+
+// AuditLog lists the changes made to the image tree during a build
+type AuditLog struct {
+	ImagePath string        `json:"image-path"`
+	Started   string        `json:"started"`
+	Finished  string        `json:"finished"`
+	Changes   []AuditChange `json:"changes"`
+}
+
+// AuditChange is a path added, modified or deleted during the build
+type AuditChange struct {
+	Path   string `json:"path"`
+	Change string `json:"change"`
+	// States lists the states that changed the path
+	States []string        `json:"states,omitempty"`
+	Before *AuditPathState `json:"before,omitempty"`
+	After  *AuditPathState `json:"after,omitempty"`
+}
+
+// AuditPathState is the state of a path before or after the build
+type AuditPathState struct {
+	Type   string `json:"type"`
+	Mode   string `json:"mode"`
+	Owner  string `json:"owner"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+	Target string `json:"target,omitempty"`
+}
+
+// auditPathState converts an entry of a snapshot for the audit log
+func auditPathState(entry *auditEntry) *AuditPathState {
+	pathType := "file"
+	switch {
+	case entry.mode.IsDir():
+		pathType = "directory"
+	case entry.mode&fs.ModeSymlink != 0:
+		pathType = "symlink"
+	case !entry.mode.IsRegular():
+		pathType = "special"
+	}
+	return &AuditPathState{
+		Type:   pathType,
+		Mode:   fmt.Sprintf("%04o", uint32(entry.mode.Perm())|unixModeBitsFromFileMode(entry.mode)),
+		Owner:  fmt.Sprintf("%d:%d", entry.uid, entry.gid),
+		Size:   entry.size,
+		SHA256: entry.sha256,
+		Target: entry.target,
+	}
+}
+
+// unixModeBitsFromFileMode returns the setuid, setgid and sticky bits of a
+// mode in their unix representation
+func unixModeBitsFromFileMode(mode fs.FileMode) uint32 {
+	var bits uint32
+	if mode&fs.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&fs.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return bits
+}
+
+// write records the final state of the image tree and writes the changes
+// since the initial one to path
+func (audit *treeAudit) write(path string) error {
+	final, err := snapshotTree(audit.root, audit.scope, true, audit.initial)
+	if err != nil {
+		return err
+	}
+
+	auditLog := AuditLog{
+		ImagePath: audit.root,
+		Started:   audit.started.UTC().Format(time.RFC3339),
+		Finished:  time.Now().UTC().Format(time.RFC3339),
+		Changes:   make([]AuditChange, 0),
+	}
+	for _, changedPath := range changedPaths(audit.initial, final, (*auditEntry).sameContent) {
+		change := AuditChange{Path: changedPath, States: audit.changedBy[changedPath]}
+		before, inBefore := audit.initial[changedPath]
+		after, inAfter := final[changedPath]
+		switch {
+		case !inBefore:
+			change.Change = "added"
+			change.After = auditPathState(after)
+		case !inAfter:
+			change.Change = "deleted"
+			change.Before = auditPathState(before)
+		default:
+			change.Change = "modified"
+			change.Before = auditPathState(before)
+			change.After = auditPathState(after)
+		}
+		auditLog.Changes = append(auditLog.Changes, change)
+	}
+
+	if err := writeJSONFile(path, auditLog); err != nil {
+		return fmt.Errorf("Error writing the audit log: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package statemachine
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"operese/cedar/internal/commands"
+	"operese/cedar/internal/helper"
+)
+
+// TestSameMetadataAndContent tests which differences between two states of
+// a path are changes
+func TestSameMetadataAndContent(t *testing.T) {
+	file := auditEntry{mode: 0644, size: 4, uid: 0, gid: 0, mtime: 1, ctime: 2, inode: 3, sha256: "abcd", isHashed: true}
+	dir := auditEntry{mode: fs.ModeDir | 0755, size: 4096, mtime: 1, ctime: 2, inode: 4}
+	testCases := []struct {
+		name            string
+		before          auditEntry
+		change          func(entry *auditEntry)
+		expectedMeta    bool
+		expectedContent bool
+	}{
+		{"unchanged", file, func(entry *auditEntry) {}, true, true},
+		{"touched", file, func(entry *auditEntry) { entry.mtime = 10; entry.ctime = 11 }, false, true},
+		{"rewritten", file, func(entry *auditEntry) { entry.inode = 30; entry.ctime = 11 }, false, true},
+		{"content", file, func(entry *auditEntry) { entry.ctime = 11; entry.sha256 = "ef01" }, false, false},
+		{"size", file, func(entry *auditEntry) { entry.size = 5 }, false, false},
+		{"mode", file, func(entry *auditEntry) { entry.mode = 0600 }, false, false},
+		{"owner", file, func(entry *auditEntry) { entry.uid = 1000 }, false, false},
+		{"symlink_target", auditEntry{mode: fs.ModeSymlink | 0777, target: "a"}, func(entry *auditEntry) { entry.target = "b" }, false, false},
+		{"directory_times", dir, func(entry *auditEntry) { entry.mtime = 10; entry.ctime = 11; entry.size = 8192 }, true, true},
+		{"directory_mode", dir, func(entry *auditEntry) { entry.mode = fs.ModeDir | 0700 }, false, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			before := tc.before
+			after := tc.before
+			tc.change(&after)
+			asserter.AssertEqual(tc.expectedMeta, before.sameMetadata(&after))
+			asserter.AssertEqual(tc.expectedContent, before.sameContent(&after))
+		})
+	}
+}
+
+// TestChangedPaths tests the paths added, modified and deleted between two snapshots
+func TestChangedPaths(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	before := treeSnapshot{
+		"etc":          {mode: fs.ModeDir | 0755},
+		"etc/hostname": {mode: 0644, size: 5},
+		"etc/hosts":    {mode: 0644, size: 10},
+		"etc/old":      {mode: 0644},
+	}
+	after := treeSnapshot{
+		"etc":          {mode: fs.ModeDir | 0755},
+		"etc/hostname": {mode: 0644, size: 5},
+		"etc/hosts":    {mode: 0644, size: 12},
+		"etc/new":      {mode: 0644},
+	}
+	asserter.AssertEqual([]string{"etc/hosts", "etc/new", "etc/old"}, changedPaths(before, after, (*auditEntry).sameMetadata))
+	asserter.AssertEqual([]string{}, changedPaths(before, before, (*auditEntry).sameContent))
+}
+
+// TestAuditPathState tests the conversion of the entries for the audit log
+func TestAuditPathState(t *testing.T) {
+	testCases := []struct {
+		name     string
+		entry    auditEntry
+		expected AuditPathState
+	}{
+		{
+			"file",
+			auditEntry{mode: 0644, size: 12, uid: 0, gid: 0, sha256: "abcd"},
+			AuditPathState{Type: "file", Mode: "0644", Owner: "0:0", Size: 12, SHA256: "abcd"},
+		},
+		{
+			"setuid",
+			auditEntry{mode: fs.ModeSetuid | 0755, uid: 0, gid: 50},
+			AuditPathState{Type: "file", Mode: "4755", Owner: "0:50"},
+		},
+		{
+			"sticky_directory",
+			auditEntry{mode: fs.ModeDir | fs.ModeSticky | 0777, size: 4096},
+			AuditPathState{Type: "directory", Mode: "1777", Owner: "0:0", Size: 4096},
+		},
+		{
+			"setgid_directory",
+			auditEntry{mode: fs.ModeDir | fs.ModeSetgid | 02775, uid: 1000, gid: 1000},
+			AuditPathState{Type: "directory", Mode: "2775", Owner: "1000:1000"},
+		},
+		{
+			"symlink",
+			auditEntry{mode: fs.ModeSymlink | 0777, size: 9, target: "/run/foo"},
+			AuditPathState{Type: "symlink", Mode: "0777", Owner: "0:0", Size: 9, Target: "/run/foo"},
+		},
+		{
+			"fifo",
+			auditEntry{mode: fs.ModeNamedPipe | 0600},
+			AuditPathState{Type: "special", Mode: "0600", Owner: "0:0"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			asserter.AssertEqual(&tc.expected, auditPathState(&tc.entry))
+		})
+	}
+}
+
+// TestSnapshotTreeScope tests that the whole tree is recorded, including
+// the directories the pseudo-filesystems are mounted on in the chroot
+func TestSnapshotTreeScope(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	root := t.TempDir()
+	for _, path := range []string{
+		"etc/hostname",
+		"usr/bin/hello",
+		"var/lib/dpkg/status",
+		"dev/null",
+		"proc/1/status",
+		".hidden",
+	} {
+		writeTestTreeFile(t, root, path, path)
+	}
+
+	snapshot, err := snapshotTree(root, auditScope, true, nil)
+	asserter.AssertErrNil(err, true)
+
+	paths := make([]string, 0, len(snapshot))
+	for path := range snapshot {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	asserter.AssertEqual([]string{
+		".hidden",
+		"dev",
+		"dev/null",
+		"etc",
+		"etc/hostname",
+		"proc",
+		"proc/1",
+		"proc/1/status",
+		"usr",
+		"usr/bin",
+		"usr/bin/hello",
+		"var",
+		"var/lib",
+		"var/lib/dpkg",
+		"var/lib/dpkg/status",
+	}, paths)
+
+	hash, err := helper.HashFile(filepath.Join(root, "etc", "hostname"), helper.SHA256)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(hash, snapshot["etc/hostname"].sha256)
+}
+
+// TestTreeAuditPackageFile tests that the files installed by a package, out
+// of the directories cedar writes to itself, are reported
+func TestTreeAuditPackageFile(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	root := t.TempDir()
+	writeTestTreeFile(t, root, "var/lib/dpkg/status", "")
+
+	audit, err := newTreeAudit(root, auditScope)
+	asserter.AssertErrNil(err, true)
+	writeTestTreeFile(t, root, "usr/bin/tool", "#!/bin/sh\n")
+	writeTestTreeFile(t, root, "var/lib/dpkg/status", dpkgStatusEntry("tool", "1.0", "amd64", true))
+	asserter.AssertErrNil(audit.recordState("install_packages"), true)
+
+	auditLogPath := filepath.Join(t.TempDir(), "audit.json")
+	asserter.AssertErrNil(audit.write(auditLogPath), true)
+	content, err := os.ReadFile(auditLogPath)
+	asserter.AssertErrNil(err, true)
+	var auditLog AuditLog
+	asserter.AssertErrNil(json.Unmarshal(content, &auditLog), true)
+
+	changes := make(map[string]AuditChange)
+	for _, change := range auditLog.Changes {
+		changes[change.Path] = change
+	}
+	tool, found := changes["usr/bin/tool"]
+	if !found {
+		t.Fatalf("usr/bin/tool is not reported in %v", auditLog.Changes)
+	}
+	asserter.AssertEqual("added", tool.Change)
+	asserter.AssertEqual([]string{"install_packages"}, tool.States)
+	asserter.AssertEqual("modified", changes["var/lib/dpkg/status"].Change)
+}
+
+// TestTreeAuditCleanRootfs tests that the files clean_rootfs deletes from the
+// directories of the pseudo-filesystems are reported
+func TestTreeAuditCleanRootfs(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	root := t.TempDir()
+	for _, path := range []string{"dev/console", "run/lock/file", "etc/hostname"} {
+		writeTestTreeFile(t, root, path, path)
+	}
+
+	audit, err := newTreeAudit(root, auditScope)
+	asserter.AssertErrNil(err, true)
+	classicStateMachine := &ClassicStateMachine{Args: commands.ClassicArgs{ImagePath: root}}
+	classicStateMachine.parent = classicStateMachine
+	asserter.AssertErrNil(classicStateMachine.cleanRootfs(), true)
+	asserter.AssertErrNil(audit.recordState("clean_rootfs"), true)
+
+	auditLogPath := filepath.Join(t.TempDir(), "audit.json")
+	asserter.AssertErrNil(audit.write(auditLogPath), true)
+	content, err := os.ReadFile(auditLogPath)
+	asserter.AssertErrNil(err, true)
+	var auditLog AuditLog
+	asserter.AssertErrNil(json.Unmarshal(content, &auditLog), true)
+
+	changes := make(map[string]AuditChange)
+	for _, change := range auditLog.Changes {
+		changes[change.Path] = change
+	}
+	for _, path := range []string{"dev/console", "run/lock", "run/lock/file"} {
+		change, found := changes[path]
+		if !found {
+			t.Fatalf("%s is not reported in %v", path, auditLog.Changes)
+		}
+		asserter.AssertEqual("deleted", change.Change)
+		asserter.AssertEqual([]string{"clean_rootfs"}, change.States)
+	}
+	if _, found := changes["etc/hostname"]; found {
+		t.Errorf("etc/hostname is reported but was not changed")
+	}
+}
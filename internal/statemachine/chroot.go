@@ -0,0 +1,132 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// policyRcD prevents services from being started by package maintainer
+// scripts run in the chroot
+const policyRcD = `#!/bin/sh
+echo "All runlevel operations denied by policy" >&2
+exit 101
+`
+
+var policyRcDRelPath = filepath.Join("usr", "sbin", "policy-rc.d")
+
+// runInChroot runs the given commands with the pseudo filesystems mounted in
+// the image tree, in a private mount namespace. The commands run in order and
+// the first failure stops them. env is added to the environment of cedar.
+func (classicStateMachine *ClassicStateMachine) runInChroot(cmds []*exec.Cmd, env []string) (err error) {
+	// mountCmds should be filled as a FIFO list
+	var mountCmds []*exec.Cmd
+	// unmount commands are not needed: the kernel releases every mount of the
+	// namespace once the commands exit, even if cedar gets killed
+	var teardownCmds []*exec.Cmd
+	if !classicStateMachine.Rootless {
+		// udev cannot be reached from a user namespace
+		teardownCmds = append(teardownCmds, execCommand("udevadm", "settle"))
+	}
+
+	restoreEmulation, err := setupEmulation(classicStateMachine.Args.ImagePath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = joinRestoreErr(err, restoreEmulation())
+	}()
+
+	mountPoints := chrootMountPoints(classicStateMachine.Args.ImagePath, classicStateMachine.Rootless)
+
+	// The mounts are done in a private mount namespace, so nothing should
+	// leak to the host. Still make sure we left the system as clean as
+	// possible if something has gone wrong
+	defer func() {
+		err = teardownMount(classicStateMachine.Args.ImagePath, mountPoints, teardownCmds, err, classicStateMachine.commonFlags.Debug)
+	}()
+
+	for _, mp := range mountPoints {
+		mpMountCmds, _, err := mp.getMountCmd()
+		if err != nil {
+			return fmt.Errorf("Error preparing mountpoint \"%s\": \"%s\"",
+				mp.relpath,
+				err.Error(),
+			)
+		}
+		mountCmds = append(mountCmds, mpMountCmds...)
+	}
+
+	nsCmd := namespacedCmd(append(mountCmds, cmds...))
+	if len(env) > 0 {
+		nsCmd.Env = append(os.Environ(), env...)
+	}
+
+	return helperRunCmdContext(classicStateMachine.ctx, nsCmd, classicStateMachine.commonFlags.Debug)
+}
+
+// guardChroot gives the chroot access to the network of the host and
+// prevents services from being started in it. The returned function
+// reverts both.
+func (classicStateMachine *ClassicStateMachine) guardChroot() (restore func(error) error, err error) {
+	imagePath := classicStateMachine.Args.ImagePath
+	if err := helperBackupAndCopyResolvConf(imagePath); err != nil {
+		return nil, fmt.Errorf("Error setting up /etc/resolv.conf in the chroot: \"%s\"", err.Error())
+	}
+
+	var restorePolicyRcD func(error) error
+	policyRcDPath, err := resolveParentInTree(imagePath, policyRcDRelPath)
+	if err == nil {
+		restorePolicyRcD, err = helperBackupReplace(policyRcDPath, policyRcD)
+	}
+	if err != nil {
+		err = fmt.Errorf("Error installing policy-rc.d in the chroot: %s", err.Error())
+		return nil, joinRestoreErr(err, helperRestoreResolvConf(imagePath))
+	}
+
+	return func(err error) error {
+		if restorePolicyRcD != nil {
+			err = restorePolicyRcD(err)
+		}
+		return joinRestoreErr(err, helperRestoreResolvConf(imagePath))
+	}, nil
+}
+
+// resolveParentInTree returns the path of a file of the image tree, with its
+// parent directories resolved like they would be in the chroot, so that a
+// symlink of the tree never leads to a file of the host. The file itself is
+// not resolved.
+func resolveParentInTree(imagePath string, relPath string) (string, error) {
+	parent, err := helperResolveInRoot(imagePath, filepath.Dir(relPath))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(parent, filepath.Base(relPath)), nil
+}
+
+var chrootCommandsState = stateFunc{"chroot_commands", (*StateMachine).runChrootCommands}
+
+// runChrootCommands runs the customization commands of the snap list in the chroot
+func (stateMachine *StateMachine) runChrootCommands() (err error) {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+
+	restore, err := classicStateMachine.guardChroot()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = restore(err)
+	}()
+
+	cmds := make([]*exec.Cmd, 0, len(classicStateMachine.ImageDef.ChrootCommands))
+	for _, command := range classicStateMachine.ImageDef.ChrootCommands {
+		cmds = append(cmds, execCommand("chroot", classicStateMachine.Args.ImagePath, "sh", "-c", command))
+	}
+
+	err = classicStateMachine.runInChroot(cmds, []string{"DEBIAN_FRONTEND=noninteractive"})
+	if err != nil {
+		return fmt.Errorf("Error running chroot commands: %s", err.Error())
+	}
+	return nil
+}
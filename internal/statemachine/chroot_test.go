@@ -0,0 +1,155 @@
+package statemachine
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/snapcore/snapd/osutil"
+
+	"operese/cedar/internal/commands"
+	"operese/cedar/internal/helper"
+	"operese/cedar/internal/snaplist"
+)
+
+// mockResolvConf replaces the handling of resolv.conf, which copies the one of the host
+func mockResolvConf(t *testing.T) {
+	t.Helper()
+	helperBackupAndCopyResolvConf = func(string) error { return nil }
+	helperRestoreResolvConf = func(string) error { return nil }
+	t.Cleanup(func() {
+		helperBackupAndCopyResolvConf = helper.BackupAndCopyResolvConf
+		helperRestoreResolvConf = helper.RestoreResolvConf
+	})
+}
+
+// TestGuardChroot tests that policy-rc.d is installed in the image tree and
+// removed or restored afterwards, and never written to the host
+func TestGuardChroot(t *testing.T) {
+	testCases := []struct {
+		name        string
+		existing    string
+		sbinLink    bool
+		expectedErr string
+	}{
+		{"missing", "", false, ""},
+		{"existing", "#!/bin/sh\nexit 0\n", false, ""},
+		{"absolute_symlink_to_host", "", true, "Error installing policy-rc.d in the chroot"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			mockResolvConf(t)
+			imagePath := t.TempDir()
+			hostSbin := t.TempDir()
+			policyRcDPath := filepath.Join(imagePath, policyRcDRelPath)
+			if tc.sbinLink {
+				asserter.AssertErrNil(os.MkdirAll(filepath.Join(imagePath, "usr"), 0755), true)
+				asserter.AssertErrNil(os.Symlink(hostSbin, filepath.Join(imagePath, "usr", "sbin")), true)
+			} else {
+				asserter.AssertErrNil(os.MkdirAll(filepath.Dir(policyRcDPath), 0755), true)
+			}
+			if tc.existing != "" {
+				asserter.AssertErrNil(os.WriteFile(policyRcDPath, []byte(tc.existing), 0755), true)
+			}
+
+			classicStateMachine := &ClassicStateMachine{Args: commands.ClassicArgs{ImagePath: imagePath}}
+			restore, err := classicStateMachine.guardChroot()
+			asserter.AssertEqual(false, osutil.FileExists(filepath.Join(hostSbin, "policy-rc.d")))
+			if tc.expectedErr != "" {
+				asserter.AssertErrContains(err, tc.expectedErr)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+
+			content, err := os.ReadFile(policyRcDPath)
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(policyRcD, string(content))
+
+			asserter.AssertErrNil(restore(nil), true)
+			content, err = os.ReadFile(policyRcDPath)
+			if tc.existing == "" {
+				asserter.AssertEqual(true, os.IsNotExist(err))
+				return
+			}
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.existing, string(content))
+		})
+	}
+}
+
+// TestShellJoin tests that the quoted arguments are read back unchanged by sh
+func TestShellJoin(t *testing.T) {
+	testCases := []struct {
+		name     string
+		args     []string
+		expected string
+	}{
+		{"plain", []string{"mount", "-t", "proc", "proc-build"}, `'mount' '-t' 'proc' 'proc-build'`},
+		{"spaces", []string{"echo", "hello world"}, `'echo' 'hello world'`},
+		{"quote", []string{"echo", "it's"}, `'echo' 'it'\''s'`},
+		{"expansions", []string{"echo", "$HOME `id` $(id) *"}, "'echo' '$HOME `id` $(id) *'"},
+		{"empty", []string{"echo", ""}, `'echo' ''`},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			joined := shellJoin(tc.args)
+			asserter.AssertEqual(tc.expected, joined)
+
+			// printf prints every argument it is given on its own line
+			output, err := exec.Command("sh", "-c", "printf '%s\\n' "+joined).Output()
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(strings.Join(tc.args, "\n")+"\n", string(output))
+		})
+	}
+}
+
+// TestRunChrootCommands tests that the commands of the snap list run in the
+// chroot, in one shell of a private mount namespace, while policy-rc.d is installed
+func TestRunChrootCommands(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	mockResolvConf(t)
+	mockExecCommand(t)
+	imagePath := t.TempDir()
+	writeDpkgStatus(t, imagePath, dpkgStatusEntry("dpkg", "1.22.6", hostArchitecture(), true))
+	asserter.AssertErrNil(os.MkdirAll(filepath.Join(imagePath, "usr", "sbin"), 0755), true)
+
+	var nsCmd *exec.Cmd
+	policyRcDInstalled := false
+	helperRunCmdContext = func(ctx context.Context, cmd *exec.Cmd, debug bool) error {
+		nsCmd = cmd
+		policyRcDInstalled = osutil.FileExists(filepath.Join(imagePath, policyRcDRelPath))
+		return nil
+	}
+	t.Cleanup(func() { helperRunCmdContext = helper.RunCmdContext })
+
+	classicStateMachine := &ClassicStateMachine{
+		Args: commands.ClassicArgs{ImagePath: imagePath},
+		ImageDef: snaplist.SnapList{ChrootCommands: []string{
+			"echo 'hello world' > /etc/motd",
+			"apt-get install -y vim",
+		}},
+	}
+	classicStateMachine.parent = classicStateMachine
+	classicStateMachine.commonFlags = &commands.CommonOpts{}
+	classicStateMachine.ctx = context.Background()
+
+	asserter.AssertErrNil(classicStateMachine.runChrootCommands(), true)
+	if nsCmd == nil {
+		t.Fatal("The chroot commands were not run")
+	}
+	asserter.AssertEqual(true, policyRcDInstalled)
+	asserter.AssertEqual(false, osutil.FileExists(filepath.Join(imagePath, policyRcDRelPath)))
+	asserter.AssertEqual(true, helper.SliceHasElement(nsCmd.Env, "DEBIAN_FRONTEND=noninteractive"))
+
+	script := strings.Split(nsCmd.Args[2], "\n")
+	asserter.AssertEqual("set -e", script[0])
+	asserter.AssertEqual([]string{
+		"'chroot' '" + imagePath + "' 'sh' '-c' 'echo '\\''hello world'\\'' > /etc/motd'",
+		"'chroot' '" + imagePath + "' 'sh' '-c' 'apt-get install -y vim'",
+	}, script[len(script)-2:])
+}
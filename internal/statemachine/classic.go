@@ -1,14 +1,21 @@
 package statemachine
 
 import (
+	"crypto"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/invopop/jsonschema"
+	"github.com/snapcore/snapd/gadget/quantity"
+	"github.com/snapcore/snapd/osutil"
 	"github.com/xeipuuv/gojsonschema"
 	"gopkg.in/yaml.v2"
 
 	"operese/cedar/internal/commands"
+	"operese/cedar/internal/helper"
 	"operese/cedar/internal/snaplist"
 )
 
@@ -18,10 +25,52 @@ type ClassicStateMachine struct {
 	ImageDef snaplist.SnapList
 	Args     commands.ClassicArgs
 	Preseed  bool
+	Wait     time.Duration
+	// running in a user namespace, without real root privileges
+	Rootless         bool
+	SkipPreflight    bool
+	SetDefaultLocale bool
+	CleanRootfs      bool
+	// where the build report is written, if requested
+	ReportPath string
+	// where the changes made to the image tree are listed, if requested
+	AuditLogPath string
+	// where and in which format the snap manifest is written, if requested
+	ManifestPath   string
+	ManifestFormat string
+	// where the SBOMs of the seeded snaps are written, if requested
+	SPDXPath      string
+	CycloneDXPath string
+	// where the provenance is written, if requested, and the key signing it
+	ProvenancePath    string
+	ProvenanceKeyPath string
+	provenanceSigner  crypto.Signer
+	// arguments cedar was run with, recorded in the provenance
+	CommandLine []string
+	// clamp the timestamps of the image tree to SOURCE_DATE_EPOCH
+	Reproducible    bool
+	sourceDateEpoch time.Time
+	// state of the image tree before the build, so only what the build
+	// changed is clamped
+	reproducibleBase treeSnapshot
+	// budget of the seed size and of the growth of the image tree, which
+	// takes precedence over max-seed-size in the snap list
+	MaxSeedSize     string
+	maxSeedSize     quantity.Size
+	diskUsageBefore *diskUsageSnapshot
+	diskUsage       *DiskUsage
+	// version of cedar, recorded in the report
+	Version string
+	// digests of the seeded snaps, shared by the outputs describing them
+	snapDigests snapDigestCache
+
+	// values detected from the image tree because the snap list lacks them
+	DetectedArchitecture string
+	DetectedSeries       string
 }
 
 // Setup assigns variables and calls other functions that must be executed before Run()
-func (classicStateMachine *ClassicStateMachine) Setup() error {
+func (classicStateMachine *ClassicStateMachine) Setup() (err error) {
 	// set the parent pointer of the embedded struct
 	classicStateMachine.parent = classicStateMachine
 
@@ -32,6 +81,26 @@ func (classicStateMachine *ClassicStateMachine) Setup() error {
 		return err
 	}
 
+	// the files of the snap list are relative to its directory, which must
+	// not be looked up in $PATH or from the directory of a hook
+	snapListPath, err := filepath.Abs(classicStateMachine.Args.SnapList)
+	if err != nil {
+		return fmt.Errorf("Error getting absolute path of \"%s\": %s", classicStateMachine.Args.SnapList, err.Error())
+	}
+	classicStateMachine.Args.SnapList = snapListPath
+
+	if !classicStateMachine.commonFlags.DryRun {
+		if err := classicStateMachine.lockTree(classicStateMachine.Args.ImagePath, classicStateMachine.Wait); err != nil {
+			return err
+		}
+		// Teardown is not called when Setup fails, so release the lock here
+		defer func() {
+			if err != nil {
+				_ = classicStateMachine.unlockTree()
+			}
+		}()
+	}
+
 	if err := classicStateMachine.parseSnapList(); err != nil {
 		return err
 	}
@@ -45,10 +114,45 @@ func (classicStateMachine *ClassicStateMachine) Setup() error {
 		return err
 	}
 
+	if err := classicStateMachine.validateSkipOnly(); err != nil {
+		return err
+	}
+	classicStateMachine.applySkipOnly()
+
+	if err := classicStateMachine.loadProvenanceKey(); err != nil {
+		return err
+	}
+
+	if err := classicStateMachine.loadSourceDateEpoch(); err != nil {
+		return err
+	}
+
+	if err := classicStateMachine.loadMaxSeedSize(); err != nil {
+		return err
+	}
+
 	if err := classicStateMachine.SetSeries(); err != nil {
 		return err
 	}
 
+	if !classicStateMachine.commonFlags.DryRun {
+		if err := classicStateMachine.validateImageTree(); err != nil {
+			return err
+		}
+	}
+
+	if !classicStateMachine.commonFlags.DryRun {
+		if err := classicStateMachine.checkPrerequisites(); err != nil {
+			return err
+		}
+	}
+
+	if !classicStateMachine.commonFlags.DryRun && !classicStateMachine.SkipPreflight {
+		if err := classicStateMachine.preflight(); err != nil {
+			return err
+		}
+	}
+
 	classicStateMachine.displayStates()
 
 	if classicStateMachine.commonFlags.DryRun {
@@ -57,6 +161,44 @@ func (classicStateMachine *ClassicStateMachine) Setup() error {
 	return nil
 }
 
+// Run runs the states and, if one of them fails, the on-failure hooks. The
+// tree is measured and recorded first for the disk usage check, the audit
+// and the reproducible mode, and the audit log and the report are written
+// last, so they record the outcome of the whole build.
+func (classicStateMachine *ClassicStateMachine) Run() error {
+	if classicStateMachine.commonFlags.DryRun {
+		return classicStateMachine.runStatesAndHooks()
+	}
+
+	diskUsageBefore, err := measureDiskUsage(classicStateMachine.Args.ImagePath)
+	if err != nil {
+		return err
+	}
+	classicStateMachine.diskUsageBefore = diskUsageBefore
+
+	if classicStateMachine.AuditLogPath != "" {
+		audit, err := newTreeAudit(classicStateMachine.Args.ImagePath, auditScope)
+		if err != nil {
+			return err
+		}
+		classicStateMachine.audit = audit
+	}
+	if classicStateMachine.Reproducible {
+		if err := classicStateMachine.recordReproducibleBase(); err != nil {
+			return err
+		}
+	}
+
+	err = classicStateMachine.runStatesAndHooks()
+	if classicStateMachine.audit != nil {
+		err = joinRestoreErr(err, classicStateMachine.audit.write(classicStateMachine.AuditLogPath))
+	}
+	if classicStateMachine.ReportPath != "" {
+		err = joinRestoreErr(err, classicStateMachine.writeReport(err))
+	}
+	return err
+}
+
 func (classicStateMachine *ClassicStateMachine) SetSeries() error {
 	classicStateMachine.series = classicStateMachine.ImageDef.Series
 	return nil
@@ -82,9 +224,18 @@ func (stateMachine *StateMachine) parseSnapList() error {
 		return err
 	}
 
+	err = validateCleanRootfsPatterns(snapList.CleanRootfs)
+	if err != nil {
+		return err
+	}
+
 	classicStateMachine.ImageDef = *snapList
+	classicStateMachine.Packages = snapList.Packages
 
-	return nil
+	if err := classicStateMachine.validatePackages(); err != nil {
+		return err
+	}
+	return classicStateMachine.validateFiles()
 }
 
 func readSnapList(snapListPath string) (*snaplist.SnapList, error) {
@@ -147,10 +298,122 @@ func validateSnapList(snapList *snaplist.SnapList) error {
 func (s *StateMachine) calculateStates() error {
 	classicStateMachine := s.parent.(*ClassicStateMachine)
 
+	hooks := classicStateMachine.ImageDef.Hooks
+	if hooks == nil {
+		hooks = &snaplist.Hooks{}
+	}
+
+	if len(classicStateMachine.Packages) > 0 {
+		s.states = append(s.states, installPackagesState)
+	}
+	if len(classicStateMachine.ImageDef.Files) > 0 {
+		s.states = append(s.states, addFilesState)
+	}
+	if len(hooks.PrePrepare) > 0 {
+		s.states = append(s.states, prePrepareHooksState)
+	}
 	s.states = append(s.states, prepareClassicImageState)
+	if classicStateMachine.ManifestPath != "" {
+		s.states = append(s.states, writeManifestState)
+	}
+	if classicStateMachine.SPDXPath != "" || classicStateMachine.CycloneDXPath != "" {
+		s.states = append(s.states, writeSBOMState)
+	}
+	if len(hooks.PostPrepare) > 0 {
+		s.states = append(s.states, postPrepareHooksState)
+	}
 	if classicStateMachine.Preseed {
+		if len(hooks.PrePreseed) > 0 {
+			s.states = append(s.states, prePreseedHooksState)
+		}
 		s.states = append(s.states, preseedClassicImageState)
+		if len(hooks.PostPreseed) > 0 {
+			s.states = append(s.states, postPreseedHooksState)
+		}
+	}
+
+	if len(classicStateMachine.ImageDef.ChrootCommands) > 0 {
+		s.states = append(s.states, chrootCommandsState)
+	}
+
+	if classicStateMachine.SetDefaultLocale || *classicStateMachine.ImageDef.SetDefaultLocale {
+		s.states = append(s.states, setDefaultLocaleState)
+	}
+
+	// cleaning must stay last, so nothing is generated after it
+	if classicStateMachine.CleanRootfs || classicStateMachine.ImageDef.CleanRootfs != nil {
+		s.states = append(s.states, cleanRootfsState)
+	}
+
+	// only timestamps and ordering are changed, so it can follow the cleaning
+	if classicStateMachine.Reproducible {
+		s.states = append(s.states, makeReproducibleState)
 	}
 
+	// after everything that changes the size of the tree
+	s.states = append(s.states, checkDiskUsageState)
+
+	// the provenance only reads the tree, and must describe its final state
+	if classicStateMachine.ProvenancePath != "" {
+		s.states = append(s.states, writeProvenanceState)
+	}
+
+	return nil
+}
+
+// statePrerequisite describes what a state needs from a previous one
+type statePrerequisite struct {
+	state    string
+	producer string
+	// relative to the image tree
+	artefact string
+}
+
+var statePrerequisites = []statePrerequisite{
+	{"write_manifest", "prepare_image", filepath.Join("var", "lib", "snapd", "seed", "seed.yaml")},
+	{"write_sbom", "prepare_image", filepath.Join("var", "lib", "snapd", "seed", "seed.yaml")},
+	{"write_provenance", "prepare_image", filepath.Join("var", "lib", "snapd", "seed", "seed.yaml")},
+	{"preseed_image", "prepare_image", filepath.Join("var", "lib", "snapd", "seed", "seed.yaml")},
+	{"post_preseed_hooks", "preseed_image", filepath.Join("var", "lib", "snapd", "state.json")},
+}
+
+// checkPrerequisites makes sure that the states running without the ones
+// they depend on, because of --skip or --only, find what they need in the
+// image tree
+func (classicStateMachine *ClassicStateMachine) checkPrerequisites() error {
+	stateNames := make([]string, 0, len(classicStateMachine.states))
+	for _, state := range classicStateMachine.states {
+		stateNames = append(stateNames, state.name)
+	}
+	for _, prerequisite := range statePrerequisites {
+		if !helper.SliceHasElement(stateNames, prerequisite.state) ||
+			helper.SliceHasElement(stateNames, prerequisite.producer) {
+			continue
+		}
+		if !osutil.FileExists(filepath.Join(classicStateMachine.Args.ImagePath, prerequisite.artefact)) {
+			return fmt.Errorf("State %s cannot run without %s: %s was not found in the image tree",
+				prerequisite.state, prerequisite.producer, prerequisite.artefact)
+		}
+	}
+	return nil
+}
+
+// validateCleanRootfsPatterns makes sure the additional patterns of files to
+// clean cannot match anything outside of the image tree
+func validateCleanRootfsPatterns(cleanRootfs *snaplist.CleanRootfs) error {
+	if cleanRootfs == nil {
+		return nil
+	}
+	patterns := append(append([]string{}, cleanRootfs.Delete...), cleanRootfs.Truncate...)
+	for _, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid clean-rootfs pattern \"%s\": %s", pattern, err.Error())
+		}
+		for _, element := range strings.Split(filepath.ToSlash(pattern), "/") {
+			if element == ".." {
+				return fmt.Errorf("Invalid clean-rootfs pattern \"%s\": \"..\" is not allowed", pattern)
+			}
+		}
+	}
 	return nil
 }
@@ -3,14 +3,12 @@ package statemachine
 import (
 	"context"
 	"fmt"
-	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
 
 	"github.com/snapcore/snapd/image"
-	"github.com/snapcore/snapd/image/preseed"
 	"github.com/snapcore/snapd/interfaces/builtin"
 	"github.com/snapcore/snapd/osutil"
 	"github.com/snapcore/snapd/seed/seedwriter"
@@ -63,17 +61,17 @@ func (stateMachine *StateMachine) prepareClassicImage() error {
 	// plug/slot sanitization needed by provider handling
 	snap.SanitizePlugsSlots = builtin.SanitizePlugsSlots
 
-	err = resetPreseeding(imageOpts, classicStateMachine.Args.ImagePath, stateMachine.commonFlags.Debug, stateMachine.commonFlags.Verbose)
+	err = resetPreseeding(stateMachine.ctx, imageOpts, classicStateMachine.Args.ImagePath, stateMachine.commonFlags.Debug)
 	if err != nil {
 		return err
 	}
 
-	err = ensureSnapBasesInstalled(imageOpts)
+	err = ensureSnapBasesInstalled(stateMachine.ctx, imageOpts)
 	if err != nil {
 		return err
 	}
 
-	err = addExtraSnaps(imageOpts, &classicStateMachine.ImageDef)
+	err = stateMachine.addExtraSnaps(imageOpts, &classicStateMachine.ImageDef)
 	if err != nil {
 		return err
 	}
@@ -84,32 +82,64 @@ func (stateMachine *StateMachine) prepareClassicImage() error {
 	imageOpts.Customizations = *new(image.Customizations)
 	imageOpts.Customizations.Validation = stateMachine.commonFlags.Validation
 
-	// image.Prepare automatically has some output that we only want for
-	// verbose or greater logging
-	if !stateMachine.commonFlags.Debug && !stateMachine.commonFlags.Verbose {
+	var watcher *snapWatcher
+	if stateMachine.events != nil {
 		oldImageStdout := image.Stdout
-		image.Stdout = io.Discard
 		defer func() {
 			image.Stdout = oldImageStdout
 		}()
+		watcher = &snapWatcher{out: image.Stdout, events: stateMachine.events, channels: imageOpts.SnapChannels}
+		image.Stdout = watcher
 	}
 
 	if err := imagePrepare(imageOpts); err != nil {
 		return fmt.Errorf("Error preparing image: %s", err.Error())
 	}
+	if watcher != nil {
+		watcher.finishDownload()
+	}
 
 	return nil
 }
 
+var writeManifestState = stateFunc{"write_manifest", (*StateMachine).writeManifest}
+
+// writeManifest writes the manifest of the snaps seeded by prepare_image
+func (stateMachine *StateMachine) writeManifest() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+	digests := classicStateMachine.seedDigests()
+	channels, err := getPreseededSnaps(classicStateMachine.Args.ImagePath, digests)
+	if err != nil {
+		return fmt.Errorf("Error reading the seed: %s", err.Error())
+	}
+	snapsDir := filepath.Join(classicStateMachine.Args.ImagePath, "var", "lib", "snapd", "seed", "snaps")
+	snapSHA3_384 := func(snapPath string) (string, error) {
+		snapDigests, err := digests.get(snapPath)
+		if err != nil {
+			return "", err
+		}
+		return snapDigests.assertionSHA3_384, nil
+	}
+	return WriteSnapManifest(snapsDir, classicStateMachine.ManifestPath, channels, classicStateMachine.ManifestFormat, snapSHA3_384)
+}
+
 // resetPreseeding checks if the rootfs is already preseeded and reset if necessary.
 // This can happen when building from a rootfs tarball
-func resetPreseeding(imageOpts *image.Options, chroot string, debug, verbose bool) error {
+func resetPreseeding(ctx context.Context, imageOpts *image.Options, chroot string, debug bool) (err error) {
 	if !osutil.FileExists(filepath.Join(chroot, "var", "lib", "snapd", "state.json")) {
 		return nil
 	}
+	restoreEmulation, err := setupEmulation(chroot)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = joinRestoreErr(err, restoreEmulation())
+	}()
+
 	// first get a list of all preseeded snaps
 	// seededSnaps maps the snap name and channel that was seeded
-	preseededSnaps, err := getPreseededSnaps(chroot)
+	preseededSnaps, err := getPreseededSnaps(chroot, nil)
 	if err != nil {
 		return fmt.Errorf("Error getting list of preseeded snaps from existing rootfs: %s",
 			err.Error())
@@ -123,19 +153,15 @@ func resetPreseeding(imageOpts *image.Options, chroot string, debug, verbose boo
 			imageOpts.SnapChannels[snap] = channel
 		}
 	}
-	// preseed.ClassicReset automatically has some output that we only want for
-	// verbose or greater logging
-	if !debug && !verbose {
-		oldPreseedStdout := preseed.Stdout
-		preseed.Stdout = io.Discard
-		defer func() {
-			preseed.Stdout = oldPreseedStdout
-		}()
-	}
 	// We need to use the snap-preseed binary for the reset as well, as using
 	// preseed.ClassicReset() might leave us in a chroot jail
 	cmd := execCommand(fmt.Sprintf("%s/usr/lib/snapd/snap-preseed", chroot), "--reset", chroot)
-	err = cmd.Run()
+	env, err := emulationEnv(chroot)
+	if err != nil {
+		return err
+	}
+	cmd.Env = append(os.Environ(), env...)
+	err = helper.RunCmdContext(ctx, cmd, debug)
 	if err != nil {
 		return fmt.Errorf("Error resetting preseeding in the chroot. Error is \"%s\"", err.Error())
 	}
@@ -146,13 +172,12 @@ func resetPreseeding(imageOpts *image.Options, chroot string, debug, verbose boo
 // ensureSnapBasesInstalled iterates through the list of snaps and ensure that all
 // of their bases are also set to be installed. Note we only do this for snaps that
 // are seeded. Users are expected to specify all base and content provider snaps
-// in the image definition.
-func ensureSnapBasesInstalled(imageOpts *image.Options) error {
+// in the image definition. The store requests are cancelled along with ctx.
+func ensureSnapBasesInstalled(ctx context.Context, imageOpts *image.Options) error {
 	snapStore := store.New(nil, nil)
-	snapContext := context.Background()
 	for _, seededSnap := range imageOpts.Snaps {
 		snapSpec := store.SnapSpec{Name: seededSnap}
-		snapInfo, err := snapStore.SnapInfo(snapContext, snapSpec, nil)
+		snapInfo, err := snapStore.SnapInfo(ctx, snapSpec, nil)
 		if err != nil {
 			return fmt.Errorf("Error getting info for snap %s: \"%s\"",
 				seededSnap, err.Error())
@@ -166,7 +191,7 @@ func ensureSnapBasesInstalled(imageOpts *image.Options) error {
 
 // addExtraSnaps adds any extra snaps from the image definition to the list
 // This should be done last to ensure the correct channels are being used
-func addExtraSnaps(imageOpts *image.Options, snapList *snaplist.SnapList) error {
+func (stateMachine *StateMachine) addExtraSnaps(imageOpts *image.Options, snapList *snaplist.SnapList) error {
 	imageOpts.SeedManifest = seedwriter.NewManifest()
 	for _, extraSnap := range snapList.Snaps {
 		if !helper.SliceHasElement(imageOpts.Snaps, extraSnap.SnapName) {
@@ -176,10 +201,10 @@ func addExtraSnaps(imageOpts *image.Options, snapList *snaplist.SnapList) error
 			imageOpts.SnapChannels[extraSnap.SnapName] = extraSnap.Channel
 		}
 		if extraSnap.SnapRevision != 0 {
-			fmt.Printf("WARNING: revision %d for snap %s may not be the latest available version!\n",
+			stateMachine.warn(fmt.Sprintf("revision %d for snap %s may not be the latest available version!",
 				extraSnap.SnapRevision,
 				extraSnap.SnapName,
-			)
+			))
 			err := imageOpts.SeedManifest.SetAllowedSnapRevision(extraSnap.SnapName, snap.R(extraSnap.SnapRevision))
 			if err != nil {
 				return fmt.Errorf("error dealing with the extra snap %s: %w", extraSnap.SnapName, err)
@@ -193,81 +218,19 @@ func addExtraSnaps(imageOpts *image.Options, snapList *snaplist.SnapList) error
 var preseedClassicImageState = stateFunc{"preseed_image", (*StateMachine).preseedClassicImage}
 
 // preseedClassicImage preseeds the snaps that have already been staged in the chroot
-func (stateMachine *StateMachine) preseedClassicImage() (err error) {
+func (stateMachine *StateMachine) preseedClassicImage() error {
 	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
 
-	// preseedCmds should be filled as a FIFO list
-	var preseedCmds []*exec.Cmd
-	// teardownCmds should be filled as a LIFO list to unmount first what was mounted last
-	var teardownCmds []*exec.Cmd
-
-	// set up the mount commands
-	mountPoints := []*mountPoint{
-		{
-			src:      "devtmpfs-build",
-			basePath: classicStateMachine.Args.ImagePath,
-			relpath:  "/dev",
-			typ:      "devtmpfs",
-		},
-		{
-			src:      "devpts-build",
-			basePath: classicStateMachine.Args.ImagePath,
-			relpath:  "/dev/pts",
-			typ:      "devpts",
-			opts:     []string{"nodev", "nosuid"},
-		},
-		{
-			src:      "proc-build",
-			basePath: classicStateMachine.Args.ImagePath,
-			relpath:  "/proc",
-			typ:      "proc",
-		},
-		{
-			src:      "none",
-			basePath: classicStateMachine.Args.ImagePath,
-			relpath:  "/sys/kernel/security",
-			typ:      "securityfs",
-		},
-		{
-			src:      "none",
-			basePath: classicStateMachine.Args.ImagePath,
-			relpath:  "/sys/fs/cgroup",
-			typ:      "cgroup2",
-		},
-	}
-
-	// Make sure we left the system as clean as possible if something has gone wrong
-	defer func() {
-		err = teardownMount(classicStateMachine.Args.ImagePath, mountPoints, teardownCmds, err, stateMachine.commonFlags.Debug)
-	}()
-
-	for _, mp := range mountPoints {
-		mountCmds, umountCmds, err := mp.getMountCmd()
-		if err != nil {
-			return fmt.Errorf("Error preparing mountpoint \"%s\": \"%s\"",
-				mp.relpath,
-				err.Error(),
-			)
-		}
-		preseedCmds = append(preseedCmds, mountCmds...)
-		teardownCmds = append(umountCmds, teardownCmds...)
-	}
-
-	teardownCmds = append([]*exec.Cmd{
-		execCommand("udevadm", "settle"),
-	}, teardownCmds...)
-
-	preseedCmds = append(preseedCmds,
-		//nolint:gosec,G204
-		exec.Command(fmt.Sprintf("%s/usr/lib/snapd/snap-preseed", classicStateMachine.Args.ImagePath), classicStateMachine.Args.ImagePath),
-	)
-
-	err = helper.RunCmds(preseedCmds, classicStateMachine.commonFlags.Debug)
+	preseedCmd := execCommand(fmt.Sprintf("%s/usr/lib/snapd/snap-preseed", classicStateMachine.Args.ImagePath), classicStateMachine.Args.ImagePath)
+	// snap-preseed is run from the host, not in the chroot. runInChroot runs
+	// all its commands in one shell, so the environment is given to it; the
+	// mount commands run along are native ones, unaffected by it.
+	env, err := emulationEnv(classicStateMachine.Args.ImagePath)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return classicStateMachine.runInChroot([]*exec.Cmd{preseedCmd}, env)
 }
 
 var setDefaultLocaleState = stateFunc{"set_default_locale", (*StateMachine).setDefaultLocale}
@@ -310,42 +273,62 @@ func (stateMachine *StateMachine) cleanRootfs() error {
 		filepath.Join(classicStateMachine.Args.ImagePath, "etc", "machine-id"),
 	}
 
-	toCleanFromPattern, err := listWithPatterns(classicStateMachine.Args.ImagePath,
-		[]string{
-			filepath.Join("etc", "ssh", "ssh_host_*_key.pub"),
-			filepath.Join("etc", "ssh", "ssh_host_*_key"),
-			filepath.Join("var", "cache", "debconf", "*-old"),
-			filepath.Join("var", "lib", "dpkg", "*-old"),
-			filepath.Join("dev", "*"),
-			filepath.Join("sys", "*"),
-			filepath.Join("run", "*"),
-		})
+	deletePatterns, truncatePatterns := classicStateMachine.cleanRootfsPatterns()
+
+	toCleanFromPattern, err := listWithPatterns(classicStateMachine.Args.ImagePath, deletePatterns)
 	if err != nil {
 		return err
 	}
 
 	toDelete = append(toDelete, toCleanFromPattern...)
 
-	err = doDeleteFiles(toDelete)
+	err = doDeleteFiles(classicStateMachine.Args.ImagePath, toDelete)
 	if err != nil {
 		return err
 	}
 
-	toTruncateFromPattern, err := listWithPatterns(classicStateMachine.Args.ImagePath,
-		[]string{
-			// udev persistent rules
-			filepath.Join("etc", "udev", "rules.d", "*persistent-net.rules"),
-		})
+	toTruncateFromPattern, err := listWithPatterns(classicStateMachine.Args.ImagePath, truncatePatterns)
 	if err != nil {
 		return err
 	}
 
 	toTruncate = append(toTruncate, toTruncateFromPattern...)
 
-	return doTruncateFiles(toTruncate)
+	return doTruncateFiles(classicStateMachine.Args.ImagePath, toTruncate)
+}
+
+// cleanRootfsPatterns returns the patterns of the files clean_rootfs deletes
+// and truncates, relative to the image tree
+func (classicStateMachine *ClassicStateMachine) cleanRootfsPatterns() (deletePatterns, truncatePatterns []string) {
+	deletePatterns = []string{
+		filepath.Join("etc", "ssh", "ssh_host_*_key.pub"),
+		filepath.Join("etc", "ssh", "ssh_host_*_key"),
+		filepath.Join("var", "cache", "debconf", "*-old"),
+		filepath.Join("var", "lib", "dpkg", "*-old"),
+		filepath.Join("dev", "*"),
+		filepath.Join("sys", "*"),
+		filepath.Join("run", "*"),
+	}
+	truncatePatterns = []string{
+		// udev persistent rules
+		filepath.Join("etc", "udev", "rules.d", "*persistent-net.rules"),
+	}
+	if classicStateMachine.ImageDef.CleanRootfs != nil {
+		deletePatterns = append(deletePatterns, classicStateMachine.ImageDef.CleanRootfs.Delete...)
+		truncatePatterns = append(truncatePatterns, classicStateMachine.ImageDef.CleanRootfs.Truncate...)
+	}
+	return deletePatterns, truncatePatterns
 }
 
+// listWithPatterns lists the files of the chroot matching the given patterns.
+// Matches reached through a symlink pointing outside of the chroot are
+// ignored. The matches themselves may still be symlinks, which are resolved
+// in the chroot when they are cleaned.
 func listWithPatterns(chroot string, patterns []string) ([]string, error) {
+	resolvedChroot, err := filepath.EvalSymlinks(chroot)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve path %s: %s", chroot, err.Error())
+	}
 	files := make([]string, 0)
 	for _, pattern := range patterns {
 		matches, err := filepath.Glob(filepath.Join(chroot, pattern))
@@ -353,15 +336,31 @@ func listWithPatterns(chroot string, patterns []string) ([]string, error) {
 			return nil, fmt.Errorf("unable to list files for pattern %s: %s", pattern, err.Error())
 		}
 
-		files = append(files, matches...)
+		for _, match := range matches {
+			parent, err := filepath.EvalSymlinks(filepath.Dir(match))
+			if err != nil || !isSubPath(parent, resolvedChroot) {
+				continue
+			}
+			files = append(files, match)
+		}
 	}
 	return files, nil
 }
 
-// doDeleteFiles deletes the given list of files
-func doDeleteFiles(toDelete []string) error {
+// doDeleteFiles deletes the given list of files of the chroot. Their parent
+// directories are resolved in the chroot, so that a symlink of the tree never
+// leads to a file of the host. Symlinks themselves are removed, not followed.
+func doDeleteFiles(chroot string, toDelete []string) error {
 	for _, f := range toDelete {
-		err := osRemoveAll(f)
+		relPath, err := filepathRel(chroot, f)
+		if err != nil {
+			return fmt.Errorf("Error removing %s: %s", f, err.Error())
+		}
+		path, err := resolveParentInTree(chroot, relPath)
+		if err != nil {
+			return fmt.Errorf("Error removing %s: %s", f, err.Error())
+		}
+		err = osRemoveAll(path)
 		if err != nil && !os.IsNotExist(err) {
 			return fmt.Errorf("Error removing %s: %s", f, err.Error())
 		}
@@ -369,10 +368,20 @@ func doDeleteFiles(toDelete []string) error {
 	return nil
 }
 
-// doTruncateFiles truncates content in the given list of files
-func doTruncateFiles(toTruncate []string) error {
+// doTruncateFiles truncates content in the given list of files of the chroot.
+// Truncating follows symlinks, so the files are resolved in the chroot first:
+// an absolute symlink of the tree must never empty a file of the host.
+func doTruncateFiles(chroot string, toTruncate []string) error {
 	for _, f := range toTruncate {
-		err := osTruncate(f, 0)
+		relPath, err := filepathRel(chroot, f)
+		if err != nil {
+			return fmt.Errorf("Error truncating %s: %s", f, err.Error())
+		}
+		resolved, err := helperResolveInRoot(chroot, relPath)
+		if err != nil {
+			return fmt.Errorf("Error truncating %s: %s", f, err.Error())
+		}
+		err = osTruncate(resolved, 0)
 		if err != nil && !os.IsNotExist(err) {
 			return fmt.Errorf("Error truncating %s: %s", f, err.Error())
 		}
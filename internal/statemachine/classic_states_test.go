@@ -0,0 +1,258 @@
+package statemachine
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"operese/cedar/internal/commands"
+	"operese/cedar/internal/helper"
+	"operese/cedar/internal/snaplist"
+)
+
+// mockExecCommand makes execCommand return commands keeping their arguments
+// but running true, so nothing is executed on the host
+func mockExecCommand(t *testing.T) {
+	t.Helper()
+	execCommand = func(name string, arg ...string) *exec.Cmd {
+		cmd := exec.Command("true")
+		cmd.Args = append([]string{name}, arg...)
+		return cmd
+	}
+	t.Cleanup(func() { execCommand = exec.Command })
+}
+
+// TestPreseedClassicImage tests that snap-preseed runs in a private mount
+// namespace, along with the mounts it needs, and with the environment
+// needed to run it from the host
+func TestPreseedClassicImage(t *testing.T) {
+	testCases := []struct {
+		name        string
+		foreignArch bool
+	}{
+		{"native", false},
+		{"foreign", true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			imagePath := t.TempDir()
+			preseedPath := filepath.Join(imagePath, "usr", "lib", "snapd", "snap-preseed")
+			treeArch := hostArchitecture()
+			if tc.foreignArch {
+				treeArch = "riscv64"
+				if hostArchitecture() == treeArch {
+					treeArch = "amd64"
+				}
+				// the interpreter of a handler with the F flag is not needed in the tree
+				binfmtDir := t.TempDir()
+				asserter.AssertErrNil(os.WriteFile(filepath.Join(binfmtDir, "qemu-"+debArchToQemuArch[treeArch]),
+					[]byte("enabled\ninterpreter /usr/libexec/qemu-binfmt/qemu\nflags: F\n"), 0644), true)
+				binfmtMiscDir = binfmtDir
+				t.Cleanup(func() { binfmtMiscDir = "/proc/sys/fs/binfmt_misc" })
+			}
+			writeDpkgStatus(t, imagePath, dpkgStatusEntry("dpkg", "1.22.6", treeArch, true))
+
+			mockExecCommand(t)
+			var nsCmd *exec.Cmd
+			helperRunCmdContext = func(ctx context.Context, cmd *exec.Cmd, debug bool) error {
+				nsCmd = cmd
+				return nil
+			}
+			t.Cleanup(func() { helperRunCmdContext = helper.RunCmdContext })
+
+			classicStateMachine := &ClassicStateMachine{
+				Args: commands.ClassicArgs{ImagePath: imagePath},
+			}
+			classicStateMachine.parent = classicStateMachine
+			classicStateMachine.commonFlags = &commands.CommonOpts{}
+			classicStateMachine.ctx = context.Background()
+
+			asserter.AssertErrNil(classicStateMachine.preseedClassicImage(), true)
+			if nsCmd == nil {
+				t.Fatal("snap-preseed was not run")
+			}
+			asserter.AssertEqual(uintptr(syscall.CLONE_NEWNS), nsCmd.SysProcAttr.Unshareflags&syscall.CLONE_NEWNS)
+
+			script := strings.Split(nsCmd.Args[2], "\n")
+			asserter.AssertEqual(shellJoin([]string{preseedPath, imagePath}), script[len(script)-1])
+			for _, line := range script[1 : len(script)-1] {
+				if !strings.HasPrefix(line, "'mount' ") {
+					t.Errorf("Unexpected command %s run before snap-preseed", line)
+				}
+			}
+
+			emulationEnv := "QEMU_LD_PREFIX=" + imagePath
+			asserter.AssertEqual(tc.foreignArch, helper.SliceHasElement(nsCmd.Env, emulationEnv))
+		})
+	}
+}
+
+// TestCalculateStatesOptIn tests that set_default_locale and clean_rootfs
+// only run when requested, from the command line or the snap list
+func TestCalculateStatesOptIn(t *testing.T) {
+	testCases := []struct {
+		name             string
+		setDefaultLocale bool
+		cleanRootfs      bool
+		snapList         snaplist.SnapList
+		expectedLocale   bool
+		expectedClean    bool
+	}{
+		{"default", false, false, snaplist.SnapList{SetDefaultLocale: helper.BoolPtr(false)}, false, false},
+		{"locale_flag", true, false, snaplist.SnapList{SetDefaultLocale: helper.BoolPtr(false)}, true, false},
+		{"locale_snap_list", false, false, snaplist.SnapList{SetDefaultLocale: helper.BoolPtr(true)}, true, false},
+		{"clean_flag", false, true, snaplist.SnapList{SetDefaultLocale: helper.BoolPtr(false)}, false, true},
+		{"clean_snap_list", false, false, snaplist.SnapList{
+			SetDefaultLocale: helper.BoolPtr(false),
+			CleanRootfs:      &snaplist.CleanRootfs{},
+		}, false, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			classicStateMachine := &ClassicStateMachine{
+				SetDefaultLocale: tc.setDefaultLocale,
+				CleanRootfs:      tc.cleanRootfs,
+				ImageDef:         tc.snapList,
+			}
+			classicStateMachine.parent = classicStateMachine
+			asserter.AssertErrNil(classicStateMachine.calculateStates(), true)
+
+			names := stateNames(&classicStateMachine.StateMachine)
+			asserter.AssertEqual(tc.expectedLocale, helper.SliceHasElement(names, "set_default_locale"))
+			asserter.AssertEqual(tc.expectedClean, helper.SliceHasElement(names, "clean_rootfs"))
+		})
+	}
+}
+
+// TestSetDefaultLocale tests that a locale is only set when none is configured
+func TestSetDefaultLocale(t *testing.T) {
+	defaultLocale := "# Default Ubuntu locale\nLANG=C.UTF-8\n"
+	testCases := []struct {
+		name     string
+		existing string
+		expected string
+	}{
+		{"missing", "", defaultLocale},
+		{"lang", "LANG=fr_FR.UTF-8\n", "LANG=fr_FR.UTF-8\n"},
+		{"lc_all", "LC_ALL=de_DE.UTF-8\n", "LC_ALL=de_DE.UTF-8\n"},
+		{"comment_only", "# LANG is not set\n", defaultLocale},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			imagePath := t.TempDir()
+			localePath := filepath.Join(imagePath, "etc", "default", "locale")
+			if tc.existing != "" {
+				writeTestTreeFile(t, imagePath, filepath.Join("etc", "default", "locale"), tc.existing)
+			}
+			classicStateMachine := &ClassicStateMachine{Args: commands.ClassicArgs{ImagePath: imagePath}}
+			classicStateMachine.parent = classicStateMachine
+
+			asserter.AssertErrNil(classicStateMachine.setDefaultLocale(), true)
+			content, err := os.ReadFile(localePath)
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.expected, string(content))
+		})
+	}
+}
+
+// TestValidateCleanRootfsPatterns tests that the patterns cannot leave the image tree
+func TestValidateCleanRootfsPatterns(t *testing.T) {
+	testCases := []struct {
+		name        string
+		cleanRootfs *snaplist.CleanRootfs
+		expectedErr string
+	}{
+		{"none", nil, ""},
+		{"valid", &snaplist.CleanRootfs{Delete: []string{"var/log/*.log"}, Truncate: []string{"etc/hostname"}}, ""},
+		{"parent_delete", &snaplist.CleanRootfs{Delete: []string{"var/../../etc/*"}}, "\"..\" is not allowed"},
+		{"parent_truncate", &snaplist.CleanRootfs{Truncate: []string{"../etc/hostname"}}, "\"..\" is not allowed"},
+		{"malformed", &snaplist.CleanRootfs{Delete: []string{"var/log/[a-"}}, "Invalid clean-rootfs pattern"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			err := validateCleanRootfsPatterns(tc.cleanRootfs)
+			if tc.expectedErr != "" {
+				asserter.AssertErrContains(err, tc.expectedErr)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+		})
+	}
+}
+
+// TestCleanRootfs tests that secrets and generated values are cleaned from
+// the image tree, and that symlinks of the tree never lead to the host
+func TestCleanRootfs(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	imagePath := t.TempDir()
+	hostDir := t.TempDir()
+
+	// files of the host the symlinks of the tree point to
+	for _, name := range []string{"70-persistent-net.rules", "syslog.log", "secret"} {
+		asserter.AssertErrNil(os.WriteFile(filepath.Join(hostDir, name), []byte("host"), 0644), true)
+	}
+	asserter.AssertErrNil(os.MkdirAll(filepath.Join(hostDir, "dbus"), 0755), true)
+	asserter.AssertErrNil(os.WriteFile(filepath.Join(hostDir, "dbus", "machine-id"), []byte("host"), 0644), true)
+
+	for _, file := range []string{
+		"etc/ssh/ssh_host_rsa_key",
+		"etc/ssh/ssh_host_rsa_key.pub",
+		"etc/machine-id-real",
+		"var/log/dpkg.log",
+		"var/cache/app/data",
+		"run/lock",
+	} {
+		writeTestTreeFile(t, imagePath, file, "tree")
+	}
+	symlinks := map[string]string{
+		// absolute symlinks are resolved in the tree
+		"etc/machine-id": "/etc/machine-id-real",
+		"etc/udev/rules.d/70-persistent-net.rules": filepath.Join(hostDir, "70-persistent-net.rules"),
+		"var/log/syslog.log":                       filepath.Join(hostDir, "syslog.log"),
+		"var/cache/app/secret":                     filepath.Join(hostDir, "secret"),
+		"var/lib/dbus":                             filepath.Join(hostDir, "dbus"),
+	}
+	for link, target := range symlinks {
+		path := filepath.Join(imagePath, link)
+		asserter.AssertErrNil(os.MkdirAll(filepath.Dir(path), 0755), true)
+		asserter.AssertErrNil(os.Symlink(target, path), true)
+	}
+
+	classicStateMachine := &ClassicStateMachine{
+		Args: commands.ClassicArgs{ImagePath: imagePath},
+		ImageDef: snaplist.SnapList{CleanRootfs: &snaplist.CleanRootfs{
+			Delete:   []string{"var/cache/app/*"},
+			Truncate: []string{"var/log/*.log"},
+		}},
+	}
+	classicStateMachine.parent = classicStateMachine
+	asserter.AssertErrNil(classicStateMachine.cleanRootfs(), true)
+
+	for _, removed := range []string{"etc/ssh/ssh_host_rsa_key", "etc/ssh/ssh_host_rsa_key.pub",
+		"var/cache/app/data", "var/cache/app/secret", "run/lock"} {
+		if _, err := os.Lstat(filepath.Join(imagePath, removed)); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed from the image tree", removed)
+		}
+	}
+	for file, expected := range map[string]string{
+		"etc/machine-id-real": "",
+		"var/log/dpkg.log":    "",
+	} {
+		content, err := os.ReadFile(filepath.Join(imagePath, file))
+		asserter.AssertErrNil(err, true)
+		asserter.AssertEqual(expected, string(content))
+	}
+	for _, name := range []string{"70-persistent-net.rules", "syslog.log", "secret", "dbus/machine-id"} {
+		content, err := os.ReadFile(filepath.Join(hostDir, name))
+		asserter.AssertErrNil(err, true)
+		asserter.AssertEqual("host", string(content))
+	}
+}
@@ -0,0 +1,205 @@
+package statemachine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/snapcore/snapd/osutil"
+
+	"operese/cedar/internal/helper"
+)
+
+// interpreterRecordSuffix names the file, next to the image tree, recording
+// the qemu interpreter copied into the tree for emulation
+const interpreterRecordSuffix = ".cedar-interpreter"
+
+// sideFilePath returns the path of a file cedar keeps next to the image tree
+// rather than in it, named after the resolved path of the tree
+func sideFilePath(imagePath string, suffix string) (string, error) {
+	absPath, err := filepath.Abs(imagePath)
+	if err != nil {
+		return "", fmt.Errorf("Error getting absolute path of \"%s\": %s", imagePath, err.Error())
+	}
+	resolvedPath, err := filepath.EvalSymlinks(absPath)
+	if err != nil {
+		return "", fmt.Errorf("Error resolving image path: %s", err.Error())
+	}
+	return resolvedPath + suffix, nil
+}
+
+// Cleanup recovers an image tree left behind by a cedar run that did not
+// complete its teardown, for example because it crashed or was killed.
+// It returns a description of every fix that was applied.
+func Cleanup(imagePath string, debug bool) (fixed []string, err error) {
+	imagePath, err = filepath.Abs(imagePath)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting absolute path of \"%s\": %s", imagePath, err.Error())
+	}
+	imagePath, err = filepath.EvalSymlinks(imagePath)
+	if err != nil {
+		return nil, fmt.Errorf("Error resolving image path: %s", err.Error())
+	}
+
+	// hold the lock while cleaning up so no build can start meanwhile.
+	// A lock file that can be taken was left behind by a dead process.
+	lockPath := imagePath + lockFileSuffix
+	staleLock := osutil.FileExists(lockPath)
+	lockFile, err := tryLockFile(lockPath)
+	if errors.Is(err, errTreeLocked) {
+		return nil, fmt.Errorf("Image tree %s is used by a running cedar process (PID %s), refusing to clean it up",
+			imagePath, lockHolder(lockPath))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		lockErr := releaseLockFile(lockFile)
+		if lockErr != nil && err == nil {
+			err = lockErr
+		}
+		if lockErr == nil && err == nil && staleLock {
+			fixed = append(fixed, "removed stale lock file "+lockPath)
+		}
+	}()
+
+	unmounted, err := cleanupMounts(imagePath, debug)
+	fixed = append(fixed, unmounted...)
+	if err != nil {
+		return fixed, err
+	}
+
+	// only touch files once nothing is mounted in the tree anymore
+	if osutil.FileExists(filepath.Join(imagePath, "etc", "resolv.conf.tmp")) {
+		if err := helperRestoreResolvConf(imagePath); err != nil {
+			return fixed, err
+		}
+		fixed = append(fixed, "restored etc/resolv.conf")
+	}
+
+	restored, err := cleanupBackups(imagePath)
+	fixed = append(fixed, restored...)
+	if err != nil {
+		return fixed, err
+	}
+
+	// a policy-rc.d created from scratch by cedar has no backup to restore
+	policyRcDPath, err := resolveParentInTree(imagePath, policyRcDRelPath)
+	if err != nil {
+		return fixed, err
+	}
+	if content, err := osReadFile(policyRcDPath); err == nil && string(content) == policyRcD {
+		if err := osRemove(policyRcDPath); err != nil {
+			return fixed, fmt.Errorf("Error removing %s: %s", policyRcDPath, err.Error())
+		}
+		fixed = append(fixed, "removed "+policyRcDRelPath)
+	}
+
+	removed, err := cleanupInterpreter(imagePath)
+	if err != nil {
+		return fixed, err
+	}
+	if removed != "" {
+		fixed = append(fixed, "removed qemu interpreter "+removed)
+	}
+
+	if osutil.IsDirectory(filepath.Join(imagePath, debsDirInChroot)) {
+		if err := osRemoveAll(filepath.Join(imagePath, debsDirInChroot)); err != nil {
+			return fixed, fmt.Errorf("Error removing %s: %s", debsDirInChroot, err.Error())
+		}
+		fixed = append(fixed, "removed "+debsDirInChroot)
+	}
+
+	return fixed, nil
+}
+
+// sortMountsDeepestFirst orders mounts so submounts come before their
+// parents, keeping the reverse mount order of the ones at the same depth
+func sortMountsDeepestFirst(mounts []*mountPoint) {
+	sort.SliceStable(mounts, func(i, j int) bool {
+		return strings.Count(filepath.Clean(mounts[i].path), "/") > strings.Count(filepath.Clean(mounts[j].path), "/")
+	})
+}
+
+// cleanupMounts unmounts everything mounted in the image tree, deepest
+// first. The unmounts are recursive so mounts that appeared under a
+// mountpoint since it was listed, e.g. in proc, do not make them fail.
+func cleanupMounts(imagePath string, debug bool) (unmounted []string, err error) {
+	mounts, err := listMounts(imagePath)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing mountpoints: %s", err.Error())
+	}
+	sortMountsDeepestFirst(mounts)
+
+	for _, m := range mounts {
+		umountCmd := execCommand("umount", "--recursive", m.path)
+		if err := helper.RunCmd(umountCmd, debug); err != nil {
+			return unmounted, err
+		}
+		unmounted = append(unmounted, fmt.Sprintf("unmounted %s (%s)", m.path, m.typ))
+	}
+
+	return unmounted, nil
+}
+
+// backedUpRelPaths are the files of the image tree a build replaces with
+// helper.BackupReplace. Only their backups are restored, files of the tree
+// that happen to have the same suffix are left alone.
+var backedUpRelPaths = []string{policyRcDRelPath}
+
+// cleanupBackups restores the files replaced with helper.BackupReplace that
+// still have a backup in the image tree
+func cleanupBackups(imagePath string) (restored []string, err error) {
+	for _, relPath := range backedUpRelPaths {
+		target, err := resolveParentInTree(imagePath, relPath)
+		if err != nil {
+			return restored, fmt.Errorf("Error restoring backups: %s", err.Error())
+		}
+		if !osutil.FileExists(helper.BackupPath(target)) {
+			continue
+		}
+		if err := helperRestoreBackup(target); err != nil {
+			return restored, fmt.Errorf("Error restoring backups: %s", err.Error())
+		}
+		restored = append(restored, fmt.Sprintf("restored %s from its backup", relPath))
+	}
+	return restored, nil
+}
+
+// cleanupInterpreter removes the qemu interpreter, and the directories
+// created for it, recorded next to the image tree by copyInterpreter. It
+// returns the removed path, relative to the tree.
+func cleanupInterpreter(imagePath string) (removed string, err error) {
+	recordPath, err := sideFilePath(imagePath, interpreterRecordSuffix)
+	if err != nil {
+		return "", err
+	}
+	content, err := osReadFile(recordPath)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("Error reading %s: %s", recordPath, err.Error())
+	}
+
+	relPath := strings.TrimSpace(string(content))
+	if relPath != "" {
+		if !filepath.IsLocal(relPath) {
+			return "", fmt.Errorf("Invalid qemu interpreter path \"%s\" recorded in %s", relPath, recordPath)
+		}
+		interpreterPath, err := resolveParentInTree(imagePath, relPath)
+		if err != nil {
+			return "", err
+		}
+		if err := osRemoveAll(interpreterPath); err != nil {
+			return "", fmt.Errorf("Error removing qemu interpreter from the image tree: %s", err.Error())
+		}
+	}
+	if err := osRemove(recordPath); err != nil {
+		return "", fmt.Errorf("Error removing %s: %s", recordPath, err.Error())
+	}
+	return relPath, nil
+}
@@ -0,0 +1,106 @@
+package statemachine
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/snapcore/snapd/osutil"
+
+	"operese/cedar/internal/helper"
+)
+
+// TestSortMountsDeepestFirst tests that submounts are unmounted before their parents
+func TestSortMountsDeepestFirst(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	mounts := []*mountPoint{
+		{path: "/tree/proc"},
+		{path: "/tree/dev/pts"},
+		{path: "/tree/dev"},
+		{path: "/tree/proc/sys/fs/binfmt_misc"},
+		{path: "/tree/sys"},
+	}
+	sortMountsDeepestFirst(mounts)
+
+	paths := make([]string, 0, len(mounts))
+	for _, m := range mounts {
+		paths = append(paths, m.path)
+	}
+	asserter.AssertEqual([]string{
+		"/tree/proc/sys/fs/binfmt_misc",
+		"/tree/dev/pts",
+		"/tree/proc",
+		"/tree/dev",
+		"/tree/sys",
+	}, paths)
+}
+
+// TestCleanupBackups tests that only the backups made by a build are restored
+func TestCleanupBackups(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	imagePath := t.TempDir()
+	policyRcDPath := filepath.Join(imagePath, policyRcDRelPath)
+	asserter.AssertErrNil(os.MkdirAll(filepath.Dir(policyRcDPath), 0755), true)
+	asserter.AssertErrNil(os.WriteFile(policyRcDPath, []byte(policyRcD), 0755), true)
+	asserter.AssertErrNil(os.WriteFile(helper.BackupPath(policyRcDPath), []byte("original"), 0755), true)
+	// a file of the tree that only shares the suffix of the backups
+	unrelated := filepath.Join(imagePath, "etc", "config.REAL")
+	asserter.AssertErrNil(os.MkdirAll(filepath.Dir(unrelated), 0755), true)
+	asserter.AssertErrNil(os.WriteFile(unrelated, []byte("unrelated"), 0644), true)
+
+	restored, err := cleanupBackups(imagePath)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual([]string{"restored " + policyRcDRelPath + " from its backup"}, restored)
+
+	content, err := os.ReadFile(policyRcDPath)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("original", string(content))
+	if !osutil.FileExists(unrelated) {
+		t.Errorf("%s was restored over its base name", unrelated)
+	}
+
+	// nothing left to restore
+	restored, err = cleanupBackups(imagePath)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(0, len(restored))
+}
+
+// TestCleanupInterpreter tests that the qemu interpreter left behind by a
+// crashed build is removed from the image tree
+func TestCleanupInterpreter(t *testing.T) {
+	testCases := []struct {
+		name        string
+		record      string
+		expected    string
+		expectedErr string
+	}{
+		{"no_record", "", "", ""},
+		{"interpreter", "usr/libexec\n", "usr/libexec", ""},
+		{"escape", "../host\n", "", "Invalid qemu interpreter path"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			imagePath := filepath.Join(t.TempDir(), "tree")
+			interpreter := filepath.Join(imagePath, "usr", "libexec", "qemu-binfmt", "aarch64-binfmt-P")
+			asserter.AssertErrNil(os.MkdirAll(filepath.Dir(interpreter), 0755), true)
+			asserter.AssertErrNil(os.WriteFile(interpreter, []byte("qemu"), 0755), true)
+			if tc.record != "" {
+				err := os.WriteFile(imagePath+interpreterRecordSuffix, []byte(tc.record), 0644)
+				asserter.AssertErrNil(err, true)
+			}
+
+			removed, err := cleanupInterpreter(imagePath)
+			if tc.expectedErr != "" {
+				asserter.AssertErrContains(err, tc.expectedErr)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.expected, removed)
+			asserter.AssertEqual(tc.expected == "", osutil.FileExists(interpreter))
+			if osutil.FileExists(imagePath + interpreterRecordSuffix) {
+				t.Errorf("the record of the interpreter was not removed")
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/snapcore/snapd/gadget/quantity"
+	"github.com/snapcore/snapd/osutil"
+
+	"operese/cedar/internal/logger"
+)
+
+// number of contributors listed when a size budget is exceeded
+const diskUsageContributors = 5
+
+// loadMaxSeedSize parses the size budget given with --max-seed-size, which
+// takes precedence over max-seed-size in the snap list
+func (classicStateMachine *ClassicStateMachine) loadMaxSeedSize() error {
+	value := classicStateMachine.MaxSeedSize
+	if value == "" {
+		value = classicStateMachine.ImageDef.MaxSeedSize
+	}
+	if value == "" {
+		return nil
+	}
+	size, err := quantity.ParseSize(value)
+	if err != nil {
+		return fmt.Errorf("Invalid max-seed-size \"%s\": %s", value, err.Error())
+	}
+	classicStateMachine.maxSeedSize = size
+	return nil
+}
+
+// diskUsageSnapshot is the disk usage of the image tree at a point of the build
+type diskUsageSnapshot struct {
+	tree quantity.Size
+	seed quantity.Size
+	// the snap files of the seed, by snap name
+	snaps map[string]quantity.Size
+}
+
+// measureDiskUsage measures the disk usage of the image tree, its seed and
+// each of the snaps of the seed
+func measureDiskUsage(imagePath string) (*diskUsageSnapshot, error) {
+	snapshot := &diskUsageSnapshot{snaps: make(map[string]quantity.Size)}
+	var err error
+	snapshot.tree, err = helperDu(imagePath)
+	if err != nil {
+		return nil, fmt.Errorf("Error measuring the disk usage of the image tree: %s", err.Error())
+	}
+
+	seedDir := filepath.Join(imagePath, "var", "lib", "snapd", "seed")
+	if !osutil.IsDirectory(seedDir) {
+		return snapshot, nil
+	}
+	snapshot.seed, err = helperDu(seedDir)
+	if err != nil {
+		return nil, fmt.Errorf("Error measuring the disk usage of the seed: %s", err.Error())
+	}
+
+	snapsDir := filepath.Join(seedDir, "snaps")
+	entries, err := osReadDir(snapsDir)
+	if os.IsNotExist(err) {
+		return snapshot, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the snaps of the seed: %s", err.Error())
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !strings.HasSuffix(entry.Name(), ".snap") {
+			continue
+		}
+		size, err := helperDu(filepath.Join(snapsDir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("Error measuring the disk usage of snap %s: %s", entry.Name(), err.Error())
+		}
+		snapshot.snaps[seedSnapFileName(entry.Name())] += size
+	}
+	return snapshot, nil
+}
+
+// seedSnapFileName returns the name of the snap of a <name>_<revision>.snap
+// file of the seed
+func seedSnapFileName(fileName string) string {
+	name := strings.TrimSuffix(fileName, ".snap")
+	if i := strings.LastIndex(name, "_"); i > 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// DiskUsage is the disk usage of the image tree before and after the build,
+// in bytes
+type DiskUsage struct {
+	TreeBefore uint64 `json:"tree-before"`
+	TreeAfter  uint64 `json:"tree-after"`
+	TreeGrowth int64  `json:"tree-growth"`
+	SeedSize   uint64 `json:"seed-size"`
+	SeedGrowth int64  `json:"seed-growth"`
+	// MaxSeedSize is the budget of the seed size and of the tree growth
+	MaxSeedSize uint64 `json:"max-seed-size,omitempty"`
+	// Partial is set when the first state of the build did not run, so the
+	// growths only cover this run and the tree growth is not checked
+	Partial bool `json:"partial,omitempty"`
+	// Snaps lists the snaps of the seed, and the ones removed from it,
+	// largest growth first
+	Snaps []SnapDiskUsage `json:"snaps"`
+}
+
+// SnapDiskUsage is the disk usage of a snap of the seed after the build and
+// its change
+type SnapDiskUsage struct {
+	Name  string `json:"name"`
+	Size  uint64 `json:"size"`
+	Delta int64  `json:"delta"`
+}
+
+// diskUsageDelta compares the disk usage of the image tree before and after the build
+func diskUsageDelta(before, after *diskUsageSnapshot) *DiskUsage {
+	usage := &DiskUsage{
+		TreeBefore: uint64(before.tree),
+		TreeAfter:  uint64(after.tree),
+		TreeGrowth: int64(after.tree) - int64(before.tree),
+		SeedSize:   uint64(after.seed),
+		SeedGrowth: int64(after.seed) - int64(before.seed),
+		Snaps:      make([]SnapDiskUsage, 0),
+	}
+	for name, size := range after.snaps {
+		usage.Snaps = append(usage.Snaps, SnapDiskUsage{Name: name, Size: uint64(size), Delta: int64(size) - int64(before.snaps[name])})
+	}
+	for name, size := range before.snaps {
+		if _, found := after.snaps[name]; !found {
+			usage.Snaps = append(usage.Snaps, SnapDiskUsage{Name: name, Delta: -int64(size)})
+		}
+	}
+	sort.Slice(usage.Snaps, func(i, j int) bool {
+		if usage.Snaps[i].Delta != usage.Snaps[j].Delta {
+			return usage.Snaps[i].Delta > usage.Snaps[j].Delta
+		}
+		return usage.Snaps[i].Name < usage.Snaps[j].Name
+	})
+	return usage
+}
+
+// formatSizeDelta formats a signed number of bytes with IEC units
+func formatSizeDelta(delta int64) string {
+	if delta < 0 {
+		return "-" + quantity.Size(-delta).IECString()
+	}
+	return "+" + quantity.Size(delta).IECString()
+}
+
+// largestSnaps lists the largest snaps of the seed
+func (usage *DiskUsage) largestSnaps() string {
+	snaps := make([]SnapDiskUsage, 0, len(usage.Snaps))
+	for _, snapUsage := range usage.Snaps {
+		if snapUsage.Size > 0 {
+			snaps = append(snaps, snapUsage)
+		}
+	}
+	sort.SliceStable(snaps, func(i, j int) bool { return snaps[i].Size > snaps[j].Size })
+	if len(snaps) > diskUsageContributors {
+		snaps = snaps[:diskUsageContributors]
+	}
+
+	descriptions := make([]string, 0, len(snaps))
+	for _, snapUsage := range snaps {
+		descriptions = append(descriptions, fmt.Sprintf("%s (%s)", snapUsage.Name, quantity.Size(snapUsage.Size).IECString()))
+	}
+	return strings.Join(descriptions, ", ")
+}
+
+// largestGrowths lists the snaps that grew the most and what grew outside
+// of the seed
+func (usage *DiskUsage) largestGrowths() string {
+	growths := make([]SnapDiskUsage, 0, len(usage.Snaps)+1)
+	for _, snapUsage := range usage.Snaps {
+		if snapUsage.Delta > 0 {
+			growths = append(growths, snapUsage)
+		}
+	}
+	if outsideSeed := usage.TreeGrowth - usage.SeedGrowth; outsideSeed > 0 {
+		growths = append(growths, SnapDiskUsage{Name: "files outside of the seed", Delta: outsideSeed})
+	}
+	sort.SliceStable(growths, func(i, j int) bool { return growths[i].Delta > growths[j].Delta })
+	if len(growths) > diskUsageContributors {
+		growths = growths[:diskUsageContributors]
+	}
+
+	descriptions := make([]string, 0, len(growths))
+	for _, growth := range growths {
+		descriptions = append(descriptions, fmt.Sprintf("%s (%s)", growth.Name, formatSizeDelta(growth.Delta)))
+	}
+	return strings.Join(descriptions, ", ")
+}
+
+var checkDiskUsageState = stateFunc{"check_disk_usage", (*StateMachine).checkDiskUsage}
+
+// checkDiskUsage reports how much the build grew the image tree and its
+// seed, and fails if the growth exceeds max-seed-size
+func (stateMachine *StateMachine) checkDiskUsage() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+	if classicStateMachine.diskUsageBefore == nil {
+		// the state ran without the measure of the tree Run makes first
+		return nil
+	}
+	after, err := measureDiskUsage(classicStateMachine.Args.ImagePath)
+	if err != nil {
+		return err
+	}
+	usage := diskUsageDelta(classicStateMachine.diskUsageBefore, after)
+	usage.MaxSeedSize = uint64(classicStateMachine.maxSeedSize)
+	usage.Partial = classicStateMachine.partialRun
+	classicStateMachine.diskUsage = usage
+
+	growthScope := ""
+	if usage.Partial {
+		growthScope = " in this run"
+	}
+	logger.Infof("The image tree grew by %s%s to %s, the seed is %s",
+		formatSizeDelta(usage.TreeGrowth), growthScope, quantity.Size(usage.TreeAfter).IECString(),
+		quantity.Size(usage.SeedSize).IECString())
+	for _, snapUsage := range usage.Snaps {
+		logger.Verbosef("  %s: %s (%s)", snapUsage.Name,
+			quantity.Size(snapUsage.Size).IECString(), formatSizeDelta(snapUsage.Delta))
+	}
+
+	if classicStateMachine.maxSeedSize == 0 {
+		return nil
+	}
+	budget := classicStateMachine.maxSeedSize.IECString()
+	exceeded := make([]string, 0, 2)
+	if usage.SeedSize > usage.MaxSeedSize {
+		exceeded = append(exceeded, fmt.Sprintf("the seed is %s (largest contributors: %s)",
+			quantity.Size(usage.SeedSize).IECString(), usage.largestSnaps()))
+	}
+	if usage.Partial {
+		logger.Infof("The growth of the image tree is not checked against max-seed-size, as " +
+			"--skip or --only left out the first state and the tree may contain what an earlier run added")
+	} else if usage.TreeGrowth > 0 && uint64(usage.TreeGrowth) > usage.MaxSeedSize {
+		exceeded = append(exceeded, fmt.Sprintf("the image tree grew by %s (largest contributors: %s)",
+			quantity.Size(usage.TreeGrowth).IECString(), usage.largestGrowths()))
+	}
+	if len(exceeded) > 0 {
+		return fmt.Errorf("The max-seed-size budget of %s is exceeded: %s", budget, strings.Join(exceeded, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package statemachine
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/snapcore/snapd/gadget/quantity"
+
+	"operese/cedar/internal/helper"
+)
+
+// TestSeedSnapFileName tests reading the snap name of the files of the seed
+func TestSeedSnapFileName(t *testing.T) {
+	testCases := []struct {
+		fileName string
+		expected string
+	}{
+		{"hello_42.snap", "hello"},
+		{"snap_store_1113.snap", "snap_store"},
+		{"local.snap", "local"},
+		{"_1.snap", "_1"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.fileName, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			asserter.AssertEqual(tc.expected, seedSnapFileName(tc.fileName))
+		})
+	}
+}
+
+// testDiskUsage is the disk usage of a build that added firefox and core22,
+// grew lxd and removed hello
+var testDiskUsage = &DiskUsage{
+	TreeBefore: 1000,
+	TreeAfter:  1900,
+	TreeGrowth: 900,
+	SeedSize:   700,
+	SeedGrowth: 600,
+	Snaps: []SnapDiskUsage{
+		{Name: "firefox", Size: 400, Delta: 400},
+		{Name: "core22", Size: 150, Delta: 150},
+		{Name: "lxd", Size: 150, Delta: 100},
+		{Name: "hello", Delta: -50},
+	},
+}
+
+// TestDiskUsageDelta tests the comparison of the disk usage before and after the build
+func TestDiskUsageDelta(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	before := &diskUsageSnapshot{
+		tree:  1000,
+		seed:  100,
+		snaps: map[string]quantity.Size{"lxd": 50, "hello": 50},
+	}
+	after := &diskUsageSnapshot{
+		tree:  1900,
+		seed:  700,
+		snaps: map[string]quantity.Size{"lxd": 150, "firefox": 400, "core22": 150},
+	}
+	asserter.AssertEqual(testDiskUsage, diskUsageDelta(before, after))
+
+	// a tree without seed
+	asserter.AssertEqual(&DiskUsage{TreeBefore: 10, TreeAfter: 5, TreeGrowth: -5, Snaps: []SnapDiskUsage{}},
+		diskUsageDelta(&diskUsageSnapshot{tree: 10}, &diskUsageSnapshot{tree: 5}))
+}
+
+// TestLargestContributors tests the lists of the largest snaps and growths
+// given when the budget is exceeded
+func TestLargestContributors(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	asserter.AssertEqual("firefox (400 B), core22 (150 B), lxd (150 B)", testDiskUsage.largestSnaps())
+	asserter.AssertEqual("firefox (+400 B), files outside of the seed (+300 B), core22 (+150 B), lxd (+100 B)",
+		testDiskUsage.largestGrowths())
+
+	many := &DiskUsage{}
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		many.Snaps = append(many.Snaps, SnapDiskUsage{Name: name, Size: 10, Delta: 10})
+	}
+	asserter.AssertEqual("a (10 B), b (10 B), c (10 B), d (10 B), e (10 B)", many.largestSnaps())
+	asserter.AssertEqual("a (+10 B), b (+10 B), c (+10 B), d (+10 B), e (+10 B)", many.largestGrowths())
+}
+
+// TestCheckDiskUsage tests the max-seed-size budget, which is not applied to
+// the growth of the tree in runs that left out the first state
+func TestCheckDiskUsage(t *testing.T) {
+	imagePath := t.TempDir()
+	snapsDir := filepath.Join(imagePath, "var", "lib", "snapd", "seed", "snaps")
+	if err := os.MkdirAll(snapsDir, 0755); err != nil {
+		t.Fatalf("Error creating the seed: %s", err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(snapsDir, "firefox_1.snap"), nil, 0644); err != nil {
+		t.Fatalf("Error creating a snap: %s", err.Error())
+	}
+	sizes := map[string]quantity.Size{
+		imagePath:              3000,
+		filepath.Dir(snapsDir): 600,
+		filepath.Join(snapsDir, "firefox_1.snap"): 600,
+	}
+	helperDu = func(path string) (quantity.Size, error) {
+		return sizes[path], nil
+	}
+	t.Cleanup(func() {
+		helperDu = helper.Du
+	})
+
+	testCases := []struct {
+		name        string
+		maxSeedSize quantity.Size
+		partialRun  bool
+		expectedErr string
+	}{
+		{"no_budget", 0, false, ""},
+		{"within_budget", 5000, false, ""},
+		{"tree_growth", 1000, false, "The max-seed-size budget of 1000 B is exceeded: the image tree grew by 1.95 KiB (largest contributors: files outside of the seed (+1.37 KiB), firefox (+600 B))"},
+		{"seed_size", 500, false, "the seed is 600 B (largest contributors: firefox (600 B)); the image tree grew by 1.95 KiB"},
+		{"partial_tree_growth", 1000, true, ""},
+		{"partial_seed_size", 500, true, "The max-seed-size budget of 500 B is exceeded: the seed is 600 B (largest contributors: firefox (600 B))"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine ClassicStateMachine
+			stateMachine.parent = &stateMachine
+			stateMachine.Args.ImagePath = imagePath
+			stateMachine.maxSeedSize = tc.maxSeedSize
+			stateMachine.partialRun = tc.partialRun
+			stateMachine.diskUsageBefore = &diskUsageSnapshot{tree: 1000, snaps: map[string]quantity.Size{}}
+
+			err := stateMachine.checkDiskUsage()
+			if tc.expectedErr != "" {
+				asserter.AssertErrContains(err, tc.expectedErr)
+			} else {
+				asserter.AssertErrNil(err, true)
+			}
+			asserter.AssertEqual(tc.partialRun, stateMachine.diskUsage.Partial)
+			asserter.AssertEqual(int64(2000), stateMachine.diskUsage.TreeGrowth)
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package statemachine
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/snapcore/snapd/gadget/quantity"
+	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/store"
+)
+
+// CheckStatus is the outcome of a host prerequisite check
+type CheckStatus string
+
+const (
+	CheckPass CheckStatus = "pass"
+	CheckWarn CheckStatus = "warn"
+	CheckFail CheckStatus = "fail"
+)
+
+// CheckResult holds the outcome of a host prerequisite check
+type CheckResult struct {
+	Name    string
+	Status  CheckStatus
+	Message string
+}
+
+// DoctorOptions describes the build the host prerequisites are checked for
+type DoctorOptions struct {
+	// ImagePath is the image tree to check, can be empty
+	ImagePath string
+	Preseed   bool
+	Rootless  bool
+}
+
+// hostCheck is a single prerequisite check
+type hostCheck struct {
+	name  string
+	check func(opts DoctorOptions) (CheckStatus, string)
+}
+
+// define some functions and variables that can be mocked by test cases
+var syscallStatfs = syscall.Statfs
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+var osGeteuid = os.Geteuid
+var execCmdCombinedOutput = (*exec.Cmd).CombinedOutput
+
+// cgroupControllersPath only exists with the unified cgroup v2 hierarchy
+var cgroupControllersPath = "/sys/fs/cgroup/cgroup.controllers"
+
+const (
+	// capSysAdmin is the bit of CAP_SYS_ADMIN in capability sets
+	capSysAdmin = 21
+	// minimum free space in the image tree before failing or warning
+	minFreeSpace     = quantity.SizeGiB
+	warnFreeSpace    = 4 * quantity.SizeGiB
+	snapdInfoRelPath = "usr/lib/snapd/info"
+	storeCheckPath   = "v2/snaps/info/core"
+)
+
+// hostChecks lists all the checks, in the order they are reported
+var hostChecks = []hostCheck{
+	{"privileges", checkPrivileges},
+	{"apparmor", checkAppArmor},
+	{"cgroup-v2", checkCgroupV2},
+	{"securityfs", checkSecurityfs},
+	{"mount", checkMount},
+	{"disk-space", checkDiskSpace},
+	{"snap-preseed", checkSnapPreseed},
+	{"store", checkStore},
+}
+
+// RunChecks verifies the host prerequisites for a build and reports
+// the outcome of every check
+func RunChecks(opts DoctorOptions) []CheckResult {
+	results := make([]CheckResult, 0, len(hostChecks))
+	for _, c := range hostChecks {
+		status, message := c.check(opts)
+		results = append(results, CheckResult{Name: c.name, Status: status, Message: message})
+	}
+	return results
+}
+
+// preflight checks the host prerequisites before running any state, so that
+// the build does not fail halfway through
+func (classicStateMachine *ClassicStateMachine) preflight() error {
+	results := RunChecks(DoctorOptions{
+		ImagePath: classicStateMachine.Args.ImagePath,
+		Preseed:   classicStateMachine.Preseed,
+		Rootless:  classicStateMachine.Rootless,
+	})
+
+	failed := make([]string, 0)
+	for _, result := range results {
+		switch result.Status {
+		case CheckFail:
+			failed = append(failed, fmt.Sprintf("%s: %s", result.Name, result.Message))
+		case CheckWarn:
+			// warnings do not prevent the build
+			classicStateMachine.warn(fmt.Sprintf("%s: %s", result.Name, result.Message))
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("Host prerequisites are not met (run \"cedar doctor\" for details, "+
+			"or use --skip-preflight to ignore them):\n%s", strings.Join(failed, "\n"))
+	}
+	return nil
+}
+
+// requiredForPreseed returns the status of a check that only fails when preseeding
+func requiredForPreseed(opts DoctorOptions) CheckStatus {
+	if opts.Preseed {
+		return CheckFail
+	}
+	return CheckWarn
+}
+
+func checkPrivileges(opts DoctorOptions) (CheckStatus, string) {
+	if osGeteuid() == 0 {
+		return CheckPass, "running as root"
+	}
+	if opts.Rootless {
+		if err := CheckUserNamespaces(); err != nil {
+			return CheckFail, err.Error()
+		}
+		return CheckPass, "user namespaces are available for a rootless build"
+	}
+	if hasEffectiveCapability(capSysAdmin) {
+		return CheckPass, "CAP_SYS_ADMIN is available"
+	}
+	return CheckFail, "cedar must run as root, or with --rootless"
+}
+
+// hasEffectiveCapability checks the effective capability set of the process
+func hasEffectiveCapability(capability uint) bool {
+	status, err := osReadFile("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	scanner := bufio.NewScanner(strings.NewReader(string(status)))
+	for scanner.Scan() {
+		capEff, found := strings.CutPrefix(scanner.Text(), "CapEff:")
+		if !found {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(capEff), 16, 64)
+		return err == nil && caps&(1<<capability) != 0
+	}
+	return false
+}
+
+func checkAppArmor(opts DoctorOptions) (CheckStatus, string) {
+	enabled, err := osReadFile("/sys/module/apparmor/parameters/enabled")
+	if err == nil && strings.TrimSpace(string(enabled)) == "Y" {
+		return CheckPass, "AppArmor is enabled"
+	}
+	return requiredForPreseed(opts), "AppArmor is not enabled, snap-preseed cannot run on this host"
+}
+
+func checkCgroupV2(opts DoctorOptions) (CheckStatus, string) {
+	if osutil.FileExists(cgroupControllersPath) {
+		return CheckPass, "the unified cgroup v2 hierarchy is mounted"
+	}
+	return requiredForPreseed(opts), "the unified cgroup v2 hierarchy is not mounted on /sys/fs/cgroup"
+}
+
+func checkSecurityfs(opts DoctorOptions) (CheckStatus, string) {
+	filesystems, err := osReadFile("/proc/filesystems")
+	if err == nil && strings.Contains(string(filesystems), "\tsecurityfs\n") {
+		return CheckPass, "securityfs is supported"
+	}
+	return requiredForPreseed(opts), "securityfs is not supported by the kernel"
+}
+
+func checkMount(opts DoctorOptions) (CheckStatus, string) {
+	target, err := osMkdirTemp("", "cedar-doctor-")
+	if err != nil {
+		return CheckFail, fmt.Sprintf("unable to create a temporary mountpoint: %s", err.Error())
+	}
+	defer func() {
+		_ = osRemove(target)
+	}()
+
+	mountCmd := execCommand("mount", "-t", "tmpfs", "cedar-doctor", target)
+	probe := namespacedCmd([]*exec.Cmd{mountCmd})
+	if opts.Rootless && osGeteuid() != 0 {
+		// tmpfs can be mounted in a user namespace owning the mount namespace
+		probe.SysProcAttr = userNamespaceAttr()
+	}
+	if output, err := execCmdCombinedOutput(probe); err != nil {
+		reason := strings.TrimSpace(string(output))
+		if reason == "" {
+			reason = err.Error()
+		}
+		return CheckFail, fmt.Sprintf("unable to mount filesystems: %s", reason)
+	}
+	return CheckPass, "filesystems can be mounted in a private mount namespace"
+}
+
+func checkDiskSpace(opts DoctorOptions) (CheckStatus, string) {
+	if opts.ImagePath == "" {
+		return CheckWarn, "no image tree given, free space not checked"
+	}
+	var stat syscall.Statfs_t
+	if err := syscallStatfs(opts.ImagePath, &stat); err != nil {
+		return CheckFail, fmt.Sprintf("unable to get free space of %s: %s", opts.ImagePath, err.Error())
+	}
+	free := quantity.Size(stat.Bavail) * quantity.Size(stat.Bsize)
+	message := fmt.Sprintf("%s available in %s", free.IECString(), opts.ImagePath)
+	switch {
+	case free < minFreeSpace:
+		return CheckFail, message
+	case free < warnFreeSpace:
+		return CheckWarn, message
+	}
+	return CheckPass, message
+}
+
+func checkSnapPreseed(opts DoctorOptions) (CheckStatus, string) {
+	if opts.ImagePath == "" {
+		return CheckWarn, "no image tree given, snap-preseed not checked"
+	}
+	if !osutil.FileExists(filepath.Join(opts.ImagePath, "usr", "lib", "snapd", "snap-preseed")) {
+		return requiredForPreseed(opts), "usr/lib/snapd/snap-preseed not found in the image tree, snapd must be installed"
+	}
+	version := snapdVersion(opts.ImagePath)
+	if version == "" {
+		return CheckWarn, fmt.Sprintf("snap-preseed found, but its version cannot be read from %s", snapdInfoRelPath)
+	}
+	return CheckPass, fmt.Sprintf("snap-preseed from snapd %s found", version)
+}
+
+// snapdVersion returns the version of snapd installed in the image tree, read
+// from the info file shipped with it
+func snapdVersion(imagePath string) string {
+	info, err := osReadFile(filepath.Join(imagePath, snapdInfoRelPath))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(info), "\n") {
+		if version, found := strings.CutPrefix(line, "VERSION="); found {
+			return version
+		}
+	}
+	return ""
+}
+
+func checkStore(opts DoctorOptions) (CheckStatus, string) {
+	storeURL := store.DefaultConfig().StoreBaseURL
+	// the info of a snap always published, so that any answer other than a
+	// success comes from a store that cannot be used, or from a proxy or a
+	// captive portal in the way
+	req, err := http.NewRequest(http.MethodGet, storeURL.JoinPath(storeCheckPath).String(), nil)
+	if err != nil {
+		return CheckFail, fmt.Sprintf("unable to build the request to the store: %s", err.Error())
+	}
+	req.Header.Set("Snap-Device-Series", "16")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return CheckFail, fmt.Sprintf("the store at %s cannot be reached: %s", storeURL, err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return CheckFail, fmt.Sprintf("the store at %s answered with %s", storeURL, resp.Status)
+	}
+	return CheckPass, fmt.Sprintf("the store at %s is reachable", storeURL)
+}
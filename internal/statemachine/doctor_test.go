@@ -0,0 +1,258 @@
+package statemachine
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/snapcore/snapd/gadget/quantity"
+
+	"operese/cedar/internal/commands"
+	"operese/cedar/internal/helper"
+)
+
+// roundTripFunc answers the requests of an http.Client without any network
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// testHost describes the host the prerequisites are checked on
+type testHost struct {
+	root        bool
+	apparmor    bool
+	cgroupV2    bool
+	securityfs  bool
+	mountErr    bool
+	freeSpace   quantity.Size
+	storeStatus int
+	storeErr    bool
+}
+
+// readyHost meets every prerequisite of a build
+var readyHost = testHost{
+	root:        true,
+	apparmor:    true,
+	cgroupV2:    true,
+	securityfs:  true,
+	freeSpace:   8 * quantity.SizeGiB,
+	storeStatus: http.StatusOK,
+}
+
+// mockHost mocks the probes of the checks so that they describe the given host
+func mockHost(t *testing.T, host testHost) {
+	t.Helper()
+	defaultHTTPClient := httpClient
+	osGeteuid = func() int {
+		if host.root {
+			return 0
+		}
+		return 1000
+	}
+	osReadFile = func(name string) ([]byte, error) {
+		switch name {
+		case "/proc/self/status":
+			return []byte("CapEff:\t0000000000000000\n"), nil
+		case "/sys/module/apparmor/parameters/enabled":
+			if host.apparmor {
+				return []byte("Y\n"), nil
+			}
+			return []byte("N\n"), nil
+		case "/proc/filesystems":
+			if host.securityfs {
+				return []byte("nodev\tproc\nnodev\tsecurityfs\n"), nil
+			}
+			return []byte("nodev\tproc\n"), nil
+		}
+		return os.ReadFile(name)
+	}
+	cgroupControllersPath = filepath.Join(t.TempDir(), "cgroup.controllers")
+	if host.cgroupV2 {
+		if err := os.WriteFile(cgroupControllersPath, []byte("cpu memory\n"), 0644); err != nil {
+			t.Fatalf("Error writing cgroup.controllers: %s", err.Error())
+		}
+	}
+	mockExecCommand(t)
+	execCmdCombinedOutput = func(cmd *exec.Cmd) ([]byte, error) {
+		if host.mountErr {
+			return []byte("mount: permission denied"), errors.New("exit status 32")
+		}
+		return nil, nil
+	}
+	syscallStatfs = func(path string, stat *syscall.Statfs_t) error {
+		stat.Bsize = 4096
+		stat.Bavail = uint64(host.freeSpace / 4096)
+		return nil
+	}
+	httpClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if host.storeErr {
+			return nil, errors.New("no route to host")
+		}
+		return &http.Response{
+			StatusCode: host.storeStatus,
+			Status:     http.StatusText(host.storeStatus),
+			Body:       io.NopCloser(strings.NewReader("")),
+		}, nil
+	})}
+	t.Cleanup(func() {
+		osGeteuid = os.Geteuid
+		osReadFile = os.ReadFile
+		cgroupControllersPath = "/sys/fs/cgroup/cgroup.controllers"
+		execCmdCombinedOutput = (*exec.Cmd).CombinedOutput
+		syscallStatfs = syscall.Statfs
+		httpClient = defaultHTTPClient
+	})
+}
+
+// writeSnapdTree writes an image tree with snap-preseed and the info of snapd
+func writeSnapdTree(t *testing.T) string {
+	t.Helper()
+	imagePath := t.TempDir()
+	snapdDir := filepath.Join(imagePath, "usr", "lib", "snapd")
+	if err := os.MkdirAll(snapdDir, 0755); err != nil {
+		t.Fatalf("Error creating snapd directory: %s", err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(snapdDir, "snap-preseed"), nil, 0755); err != nil {
+		t.Fatalf("Error writing snap-preseed: %s", err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(snapdDir, "info"), []byte("VERSION=2.63\n"), 0644); err != nil {
+		t.Fatalf("Error writing snapd info: %s", err.Error())
+	}
+	return imagePath
+}
+
+// TestRunChecks tests the status of every check on different hosts
+func TestRunChecks(t *testing.T) {
+	snapdTree := writeSnapdTree(t)
+	emptyTree := t.TempDir()
+
+	modify := func(change func(host *testHost)) testHost {
+		host := readyHost
+		change(&host)
+		return host
+	}
+
+	testCases := []struct {
+		name     string
+		opts     DoctorOptions
+		host     testHost
+		expected map[string]CheckStatus
+	}{
+		{"ready_host", DoctorOptions{ImagePath: snapdTree, Preseed: true}, readyHost, nil},
+		{"unprivileged", DoctorOptions{ImagePath: snapdTree}, modify(func(h *testHost) { h.root = false }),
+			map[string]CheckStatus{"privileges": CheckFail}},
+		{"no_apparmor_without_preseed", DoctorOptions{ImagePath: snapdTree}, modify(func(h *testHost) {
+			h.apparmor = false
+			h.cgroupV2 = false
+			h.securityfs = false
+		}), map[string]CheckStatus{"apparmor": CheckWarn, "cgroup-v2": CheckWarn, "securityfs": CheckWarn}},
+		{"no_apparmor_with_preseed", DoctorOptions{ImagePath: snapdTree, Preseed: true}, modify(func(h *testHost) {
+			h.apparmor = false
+			h.cgroupV2 = false
+			h.securityfs = false
+		}), map[string]CheckStatus{"apparmor": CheckFail, "cgroup-v2": CheckFail, "securityfs": CheckFail}},
+		{"mount_denied", DoctorOptions{ImagePath: snapdTree}, modify(func(h *testHost) { h.mountErr = true }),
+			map[string]CheckStatus{"mount": CheckFail}},
+		{"low_disk_space", DoctorOptions{ImagePath: snapdTree}, modify(func(h *testHost) { h.freeSpace = 2 * quantity.SizeGiB }),
+			map[string]CheckStatus{"disk-space": CheckWarn}},
+		{"no_disk_space", DoctorOptions{ImagePath: snapdTree}, modify(func(h *testHost) { h.freeSpace = 512 * quantity.SizeMiB }),
+			map[string]CheckStatus{"disk-space": CheckFail}},
+		{"no_image_tree", DoctorOptions{}, readyHost,
+			map[string]CheckStatus{"disk-space": CheckWarn, "snap-preseed": CheckWarn}},
+		{"no_snapd_without_preseed", DoctorOptions{ImagePath: emptyTree}, readyHost,
+			map[string]CheckStatus{"snap-preseed": CheckWarn}},
+		{"no_snapd_with_preseed", DoctorOptions{ImagePath: emptyTree, Preseed: true}, readyHost,
+			map[string]CheckStatus{"snap-preseed": CheckFail}},
+		{"store_unreachable", DoctorOptions{ImagePath: snapdTree}, modify(func(h *testHost) { h.storeErr = true }),
+			map[string]CheckStatus{"store": CheckFail}},
+		{"store_unavailable", DoctorOptions{ImagePath: snapdTree}, modify(func(h *testHost) { h.storeStatus = http.StatusServiceUnavailable }),
+			map[string]CheckStatus{"store": CheckFail}},
+		{"store_captive_portal", DoctorOptions{ImagePath: snapdTree}, modify(func(h *testHost) { h.storeStatus = http.StatusForbidden }),
+			map[string]CheckStatus{"store": CheckFail}},
+		{"store_redirect", DoctorOptions{ImagePath: snapdTree}, modify(func(h *testHost) { h.storeStatus = http.StatusNotModified }),
+			nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			mockHost(t, tc.host)
+
+			results := RunChecks(tc.opts)
+			names := make([]string, 0, len(results))
+			for _, result := range results {
+				names = append(names, result.Name)
+				expected, found := tc.expected[result.Name]
+				if !found {
+					expected = CheckPass
+				}
+				if result.Status != expected {
+					t.Errorf("Check %s: expected %s, got %s (%s)", result.Name, expected, result.Status, result.Message)
+				}
+			}
+			asserter.AssertEqual([]string{"privileges", "apparmor", "cgroup-v2", "securityfs", "mount",
+				"disk-space", "snap-preseed", "store"}, names)
+		})
+	}
+}
+
+// TestCheckStore tests the request sent to the store and how its answer is reported
+func TestCheckStore(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	defaultHTTPClient := httpClient
+	t.Cleanup(func() { httpClient = defaultHTTPClient })
+
+	var request *http.Request
+	httpClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		request = req
+		return &http.Response{
+			StatusCode: http.StatusServiceUnavailable,
+			Status:     "503 Service Unavailable",
+			Body:       io.NopCloser(strings.NewReader("")),
+		}, nil
+	})}
+
+	status, message := checkStore(DoctorOptions{})
+	asserter.AssertEqual(CheckFail, status)
+	asserter.AssertEqual(true, strings.HasSuffix(message, "answered with 503 Service Unavailable"))
+	asserter.AssertEqual("/"+storeCheckPath, request.URL.Path)
+	asserter.AssertEqual("16", request.Header.Get("Snap-Device-Series"))
+}
+
+// TestPreflight tests that only failed checks prevent the build
+func TestPreflight(t *testing.T) {
+	testCases := []struct {
+		name        string
+		host        testHost
+		expectedErr string
+	}{
+		{"ready_host", readyHost, ""},
+		{"warning", testHost{root: true, cgroupV2: true, securityfs: true, apparmor: true,
+			freeSpace: 2 * quantity.SizeGiB, storeStatus: http.StatusOK}, ""},
+		{"failure", testHost{root: true, cgroupV2: true, securityfs: true, apparmor: true,
+			freeSpace: 8 * quantity.SizeGiB, storeErr: true}, "store: the store at"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			mockHost(t, tc.host)
+			classicStateMachine := &ClassicStateMachine{
+				Args:    commands.ClassicArgs{ImagePath: writeSnapdTree(t)},
+				Preseed: true,
+			}
+			classicStateMachine.parent = classicStateMachine
+			err := classicStateMachine.preflight()
+			if tc.expectedErr != "" {
+				asserter.AssertErrContains(err, tc.expectedErr)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+		})
+	}
+}
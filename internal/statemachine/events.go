@@ -0,0 +1,133 @@
+package statemachine
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+
+	"operese/cedar/internal/logger"
+)
+
+// EventType is the kind of a progress event
+type EventType string
+
+const (
+	EventStateStarted     EventType = "state-started"
+	EventStateFinished    EventType = "state-finished"
+	EventSnapResolved     EventType = "snap-resolved"
+	EventDownloadStarted  EventType = "download-started"
+	EventDownloadFinished EventType = "download-finished"
+	EventWarning          EventType = "warning"
+	EventResult           EventType = "result"
+)
+
+// Event is a machine readable progress event, written as a single JSON line
+type Event struct {
+	Time  string    `json:"time"`
+	Type  EventType `json:"type"`
+	State string    `json:"state,omitempty"`
+	// Duration of the state, in seconds
+	Duration float64 `json:"duration,omitempty"`
+	Snap     string  `json:"snap,omitempty"`
+	Revision string  `json:"revision,omitempty"`
+	Channel  string  `json:"channel,omitempty"`
+	Message  string  `json:"message,omitempty"`
+	Success  *bool   `json:"success,omitempty"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// EventWriter writes newline-delimited JSON events. A nil EventWriter
+// discards the events.
+type EventWriter struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+// NewEventWriter returns an EventWriter writing to w
+func NewEventWriter(w io.Writer) *EventWriter {
+	return &EventWriter{encoder: json.NewEncoder(w)}
+}
+
+// Emit writes an event, timestamped with the current time
+func (e *EventWriter) Emit(event Event) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	event.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	// progress reporting must never fail the build
+	_ = e.encoder.Encode(event)
+}
+
+// Result writes the final event of the build
+func (e *EventWriter) Result(err error) {
+	success := err == nil
+	event := Event{Type: EventResult, Success: &success}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	e.Emit(event)
+}
+
+// SetEvents sets the writer the progress events are emitted to
+func (stateMachine *StateMachine) SetEvents(events *EventWriter) {
+	stateMachine.events = events
+}
+
+// warn prints a warning and emits it as an event
+func (stateMachine *StateMachine) warn(message string) {
+	logger.Warningf("%s", message)
+	stateMachine.events.Emit(Event{Type: EventWarning, State: stateMachine.CurrentStep, Message: message})
+}
+
+// fetchingRegex matches the lines printed by snapd when a snap is resolved
+var fetchingRegex = regexp.MustCompile(`^Fetching (\S+) \((\S+)\)$`)
+
+// snapWatcher is a writer for the output of image.Prepare, emitting an
+// event for every snap it resolves before passing the output on. snapd
+// downloads the snaps one after the other and prints a line before each
+// download, so a download is finished when the next one starts.
+type snapWatcher struct {
+	out         io.Writer
+	events      *EventWriter
+	channels    map[string]string
+	pending     []byte
+	downloading string
+}
+
+func (w *snapWatcher) Write(p []byte) (int, error) {
+	w.pending = append(w.pending, p...)
+	for {
+		i := bytes.IndexByte(w.pending, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(w.pending[:i])
+		w.pending = w.pending[i+1:]
+		if match := fetchingRegex.FindStringSubmatch(line); match != nil {
+			w.finishDownload()
+			w.events.Emit(Event{
+				Type:     EventSnapResolved,
+				Snap:     match[1],
+				Revision: match[2],
+				Channel:  w.channels[match[1]],
+			})
+			w.events.Emit(Event{Type: EventDownloadStarted, Snap: match[1], Revision: match[2]})
+			w.downloading = match[1]
+		}
+	}
+	return w.out.Write(p)
+}
+
+// finishDownload emits the end of the current download, if any
+func (w *snapWatcher) finishDownload() {
+	if w.downloading == "" {
+		return
+	}
+	w.events.Emit(Event{Type: EventDownloadFinished, Snap: w.downloading})
+	w.downloading = ""
+}
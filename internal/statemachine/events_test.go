@@ -0,0 +1,87 @@
+package statemachine
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"operese/cedar/internal/helper"
+)
+
+// readEvents decodes the events written by an EventWriter, without their time
+func readEvents(t *testing.T, output string) []Event {
+	t.Helper()
+	asserter := helper.Asserter{T: t}
+	events := make([]Event, 0)
+	decoder := json.NewDecoder(strings.NewReader(output))
+	for decoder.More() {
+		var event Event
+		err := decoder.Decode(&event)
+		asserter.AssertErrNil(err, true)
+		if event.Time == "" {
+			t.Errorf("Event %+v has no time", event)
+		}
+		event.Time = ""
+		events = append(events, event)
+	}
+	return events
+}
+
+// TestSnapWatcher tests the events emitted for the output of image.Prepare,
+// written in pieces that split the lines
+func TestSnapWatcher(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var eventsOutput, imageOutput bytes.Buffer
+	watcher := &snapWatcher{
+		out:      &imageOutput,
+		events:   NewEventWriter(&eventsOutput),
+		channels: map[string]string{"core22": "stable"},
+	}
+
+	chunks := []string{"Fetching snapd (21759)\nFetching cor", "e22 (1621)\nCopying \"core22\" (1621)\n", "Fetching lxd (29"}
+	for _, chunk := range chunks {
+		n, err := watcher.Write([]byte(chunk))
+		asserter.AssertErrNil(err, true)
+		asserter.AssertEqual(len(chunk), n)
+	}
+	watcher.finishDownload()
+	// the last download is finished only once
+	watcher.finishDownload()
+
+	asserter.AssertEqual(strings.Join(chunks, ""), imageOutput.String())
+	asserter.AssertEqual([]Event{
+		{Type: EventSnapResolved, Snap: "snapd", Revision: "21759"},
+		{Type: EventDownloadStarted, Snap: "snapd", Revision: "21759"},
+		{Type: EventDownloadFinished, Snap: "snapd"},
+		{Type: EventSnapResolved, Snap: "core22", Revision: "1621", Channel: "stable"},
+		{Type: EventDownloadStarted, Snap: "core22", Revision: "1621"},
+		{Type: EventDownloadFinished, Snap: "core22"},
+	}, readEvents(t, eventsOutput.String()))
+}
+
+// TestEventWriterResult tests the final event of a build
+func TestEventWriterResult(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	success, failure := true, false
+	testCases := []struct {
+		name     string
+		err      error
+		expected Event
+	}{
+		{"success", nil, Event{Type: EventResult, Success: &success}},
+		{"failure", errors.New("Error preparing image"), Event{Type: EventResult, Success: &failure, Error: "Error preparing image"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var output bytes.Buffer
+			NewEventWriter(&output).Result(tc.err)
+			asserter.AssertEqual([]Event{tc.expected}, readEvents(t, output.String()))
+		})
+	}
+
+	// a nil EventWriter discards the events
+	var events *EventWriter
+	events.Result(nil)
+}
@@ -0,0 +1,231 @@
+package statemachine
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/template"
+
+	"github.com/snapcore/snapd/osutil"
+
+	"operese/cedar/internal/helper"
+	"operese/cedar/internal/snaplist"
+)
+
+// fileTemplateData is the data available to the templated files
+type fileTemplateData struct {
+	Architecture string
+	Series       string
+	// Snaps lists the snaps of the build in the name=channel form
+	Snaps []string
+}
+
+// validateFiles makes sure the files section of the snap list can be applied
+func (classicStateMachine *ClassicStateMachine) validateFiles() error {
+	for _, file := range classicStateMachine.ImageDef.Files {
+		source := classicStateMachine.resolveSnapListPath(file.Source)
+		if !osutil.FileExists(source) || osutil.IsDirectory(source) {
+			return fmt.Errorf("Source file %s listed in the snap list does not exist or is not a regular file", source)
+		}
+		if strings.Trim(file.Destination, "/") == "" {
+			return fmt.Errorf("Invalid destination \"%s\" for file %s", file.Destination, file.Source)
+		}
+		if _, err := parseFileMode(file.Mode); err != nil {
+			return err
+		}
+		if _, _, found := strings.Cut(file.Owner, ":"); !found {
+			return fmt.Errorf("Invalid owner \"%s\" for file %s, it must be user:group", file.Owner, file.Source)
+		}
+		if file.Template {
+			if _, err := template.ParseFiles(source); err != nil {
+				return fmt.Errorf("Error parsing template %s: %s", source, err.Error())
+			}
+		}
+		if file.Checksum != "" {
+			if err := verifySnapListFile(source, file.Checksum); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// verifySnapListFile checks that a file referenced in the snap list matches
+// its declared checksum
+func verifySnapListFile(path string, checksum string) error {
+	expected, err := helper.ParseChecksum(checksum)
+	if err != nil {
+		return fmt.Errorf("Invalid checksum for %s: %s", path, err.Error())
+	}
+	return helper.VerifyFile(path, expected)
+}
+
+// parseFileMode parses an octal permission mode
+func parseFileMode(mode string) (os.FileMode, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm > 07777 {
+		return 0, fmt.Errorf("Invalid file mode \"%s\", it must be an octal number like 0644", mode)
+	}
+	return os.FileMode(perm&0777) | unixModeBits(perm), nil
+}
+
+// unixModeBits converts the setuid, setgid and sticky bits of a unix mode
+// to their os.FileMode equivalent
+func unixModeBits(perm uint64) os.FileMode {
+	var mode os.FileMode
+	if perm&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if perm&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if perm&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// lookupTreeID returns the ID of a user or group of the image tree, from its
+// passwd or group database. Numeric IDs are returned as is.
+func lookupTreeID(imagePath string, database string, name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+
+	f, err := osOpen(filepath.Join(imagePath, "etc", database))
+	if err != nil {
+		return 0, fmt.Errorf("Error opening etc/%s of the image tree: %s", database, err.Error())
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// entries are name:password:ID:...
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 3 || fields[0] != name {
+			continue
+		}
+		id, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return 0, fmt.Errorf("Invalid ID for %s in etc/%s of the image tree", name, database)
+		}
+		return id, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("Error reading etc/%s of the image tree: %s", database, err.Error())
+	}
+	return 0, fmt.Errorf("%s not found in etc/%s of the image tree", name, database)
+}
+
+var addFilesState = stateFunc{"add_files", (*StateMachine).addFiles}
+
+// addFiles copies the files of the snap list to the image tree
+func (stateMachine *StateMachine) addFiles() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+
+	for _, file := range classicStateMachine.ImageDef.Files {
+		if err := classicStateMachine.addFile(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addFile copies a file to the image tree. The destination is resolved like
+// it would be in the chroot, so symlinks in the tree cannot redirect it
+// outside of it.
+func (classicStateMachine *ClassicStateMachine) addFile(file *snaplist.File) error {
+	imagePath := classicStateMachine.Args.ImagePath
+	source := classicStateMachine.resolveSnapListPath(file.Source)
+
+	content, err := osReadFile(source)
+	if err != nil {
+		return fmt.Errorf("Error reading file %s: %s", source, err.Error())
+	}
+	if file.Template {
+		content, err = classicStateMachine.renderTemplate(source, content)
+		if err != nil {
+			return err
+		}
+	}
+
+	mode, err := parseFileMode(file.Mode)
+	if err != nil {
+		return err
+	}
+	user, group, _ := strings.Cut(file.Owner, ":")
+	uid, err := lookupTreeID(imagePath, "passwd", user)
+	if err != nil {
+		return err
+	}
+	gid, err := lookupTreeID(imagePath, "group", group)
+	if err != nil {
+		return err
+	}
+
+	destination, err := helperResolveInRoot(imagePath, file.Destination)
+	if err != nil {
+		return err
+	}
+	// the missing part of the destination was not resolved, so it cannot
+	// contain any symlink
+	if err := osMkdirAll(filepath.Dir(destination), 0755); err != nil {
+		return fmt.Errorf("Error creating directory for %s: %s", file.Destination, err.Error())
+	}
+
+	f, err := osOpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW, mode.Perm())
+	if err != nil {
+		return fmt.Errorf("Error creating file %s in the image tree: %s", file.Destination, err.Error())
+	}
+	err = writeTreeFile(f, file, content, uid, gid, mode)
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return fmt.Errorf("Error writing file %s in the image tree: %s", file.Destination, closeErr.Error())
+	}
+	return nil
+}
+
+// writeTreeFile writes the content of a file opened in the image tree and
+// sets its ownership and mode through its descriptor, so the path cannot be
+// swapped for a symlink in between
+func writeTreeFile(f *os.File, file *snaplist.File, content []byte, uid int, gid int, mode os.FileMode) error {
+	if _, err := f.Write(content); err != nil {
+		return fmt.Errorf("Error writing file %s in the image tree: %s", file.Destination, err.Error())
+	}
+	// ownership must be changed first, as it clears the setuid and setgid bits
+	if err := f.Chown(uid, gid); err != nil {
+		return fmt.Errorf("Error changing owner of %s to %s: %s", file.Destination, file.Owner, err.Error())
+	}
+	// the mode given when creating the file is subject to the umask
+	if err := f.Chmod(mode); err != nil {
+		return fmt.Errorf("Error changing mode of %s to %s: %s", file.Destination, file.Mode, err.Error())
+	}
+	return nil
+}
+
+// renderTemplate renders the content of a templated file
+func (classicStateMachine *ClassicStateMachine) renderTemplate(source string, content []byte) ([]byte, error) {
+	tmpl, err := template.New(filepath.Base(source)).Option("missingkey=error").Parse(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing template %s: %s", source, err.Error())
+	}
+
+	data := fileTemplateData{
+		Architecture: classicStateMachine.ImageDef.Architecture,
+		Series:       classicStateMachine.series,
+		Snaps:        classicStateMachine.resolvedSnaps(),
+	}
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return nil, fmt.Errorf("Error rendering template %s: %s", source, err.Error())
+	}
+	return rendered.Bytes(), nil
+}
@@ -0,0 +1,170 @@
+package statemachine
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"operese/cedar/internal/commands"
+	"operese/cedar/internal/helper"
+	"operese/cedar/internal/snaplist"
+)
+
+// TestParseFileMode tests the parsing of octal modes with their special bits
+func TestParseFileMode(t *testing.T) {
+	testCases := []struct {
+		mode        string
+		expected    os.FileMode
+		expectedErr string
+	}{
+		{"0644", 0644, ""},
+		{"755", 0755, ""},
+		{"4755", os.ModeSetuid | 0755, ""},
+		{"2775", os.ModeSetgid | 0775, ""},
+		{"1777", os.ModeSticky | 0777, ""},
+		{"0999", 0, "Invalid file mode"},
+		{"17777", 0, "Invalid file mode"},
+		{"rw-r--r--", 0, "Invalid file mode"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.mode, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			mode, err := parseFileMode(tc.mode)
+			if tc.expectedErr != "" {
+				asserter.AssertErrContains(err, tc.expectedErr)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.expected, mode)
+		})
+	}
+}
+
+// writeTreeDatabases writes the passwd and group databases of an image tree
+func writeTreeDatabases(t *testing.T, imagePath string) {
+	t.Helper()
+	asserter := helper.Asserter{T: t}
+	asserter.AssertErrNil(os.MkdirAll(filepath.Join(imagePath, "etc"), 0755), true)
+	asserter.AssertErrNil(os.WriteFile(filepath.Join(imagePath, "etc", "passwd"),
+		[]byte("root:x:0:0:root:/root:/bin/bash\nbuilder:x:1234:2345::/home/builder:/bin/sh\nbroken:x:abc:0::/:/bin/sh\n"), 0644), true)
+	asserter.AssertErrNil(os.WriteFile(filepath.Join(imagePath, "etc", "group"),
+		[]byte("root:x:0:\nstaff:x:2345:\n"), 0644), true)
+}
+
+// TestLookupTreeID tests that users and groups are looked up in the image tree
+func TestLookupTreeID(t *testing.T) {
+	imagePath := t.TempDir()
+	writeTreeDatabases(t, imagePath)
+
+	testCases := []struct {
+		name        string
+		database    string
+		entry       string
+		expected    int
+		expectedErr string
+	}{
+		{"user", "passwd", "builder", 1234, ""},
+		{"group", "group", "staff", 2345, ""},
+		{"numeric", "passwd", "4321", 4321, ""},
+		{"missing", "group", "builder", 0, "builder not found in etc/group"},
+		{"invalid_id", "passwd", "broken", 0, "Invalid ID for broken"},
+		{"missing_database", "shadow", "root", 0, "Error opening etc/shadow"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			id, err := lookupTreeID(imagePath, tc.database, tc.entry)
+			if tc.expectedErr != "" {
+				asserter.AssertErrContains(err, tc.expectedErr)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.expected, id)
+		})
+	}
+}
+
+// TestAddFile tests that a file is added with its owner and mode, including
+// the setuid bit that changing the owner clears
+func TestAddFile(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing the owner of files requires root")
+	}
+	asserter := helper.Asserter{T: t}
+	imagePath := t.TempDir()
+	writeTreeDatabases(t, imagePath)
+	snapListDir := t.TempDir()
+	asserter.AssertErrNil(os.WriteFile(filepath.Join(snapListDir, "tool"), []byte("#!/bin/sh\n"), 0644), true)
+
+	classicStateMachine := &ClassicStateMachine{
+		Args: commands.ClassicArgs{
+			ImagePath: imagePath,
+			SnapList:  filepath.Join(snapListDir, "snaplist.yaml"),
+		},
+	}
+	err := classicStateMachine.addFile(&snaplist.File{
+		Source:      "tool",
+		Destination: "/usr/local/bin/tool",
+		Mode:        "4750",
+		Owner:       "builder:staff",
+	})
+	asserter.AssertErrNil(err, true)
+
+	info, err := os.Stat(filepath.Join(imagePath, "usr", "local", "bin", "tool"))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(os.ModeSetuid|0750, info.Mode())
+	stat := info.Sys().(*syscall.Stat_t)
+	asserter.AssertEqual(uint32(1234), stat.Uid)
+	asserter.AssertEqual(uint32(2345), stat.Gid)
+}
+
+// TestValidateFiles tests the validation of the files section, including the
+// checksums of the sources
+func TestValidateFiles(t *testing.T) {
+	snapListDir := t.TempDir()
+	err := os.WriteFile(filepath.Join(snapListDir, "motd"), []byte("Welcome\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	motdSum, err := helper.HashFile(filepath.Join(snapListDir, "motd"), helper.SHA512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name        string
+		file        snaplist.File
+		expectedErr string
+	}{
+		{"valid", snaplist.File{Source: "motd", Destination: "/etc/motd", Mode: "0644", Owner: "root:root"}, ""},
+		{"checksum", snaplist.File{Source: "motd", Destination: "/etc/motd", Mode: "0644", Owner: "root:root",
+			Checksum: "sha512:" + motdSum}, ""},
+		{"checksum_mismatch", snaplist.File{Source: "motd", Destination: "/etc/motd", Mode: "0644", Owner: "root:root",
+			Checksum: strings.Repeat("0", 64)}, helper.ErrChecksumMismatch.Error()},
+		{"invalid_checksum", snaplist.File{Source: "motd", Destination: "/etc/motd", Mode: "0644", Owner: "root:root",
+			Checksum: "sha512:motd"}, "Invalid checksum for"},
+		{"missing_source", snaplist.File{Source: "issue", Destination: "/etc/issue", Mode: "0644", Owner: "root:root"},
+			"does not exist or is not a regular file"},
+		{"root_destination", snaplist.File{Source: "motd", Destination: "/", Mode: "0644", Owner: "root:root"},
+			"Invalid destination"},
+		{"invalid_owner", snaplist.File{Source: "motd", Destination: "/etc/motd", Mode: "0644", Owner: "root"},
+			"Invalid owner"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			file := tc.file
+			classicStateMachine := &ClassicStateMachine{
+				Args:     commands.ClassicArgs{SnapList: filepath.Join(snapListDir, "snaplist.yaml")},
+				ImageDef: snaplist.SnapList{Files: []*snaplist.File{&file}},
+			}
+			err := classicStateMachine.validateFiles()
+			if tc.expectedErr != "" {
+				asserter.AssertErrContains(err, tc.expectedErr)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+		})
+	}
+}
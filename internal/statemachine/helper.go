@@ -1,8 +1,10 @@
 package statemachine
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
@@ -70,13 +72,96 @@ func (stateMachine *StateMachine) validateUntilThru() error {
 	return nil
 }
 
-// WriteSnapManifest generates a snap manifest based on the contents of the selected snapsDir
-func WriteSnapManifest(snapsDir string, outputPath string) error {
+// validateSkipOnly makes sure the states given to --skip and --only exist and
+// the flags are not combined in ways that cannot be honored
+func (stateMachine *StateMachine) validateSkipOnly() error {
+	flags := stateMachine.stateMachineFlags
+	if flags.Only != "" && (len(flags.Skip) > 0 || flags.Until != "" || flags.Thru != "") {
+		return fmt.Errorf("--only cannot be used with --skip, --until or --thru")
+	}
+
+	stateNames := make([]string, 0, len(stateMachine.states))
+	for _, state := range stateMachine.states {
+		stateNames = append(stateNames, state.name)
+	}
+	for _, searchState := range append(append([]string{}, flags.Skip...), flags.Only) {
+		if searchState != "" && !helper.SliceHasElement(stateNames, searchState) {
+			return fmt.Errorf("state %s is not a valid state name", searchState)
+		}
+	}
+	for _, skipped := range flags.Skip {
+		if skipped == flags.Until || skipped == flags.Thru {
+			return fmt.Errorf("state %s cannot be both skipped and used with --until or --thru", skipped)
+		}
+	}
+
+	return nil
+}
+
+// applySkipOnly removes the states excluded by --skip and --only
+func (stateMachine *StateMachine) applySkipOnly() {
+	flags := stateMachine.stateMachineFlags
+	states := make([]stateFunc, 0, len(stateMachine.states))
+	for _, state := range stateMachine.states {
+		if helper.SliceHasElement(flags.Skip, state.name) {
+			continue
+		}
+		if flags.Only != "" && state.name != flags.Only {
+			continue
+		}
+		states = append(states, state)
+	}
+	if len(stateMachine.states) > 0 {
+		stateMachine.partialRun = len(states) == 0 || states[0].name != stateMachine.states[0].name
+	}
+	stateMachine.states = states
+}
+
+// formats of the snap manifest
+const (
+	ManifestFormatText = "text"
+	ManifestFormatJSON = "json"
+)
+
+// ManifestEntry is a snap of the snap manifest
+type ManifestEntry struct {
+	Name     string `json:"name"`
+	Revision string `json:"revision"`
+	Channel  string `json:"channel"`
+	SHA3_384 string `json:"sha3-384"`
+}
+
+// WriteSnapManifest generates a snap manifest based on the contents of the selected snapsDir.
+// The text format has a "name revision channel sha3-384" line per snap, with "-" for
+// snaps without channel, the json format a list of ManifestEntry. A seed
+// without snaps directory gives an empty manifest. snapSHA3_384 returns the
+// sha3-384 digest of a snap file, encoded like in the snap assertions.
+func WriteSnapManifest(snapsDir string, outputPath string, channels map[string]string, format string,
+	snapSHA3_384 func(snapPath string) (string, error)) error {
 	files, err := osReadDir(snapsDir)
-	if err != nil {
-		// As per previous cedar manifest generation, we skip generating
-		// manifests for non-existent/invalid paths
-		return nil
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error reading the snaps of the seed: %s", err.Error())
+	}
+
+	entries := make([]ManifestEntry, 0, len(files))
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".snap") {
+			continue
+		}
+		split := strings.SplitN(file.Name(), "_", 2)
+		if len(split) != 2 {
+			continue
+		}
+		digest, err := snapSHA3_384(filepath.Join(snapsDir, file.Name()))
+		if err != nil {
+			return fmt.Errorf("Error hashing snap %s: %s", file.Name(), err.Error())
+		}
+		entries = append(entries, ManifestEntry{
+			Name:     split[0],
+			Revision: strings.TrimSuffix(split[1], ".snap"),
+			Channel:  channels[split[0]],
+			SHA3_384: digest,
+		})
 	}
 
 	manifest, err := osCreate(outputPath)
@@ -85,10 +170,23 @@ func WriteSnapManifest(snapsDir string, outputPath string) error {
 	}
 	defer manifest.Close()
 
-	for _, file := range files {
-		if strings.HasSuffix(file.Name(), ".snap") {
-			split := strings.SplitN(file.Name(), "_", 2)
-			fmt.Fprintf(manifest, "%s %s\n", split[0], strings.TrimSuffix(split[1], ".snap"))
+	if format == ManifestFormatJSON {
+		encoder := json.NewEncoder(manifest)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(entries); err != nil {
+			return fmt.Errorf("Error writing manifest file: %s", err.Error())
+		}
+		return nil
+	}
+
+	for _, entry := range entries {
+		channel := entry.Channel
+		if channel == "" {
+			channel = "-"
+		}
+		_, err := fmt.Fprintf(manifest, "%s %s %s %s\n", entry.Name, entry.Revision, channel, entry.SHA3_384)
+		if err != nil {
+			return fmt.Errorf("Error writing manifest file: %s", err.Error())
 		}
 	}
 	return nil
@@ -142,35 +240,65 @@ func execTeardownCmds(teardownCmds []*exec.Cmd, debug bool, prevErr error) (err
 	return err
 }
 
+// joinRestoreErr adds the error of a function restoring the image tree to
+// an already existing error
+func joinRestoreErr(err error, restoreErr error) error {
+	if restoreErr == nil {
+		return err
+	}
+	if err == nil {
+		return restoreErr
+	}
+	return fmt.Errorf("%w\n%s", err, restoreErr.Error())
+}
+
 // getPreseedsnaps returns a slice of the snaps that were preseeded in a chroot
 // and their channels
-func getPreseededSnaps(rootfs string) (seededSnaps map[string]string, err error) {
+func getPreseededSnaps(rootfs string, digests snapDigestCache) (seededSnaps map[string]string, err error) {
 	// seededSnaps maps the snap name and channel that was seeded
 	seededSnaps = make(map[string]string)
 
+	snaps, err := getSeedSnaps(rootfs, digests)
+	if err != nil {
+		return seededSnaps, err
+	}
+	for _, sn := range snaps {
+		seededSnaps[sn.SnapName()] = sn.Channel
+	}
+
+	return seededSnaps, nil
+}
+
+// getSeedSnaps returns the snaps of the seed of a chroot. The asserted snaps
+// are hashed through digests, unless it is nil.
+func getSeedSnaps(rootfs string, digests snapDigestCache) (seedSnaps []*seed.Snap, err error) {
 	// open the seed and run LoadAssertions and LoadMeta to get a list of snaps
 	snapdDir := filepath.Join(rootfs, "var", "lib", "snapd")
 	seedDir := filepath.Join(snapdDir, "seed")
 	preseed, err := seedOpen(seedDir, "")
 	if err != nil {
-		return seededSnaps, err
+		return nil, err
 	}
 	measurer := timings.New(nil)
 	if err := preseed.LoadAssertions(nil, nil); err != nil {
-		return seededSnaps, err
+		return nil, err
 	}
-	if err := preseed.LoadMeta(seed.AllModes, nil, measurer); err != nil {
-		return seededSnaps, err
+	var handler seed.ContainerHandler
+	if digests != nil {
+		handler = snapDigestHandler{cache: digests}
+	}
+	if err := preseed.LoadMeta(seed.AllModes, handler, measurer); err != nil {
+		return nil, err
 	}
 
 	// iterate over the snaps in the seed and add them to the list
 	err = preseed.Iter(func(sn *seed.Snap) error {
-		seededSnaps[sn.SnapName()] = sn.Channel
+		seedSnaps = append(seedSnaps, sn)
 		return nil
 	})
 	if err != nil {
-		return seededSnaps, err
+		return nil, err
 	}
 
-	return seededSnaps, nil
+	return seedSnaps, nil
 }
@@ -0,0 +1,97 @@
+package statemachine
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/snapcore/snapd/asserts"
+
+	"operese/cedar/internal/helper"
+)
+
+// assertsSnapSHA3_384 hashes a snap like snapd does
+func assertsSnapSHA3_384(snapPath string) (string, error) {
+	digest, _, err := asserts.SnapFileSHA3_384(snapPath)
+	return digest, err
+}
+
+// TestWriteSnapManifest tests the text and json formats of the snap manifest
+func TestWriteSnapManifest(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	snapsDir := t.TempDir()
+	for _, name := range []string{"hello_42.snap", "core22_1621.snap", "README", "nounderscore.snap"} {
+		err := os.WriteFile(filepath.Join(snapsDir, name), []byte(name), 0644)
+		asserter.AssertErrNil(err, true)
+	}
+	helloDigest, _, err := asserts.SnapFileSHA3_384(filepath.Join(snapsDir, "hello_42.snap"))
+	asserter.AssertErrNil(err, true)
+	coreDigest, _, err := asserts.SnapFileSHA3_384(filepath.Join(snapsDir, "core22_1621.snap"))
+	asserter.AssertErrNil(err, true)
+	channels := map[string]string{"hello": "latest/edge"}
+
+	testCases := []struct {
+		name     string
+		format   string
+		expected string
+	}{
+		{
+			"text",
+			ManifestFormatText,
+			"core22 1621 - " + coreDigest + "\n" +
+				"hello 42 latest/edge " + helloDigest + "\n",
+		},
+		{
+			"json",
+			ManifestFormatJSON,
+			`[
+  {
+    "name": "core22",
+    "revision": "1621",
+    "channel": "",
+    "sha3-384": "` + coreDigest + `"
+  },
+  {
+    "name": "hello",
+    "revision": "42",
+    "channel": "latest/edge",
+    "sha3-384": "` + helloDigest + `"
+  }
+]
+`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			outputPath := filepath.Join(t.TempDir(), "manifest")
+			err := WriteSnapManifest(snapsDir, outputPath, channels, tc.format, assertsSnapSHA3_384)
+			asserter.AssertErrNil(err, true)
+			content, err := os.ReadFile(outputPath)
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.expected, string(content))
+		})
+	}
+}
+
+// TestWriteSnapManifestMissingSnaps tests that a seed without snaps
+// directory gives an empty manifest
+func TestWriteSnapManifestMissingSnaps(t *testing.T) {
+	testCases := []struct {
+		format   string
+		expected string
+	}{
+		{ManifestFormatText, ""},
+		{ManifestFormatJSON, "[]\n"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.format, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			outputPath := filepath.Join(t.TempDir(), "manifest")
+			err := WriteSnapManifest(filepath.Join(t.TempDir(), "missing"), outputPath, nil, tc.format, assertsSnapSHA3_384)
+			asserter.AssertErrNil(err, true)
+			content, err := os.ReadFile(outputPath)
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.expected, string(content))
+		})
+	}
+}
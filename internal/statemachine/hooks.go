@@ -0,0 +1,137 @@
+package statemachine
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/snapcore/snapd/osutil"
+
+	"operese/cedar/internal/logger"
+	"operese/cedar/internal/snaplist"
+)
+
+// policies applied when a hook script fails
+const (
+	hookOnErrorFail   = "fail"
+	hookOnErrorWarn   = "warn"
+	hookOnErrorIgnore = "ignore"
+)
+
+var prePrepareHooksState = stateFunc{"pre_prepare_hooks", (*StateMachine).runPrePrepareHooks}
+var postPrepareHooksState = stateFunc{"post_prepare_hooks", (*StateMachine).runPostPrepareHooks}
+var prePreseedHooksState = stateFunc{"pre_preseed_hooks", (*StateMachine).runPrePreseedHooks}
+var postPreseedHooksState = stateFunc{"post_preseed_hooks", (*StateMachine).runPostPreseedHooks}
+
+func (stateMachine *StateMachine) runPrePrepareHooks() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+	return classicStateMachine.runHooks("pre-prepare", classicStateMachine.ImageDef.Hooks.PrePrepare, nil)
+}
+
+func (stateMachine *StateMachine) runPostPrepareHooks() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+	return classicStateMachine.runHooks("post-prepare", classicStateMachine.ImageDef.Hooks.PostPrepare, nil)
+}
+
+func (stateMachine *StateMachine) runPrePreseedHooks() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+	return classicStateMachine.runHooks("pre-preseed", classicStateMachine.ImageDef.Hooks.PrePreseed, nil)
+}
+
+func (stateMachine *StateMachine) runPostPreseedHooks() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+	return classicStateMachine.runHooks("post-preseed", classicStateMachine.ImageDef.Hooks.PostPreseed, nil)
+}
+
+// runStatesAndHooks runs the states and, if one of them fails, the on-failure hooks
+func (classicStateMachine *ClassicStateMachine) runStatesAndHooks() error {
+	err := classicStateMachine.StateMachine.Run()
+	if err == nil || classicStateMachine.ImageDef.Hooks == nil ||
+		len(classicStateMachine.ImageDef.Hooks.OnFailure) == 0 {
+		return err
+	}
+
+	// the build may have failed because it was interrupted, but the
+	// on-failure hooks must still get a chance to run
+	ctx := classicStateMachine.ctx
+	classicStateMachine.ctx = context.WithoutCancel(ctx)
+	defer func() {
+		classicStateMachine.ctx = ctx
+	}()
+
+	hookErr := classicStateMachine.runHooks("on-failure", classicStateMachine.ImageDef.Hooks.OnFailure, []string{
+		"CEDAR_FAILED_STATE=" + classicStateMachine.CurrentStep,
+		"CEDAR_ERROR=" + err.Error(),
+	})
+	if hookErr != nil {
+		return fmt.Errorf("%w\n%s", err, hookErr.Error())
+	}
+	return err
+}
+
+// runHooks runs the given hook scripts in order and handles their failures
+// according to their policy
+func (classicStateMachine *ClassicStateMachine) runHooks(hookName string, hooks []*snaplist.Hook, extraEnv []string) error {
+	env := append(classicStateMachine.hookEnv(hookName), extraEnv...)
+	for _, hook := range hooks {
+		script := classicStateMachine.resolveSnapListPath(hook.Script)
+		err := helperRunScript(classicStateMachine.ctx, script, env)
+		if err == nil {
+			continue
+		}
+		if classicStateMachine.ctx.Err() != nil {
+			return err
+		}
+		switch hook.OnError {
+		case hookOnErrorWarn:
+			classicStateMachine.warn(fmt.Sprintf("%s hook failed: %s", hookName, err.Error()))
+		case hookOnErrorIgnore:
+			logger.Debugf("Ignoring failure of %s hook: %s", hookName, err.Error())
+		default:
+			return fmt.Errorf("Error running %s hook: %s", hookName, err.Error())
+		}
+	}
+	return nil
+}
+
+// hookEnv returns the variables describing the build to hook scripts
+func (classicStateMachine *ClassicStateMachine) hookEnv(hookName string) []string {
+	return []string{
+		"CEDAR_HOOK=" + hookName,
+		"CEDAR_IMAGE_PATH=" + classicStateMachine.Args.ImagePath,
+		"CEDAR_SNAP_LIST=" + classicStateMachine.Args.SnapList,
+		"CEDAR_ARCHITECTURE=" + classicStateMachine.ImageDef.Architecture,
+		"CEDAR_SERIES=" + classicStateMachine.series,
+		"CEDAR_SNAPS=" + strings.Join(classicStateMachine.resolvedSnaps(), " "),
+	}
+}
+
+// resolvedSnaps returns the snaps of the build in the name=channel form.
+// Once the seed is populated, these are the snaps it contains, including
+// the bases and snapd, otherwise the ones requested in the snap list.
+func (classicStateMachine *ClassicStateMachine) resolvedSnaps() []string {
+	snapChannels := make(map[string]string)
+	for _, snap := range classicStateMachine.ImageDef.Snaps {
+		snapChannels[snap.SnapName] = snap.Channel
+	}
+	seedYaml := filepath.Join(classicStateMachine.Args.ImagePath, "var", "lib", "snapd", "seed", "seed.yaml")
+	if osutil.FileExists(seedYaml) {
+		seeded, err := getPreseededSnaps(classicStateMachine.Args.ImagePath, classicStateMachine.seedDigests())
+		if err == nil && len(seeded) > 0 {
+			snapChannels = seeded
+		}
+	}
+
+	snaps := make([]string, 0, len(snapChannels))
+	for name, channel := range snapChannels {
+		if channel == "" {
+			snaps = append(snaps, name)
+			continue
+		}
+		snaps = append(snaps, name+"="+channel)
+	}
+	sort.Strings(snaps)
+	return snaps
+}
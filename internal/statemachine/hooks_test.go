@@ -0,0 +1,186 @@
+package statemachine
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"operese/cedar/internal/commands"
+	"operese/cedar/internal/helper"
+	"operese/cedar/internal/snaplist"
+)
+
+// hookRun records a run of a hook script
+type hookRun struct {
+	script string
+	env    []string
+}
+
+var cmpOptsHookRun = []cmp.Option{cmp.AllowUnexported(hookRun{})}
+
+// mockRunScript makes the hook scripts named fail.sh fail and records the runs
+func mockRunScript(t *testing.T) *[]hookRun {
+	t.Helper()
+	runs := &[]hookRun{}
+	helperRunScript = func(ctx context.Context, script string, env []string) error {
+		*runs = append(*runs, hookRun{script: script, env: env})
+		if filepath.Base(script) == "fail.sh" {
+			return errors.New("exit status 1")
+		}
+		return nil
+	}
+	t.Cleanup(func() { helperRunScript = helper.RunScript })
+	return runs
+}
+
+// newHooksStateMachine returns a state machine for a snap list in /srv/images
+func newHooksStateMachine(imagePath string) *ClassicStateMachine {
+	classicStateMachine := &ClassicStateMachine{
+		Args: commands.ClassicArgs{
+			ImagePath: imagePath,
+			SnapList:  "/srv/images/snaplist.yaml",
+		},
+		ImageDef: snaplist.SnapList{
+			Architecture: "arm64",
+			Snaps: []*snaplist.Snap{
+				{SnapName: "hello", Channel: "candidate"},
+				{SnapName: "lxd"},
+			},
+		},
+	}
+	classicStateMachine.parent = classicStateMachine
+	classicStateMachine.series = "noble"
+	classicStateMachine.ctx = context.Background()
+	classicStateMachine.commonFlags = &commands.CommonOpts{}
+	return classicStateMachine
+}
+
+// TestRunHooks tests how the failure of a hook is handled for every on-error policy
+func TestRunHooks(t *testing.T) {
+	testCases := []struct {
+		name            string
+		onError         string
+		expectedErr     string
+		expectedScripts []string
+	}{
+		{"default", "", "Error running pre-prepare hook: exit status 1",
+			[]string{"/srv/images/first.sh", "/srv/images/fail.sh"}},
+		{"fail", hookOnErrorFail, "Error running pre-prepare hook: exit status 1",
+			[]string{"/srv/images/first.sh", "/srv/images/fail.sh"}},
+		{"warn", hookOnErrorWarn, "",
+			[]string{"/srv/images/first.sh", "/srv/images/fail.sh", "/opt/hooks/last.sh"}},
+		{"ignore", hookOnErrorIgnore, "",
+			[]string{"/srv/images/first.sh", "/srv/images/fail.sh", "/opt/hooks/last.sh"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			runs := mockRunScript(t)
+			classicStateMachine := newHooksStateMachine(t.TempDir())
+
+			err := classicStateMachine.runHooks("pre-prepare", []*snaplist.Hook{
+				{Script: "first.sh", OnError: hookOnErrorFail},
+				{Script: "fail.sh", OnError: tc.onError},
+				{Script: "/opt/hooks/last.sh", OnError: hookOnErrorFail},
+			}, nil)
+			if tc.expectedErr != "" {
+				asserter.AssertErrContains(err, tc.expectedErr)
+			} else {
+				asserter.AssertErrNil(err, true)
+			}
+
+			scripts := make([]string, 0, len(*runs))
+			for _, run := range *runs {
+				scripts = append(scripts, run.script)
+			}
+			asserter.AssertEqual(tc.expectedScripts, scripts)
+		})
+	}
+}
+
+// TestRunHooksInterrupted tests that a failure caused by an interruption
+// stops the build whatever the policy of the hook
+func TestRunHooksInterrupted(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	runs := mockRunScript(t)
+	classicStateMachine := newHooksStateMachine(t.TempDir())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	classicStateMachine.ctx = ctx
+
+	err := classicStateMachine.runHooks("post-preseed", []*snaplist.Hook{
+		{Script: "fail.sh", OnError: hookOnErrorIgnore},
+		{Script: "next.sh", OnError: hookOnErrorIgnore},
+	}, nil)
+	asserter.AssertErrContains(err, "exit status 1")
+	asserter.AssertEqual(1, len(*runs))
+}
+
+// TestHookEnv tests the environment hook scripts receive
+func TestHookEnv(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	runs := mockRunScript(t)
+	imagePath := t.TempDir()
+	classicStateMachine := newHooksStateMachine(imagePath)
+
+	err := classicStateMachine.runHooks("post-prepare", []*snaplist.Hook{{Script: "hook.sh"}}, []string{"EXTRA=1"})
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual([]hookRun{{
+		script: "/srv/images/hook.sh",
+		env: []string{
+			"CEDAR_HOOK=post-prepare",
+			"CEDAR_IMAGE_PATH=" + imagePath,
+			"CEDAR_SNAP_LIST=/srv/images/snaplist.yaml",
+			"CEDAR_ARCHITECTURE=arm64",
+			"CEDAR_SERIES=noble",
+			"CEDAR_SNAPS=hello=candidate lxd",
+			"EXTRA=1",
+		},
+	}}, *runs, cmpOptsHookRun...)
+}
+
+// TestRunStatesAndHooks tests that the on-failure hooks run, and are told
+// about the failure, only when a state fails
+func TestRunStatesAndHooks(t *testing.T) {
+	testCases := []struct {
+		name         string
+		stateErr     error
+		hookScript   string
+		expectedErr  string
+		expectedRuns int
+	}{
+		{"success", nil, "hook.sh", "", 0},
+		{"failure", errors.New("state failed"), "hook.sh", "state failed", 1},
+		{"failing_hook", errors.New("state failed"), "fail.sh", "state failed\nError running on-failure hook", 1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			runs := mockRunScript(t)
+			classicStateMachine := newHooksStateMachine(t.TempDir())
+			classicStateMachine.stateMachineFlags = &commands.StateMachineOpts{}
+			classicStateMachine.ImageDef.Hooks = &snaplist.Hooks{
+				OnFailure: []*snaplist.Hook{{Script: tc.hookScript}},
+			}
+			classicStateMachine.states = []stateFunc{{"build", func(*StateMachine) error { return tc.stateErr }}}
+
+			err := classicStateMachine.runStatesAndHooks()
+			if tc.expectedErr != "" {
+				asserter.AssertErrContains(err, tc.expectedErr)
+			} else {
+				asserter.AssertErrNil(err, true)
+			}
+			asserter.AssertEqual(tc.expectedRuns, len(*runs))
+			if tc.expectedRuns == 0 {
+				return
+			}
+			env := (*runs)[0].env
+			asserter.AssertEqual(true, helper.SliceHasElement(env, "CEDAR_HOOK=on-failure"))
+			asserter.AssertEqual(true, helper.SliceHasElement(env, "CEDAR_FAILED_STATE=build"))
+			asserter.AssertEqual(true, helper.SliceHasElement(env, "CEDAR_ERROR=state failed"))
+		})
+	}
+}
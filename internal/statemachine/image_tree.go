@@ -0,0 +1,220 @@
+package statemachine
+
+import (
+	"bufio"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/strutil"
+
+	"operese/cedar/internal/logger"
+)
+
+// minPreseedSnapdVersion is the first snapd release shipping a snap-preseed
+// with complete support for classic images, including --reset
+const minPreseedSnapdVersion = "2.45"
+
+// dpkgPackage holds the fields of a dpkg status entry used by cedar
+type dpkgPackage struct {
+	Version      string
+	Architecture string
+	Installed    bool
+}
+
+// readOSRelease parses the os-release file of the image tree
+func readOSRelease(imagePath string) (map[string]string, error) {
+	// os-release is usually a symlink to the one in /usr/lib, which would be
+	// resolved against the host root, so prefer reading that one directly
+	osReleasePath := filepath.Join(imagePath, "etc", "os-release")
+	if !osutil.FileExists(osReleasePath) || osutil.IsSymlink(osReleasePath) {
+		osReleasePath = filepath.Join(imagePath, "usr", "lib", "os-release")
+	}
+
+	content, err := osReadFile(osReleasePath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading os-release of the image tree: %s", err.Error())
+	}
+
+	osRelease := make(map[string]string)
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		osRelease[key] = strings.Trim(value, `"'`)
+	}
+	return osRelease, nil
+}
+
+// readDpkgStatus parses the dpkg database of the image tree and returns the
+// known packages by name
+func readDpkgStatus(imagePath string) (map[string]*dpkgPackage, error) {
+	f, err := osOpen(filepath.Join(imagePath, "var", "lib", "dpkg", "status"))
+	if err != nil {
+		return nil, fmt.Errorf("Error opening the dpkg database of the image tree: %s", err.Error())
+	}
+	defer f.Close()
+
+	packages := make(map[string]*dpkgPackage)
+	var name string
+	current := &dpkgPackage{}
+	scanner := bufio.NewScanner(f)
+	// some fields, like Description, can be very long
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if name != "" {
+				packages[name] = current
+			}
+			name = ""
+			current = &dpkgPackage{}
+			continue
+		}
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "Package":
+			name = value
+		case "Version":
+			current.Version = value
+		case "Architecture":
+			current.Architecture = value
+		case "Status":
+			current.Installed = strings.HasSuffix(value, " installed")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading the dpkg database of the image tree: %s", err.Error())
+	}
+	if name != "" {
+		packages[name] = current
+	}
+
+	return packages, nil
+}
+
+// dpkgArchitecture returns the native architecture of the image tree, which
+// is the one of the dpkg package itself
+func dpkgArchitecture(packages map[string]*dpkgPackage) (string, error) {
+	dpkg, found := packages["dpkg"]
+	if !found || !dpkg.Installed || dpkg.Architecture == "" {
+		return "", fmt.Errorf("Unable to find the architecture of the image tree: dpkg is not installed")
+	}
+	return dpkg.Architecture, nil
+}
+
+// osReleaseCodename returns the release codename of the image tree
+func osReleaseCodename(osRelease map[string]string) string {
+	if codename := osRelease["VERSION_CODENAME"]; codename != "" {
+		return codename
+	}
+	return osRelease["UBUNTU_CODENAME"]
+}
+
+// validateImageTree makes sure the image path is an Ubuntu classic root
+// matching the snap list, so that an unbootable seed is never produced.
+// The architecture and series missing from the snap list are detected from
+// the image tree.
+func (classicStateMachine *ClassicStateMachine) validateImageTree() error {
+	imagePath := classicStateMachine.Args.ImagePath
+	if !osutil.IsDirectory(imagePath) {
+		return fmt.Errorf("Image path %s is not a directory", imagePath)
+	}
+
+	osRelease, err := readOSRelease(imagePath)
+	if err != nil {
+		return err
+	}
+	if osRelease["ID"] != "ubuntu" && !strutil.ListContains(strings.Fields(osRelease["ID_LIKE"]), "ubuntu") {
+		return fmt.Errorf("Image path %s is not an Ubuntu root filesystem (ID=%s in os-release)",
+			imagePath, osRelease["ID"])
+	}
+
+	codename := osReleaseCodename(osRelease)
+	if classicStateMachine.series == "" {
+		if codename == "" {
+			return fmt.Errorf("No series given in the snap list and none found in os-release of the image tree")
+		}
+		classicStateMachine.ImageDef.Series = codename
+		classicStateMachine.series = codename
+		classicStateMachine.DetectedSeries = codename
+	}
+	if codename != classicStateMachine.series {
+		return fmt.Errorf("The snap list is for series %s but the image tree is %s",
+			classicStateMachine.series, codename)
+	}
+
+	packages, err := readDpkgStatus(imagePath)
+	if err != nil {
+		return fmt.Errorf("Image path %s is not an Ubuntu classic root filesystem: %s", imagePath, err.Error())
+	}
+	arch, err := dpkgArchitecture(packages)
+	if err != nil {
+		return err
+	}
+	if classicStateMachine.ImageDef.Architecture == "" {
+		classicStateMachine.ImageDef.Architecture = arch
+		classicStateMachine.DetectedArchitecture = arch
+	}
+	if arch != classicStateMachine.ImageDef.Architecture {
+		return fmt.Errorf("The snap list is for architecture %s but the image tree is %s",
+			classicStateMachine.ImageDef.Architecture, arch)
+	}
+
+	classicStateMachine.displayDetected()
+
+	if !classicStateMachine.Preseed {
+		return nil
+	}
+	// snapd may be upgraded by the packages of the snap list before preseeding
+	overrides, err := classicStateMachine.packageOverrides()
+	if err != nil {
+		return err
+	}
+	if version, found := overrides["snapd"]; found {
+		if version == "" {
+			// the latest version from the archive will be installed
+			return nil
+		}
+		packages["snapd"] = &dpkgPackage{Version: version, Installed: true}
+	}
+	return checkSnapdPackage(packages)
+}
+
+// displayDetected prints the values detected from the image tree
+func (classicStateMachine *ClassicStateMachine) displayDetected() {
+	if classicStateMachine.DetectedArchitecture != "" {
+		logger.Infof("Detected architecture %s from the image tree", classicStateMachine.DetectedArchitecture)
+	}
+	if classicStateMachine.DetectedSeries != "" {
+		logger.Infof("Detected series %s from the image tree", classicStateMachine.DetectedSeries)
+	}
+}
+
+// checkSnapdPackage makes sure the snapd deb installed in the image tree
+// is recent enough to preseed it
+func checkSnapdPackage(packages map[string]*dpkgPackage) error {
+	snapd, found := packages["snapd"]
+	if !found || !snapd.Installed {
+		return fmt.Errorf("The snapd package must be installed in the image tree to preseed it")
+	}
+	cmp, err := strutil.VersionCompare(snapd.Version, minPreseedSnapdVersion)
+	if err != nil {
+		return fmt.Errorf("Unable to compare the version of snapd installed in the image tree: %s", err.Error())
+	}
+	if cmp < 0 {
+		return fmt.Errorf("The snapd package installed in the image tree (%s) is too old to preseed it, at least %s is required",
+			snapd.Version, minPreseedSnapdVersion)
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"operese/cedar/internal/commands"
+	"operese/cedar/internal/helper"
+)
+
+// ubuntuOSRelease is the os-release of an Ubuntu noble root filesystem
+const ubuntuOSRelease = `PRETTY_NAME="Ubuntu 24.04 LTS"
+NAME="Ubuntu"
+VERSION_ID="24.04"
+VERSION_CODENAME=noble
+ID=ubuntu
+ID_LIKE=debian
+UBUNTU_CODENAME=noble
+`
+
+// dpkgStatusEntry returns the entry of a package in the dpkg database
+func dpkgStatusEntry(name string, version string, arch string, installed bool) string {
+	status := "install ok installed"
+	if !installed {
+		status = "deinstall ok config-files"
+	}
+	return fmt.Sprintf("Package: %s\nStatus: %s\nArchitecture: %s\nVersion: %s\nDescription: %s\n long description\n\n",
+		name, status, arch, version, name)
+}
+
+// writeTestTreeFile writes a file of the image tree, creating its directory
+func writeTestTreeFile(t *testing.T, imagePath string, relPath string, content string) {
+	t.Helper()
+	path := filepath.Join(imagePath, relPath)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Error creating directory of %s: %s", relPath, err.Error())
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Error writing %s: %s", relPath, err.Error())
+	}
+}
+
+// writeDpkgStatus writes the dpkg database of the image tree
+func writeDpkgStatus(t *testing.T, imagePath string, status string) {
+	t.Helper()
+	writeTestTreeFile(t, imagePath, filepath.Join("var", "lib", "dpkg", "status"), status)
+}
+
+// TestReadOSRelease tests the parsing of os-release and where it is read from
+func TestReadOSRelease(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+
+	imagePath := t.TempDir()
+	writeTestTreeFile(t, imagePath, filepath.Join("usr", "lib", "os-release"), ubuntuOSRelease+"# comment\n\nBROKEN\nNAME_QUOTED='Single'\n")
+	// an absolute symlink would be resolved against the root of the host
+	asserter.AssertErrNil(os.MkdirAll(filepath.Join(imagePath, "etc"), 0755), true)
+	asserter.AssertErrNil(os.Symlink("/usr/lib/os-release", filepath.Join(imagePath, "etc", "os-release")), true)
+
+	osRelease, err := readOSRelease(imagePath)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("ubuntu", osRelease["ID"])
+	asserter.AssertEqual("Ubuntu 24.04 LTS", osRelease["PRETTY_NAME"])
+	asserter.AssertEqual("Single", osRelease["NAME_QUOTED"])
+	asserter.AssertEqual("noble", osReleaseCodename(osRelease))
+	_, found := osRelease["BROKEN"]
+	asserter.AssertEqual(false, found)
+
+	t.Run("etc", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		imagePath := t.TempDir()
+		writeTestTreeFile(t, imagePath, filepath.Join("etc", "os-release"), "ID=ubuntu\nUBUNTU_CODENAME=jammy\n")
+		osRelease, err := readOSRelease(imagePath)
+		asserter.AssertErrNil(err, true)
+		asserter.AssertEqual("jammy", osReleaseCodename(osRelease))
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		_, err := readOSRelease(t.TempDir())
+		asserter.AssertErrContains(err, "Error reading os-release of the image tree")
+	})
+}
+
+// TestReadDpkgStatus tests the parsing of the dpkg database
+func TestReadDpkgStatus(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	imagePath := t.TempDir()
+	// the last entry is not followed by an empty line
+	writeDpkgStatus(t, imagePath, dpkgStatusEntry("dpkg", "1.22.6", "amd64", true)+
+		dpkgStatusEntry("snapd", "2.63+24.04", "amd64", false)+
+		"Package: libc6\nStatus: install ok installed\nArchitecture: i386\nVersion: 2.39-0ubuntu8")
+
+	packages, err := readDpkgStatus(imagePath)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(map[string]*dpkgPackage{
+		"dpkg":  {Version: "1.22.6", Architecture: "amd64", Installed: true},
+		"snapd": {Version: "2.63+24.04", Architecture: "amd64", Installed: false},
+		"libc6": {Version: "2.39-0ubuntu8", Architecture: "i386", Installed: true},
+	}, packages)
+
+	_, err = readDpkgStatus(t.TempDir())
+	asserter.AssertErrContains(err, "Error opening the dpkg database of the image tree")
+}
+
+// TestCheckSnapdPackage tests the version of snapd required to preseed
+func TestCheckSnapdPackage(t *testing.T) {
+	testCases := []struct {
+		name        string
+		snapd       *dpkgPackage
+		expectedErr string
+	}{
+		{"recent", &dpkgPackage{Version: "2.63+24.04", Installed: true}, ""},
+		{"minimum", &dpkgPackage{Version: minPreseedSnapdVersion, Installed: true}, ""},
+		{"too_old", &dpkgPackage{Version: "2.44.3", Installed: true}, "is too old to preseed it"},
+		{"not_installed", &dpkgPackage{Version: "2.63", Installed: false}, "must be installed"},
+		{"missing", nil, "must be installed"},
+		{"invalid_version", &dpkgPackage{Version: "1:2.63", Installed: true}, "Unable to compare"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			packages := map[string]*dpkgPackage{}
+			if tc.snapd != nil {
+				packages["snapd"] = tc.snapd
+			}
+			err := checkSnapdPackage(packages)
+			if tc.expectedErr != "" {
+				asserter.AssertErrContains(err, tc.expectedErr)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+		})
+	}
+}
+
+// TestValidateImageTree tests the validation of image trees against the snap list
+func TestValidateImageTree(t *testing.T) {
+	noble := dpkgStatusEntry("dpkg", "1.22.6", "amd64", true) + dpkgStatusEntry("snapd", "2.63+24.04", "amd64", true)
+	testCases := []struct {
+		name         string
+		osRelease    string
+		status       string
+		series       string
+		arch         string
+		preseed      bool
+		packages     []string
+		expectedErr  string
+		expectedArch string
+		expectedSer  string
+	}{
+		{"valid", ubuntuOSRelease, noble, "noble", "amd64", true, nil, "", "amd64", "noble"},
+		{"detected", ubuntuOSRelease, noble, "", "", true, nil, "", "amd64", "noble"},
+		{"ubuntu_derivative", "ID=operese\nID_LIKE=\"ubuntu debian\"\nVERSION_CODENAME=noble\n", noble,
+			"noble", "amd64", false, nil, "", "amd64", "noble"},
+		{"missing_os_release", "", noble, "noble", "amd64", false, nil, "Error reading os-release of the image tree", "", ""},
+		{"not_ubuntu", "ID=debian\nVERSION_CODENAME=bookworm\n", noble, "", "", false, nil, "is not an Ubuntu root filesystem", "", ""},
+		{"no_codename", "ID=ubuntu\n", noble, "", "amd64", false, nil, "No series given in the snap list", "", ""},
+		{"series_mismatch", ubuntuOSRelease, noble, "jammy", "amd64", false, nil,
+			"The snap list is for series jammy but the image tree is noble", "", ""},
+		{"missing_dpkg_status", ubuntuOSRelease, "", "noble", "amd64", false, nil,
+			"is not an Ubuntu classic root filesystem: Error opening the dpkg database", "", ""},
+		{"arch_mismatch", ubuntuOSRelease, noble, "noble", "arm64", false, nil,
+			"The snap list is for architecture arm64 but the image tree is amd64", "", ""},
+		{"snapd_too_old", ubuntuOSRelease, dpkgStatusEntry("dpkg", "1.22.6", "amd64", true) +
+			dpkgStatusEntry("snapd", "2.40", "amd64", true), "noble", "amd64", true, nil, "is too old to preseed it", "", ""},
+		{"snapd_too_old_without_preseed", ubuntuOSRelease, dpkgStatusEntry("dpkg", "1.22.6", "amd64", true) +
+			dpkgStatusEntry("snapd", "2.40", "amd64", true), "noble", "amd64", false, nil, "", "amd64", "noble"},
+		{"snapd_missing", ubuntuOSRelease, dpkgStatusEntry("dpkg", "1.22.6", "amd64", true),
+			"noble", "amd64", true, nil, "must be installed in the image tree", "", ""},
+		{"snapd_from_archive", ubuntuOSRelease, dpkgStatusEntry("dpkg", "1.22.6", "amd64", true),
+			"noble", "amd64", true, []string{"snapd"}, "", "amd64", "noble"},
+		{"snapd_local_upgrade", ubuntuOSRelease, dpkgStatusEntry("dpkg", "1.22.6", "amd64", true) +
+			dpkgStatusEntry("snapd", "2.40", "amd64", true), "noble", "amd64", true, []string{"snapd.deb"}, "", "amd64", "noble"},
+		{"snapd_local_too_old", ubuntuOSRelease, noble, "noble", "amd64", true, []string{"old/snapd.deb"},
+			"The snapd package installed in the image tree (2.40) is too old", "", ""},
+	}
+	mockDpkgDeb(t, map[string]string{
+		"snapd.deb":     "Package: snapd\nVersion: 2.66\n",
+		"old/snapd.deb": "Package: snapd\nVersion: 2.40\n",
+	})
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			imagePath := t.TempDir()
+			if tc.osRelease != "" {
+				writeTestTreeFile(t, imagePath, filepath.Join("etc", "os-release"), tc.osRelease)
+			}
+			if tc.status != "" {
+				writeDpkgStatus(t, imagePath, tc.status)
+			}
+
+			classicStateMachine := &ClassicStateMachine{
+				Args:    commands.ClassicArgs{ImagePath: imagePath},
+				Preseed: tc.preseed,
+			}
+			classicStateMachine.Packages = tc.packages
+			classicStateMachine.series = tc.series
+			classicStateMachine.ImageDef.Series = tc.series
+			classicStateMachine.ImageDef.Architecture = tc.arch
+
+			err := classicStateMachine.validateImageTree()
+			if tc.expectedErr != "" {
+				asserter.AssertErrContains(err, tc.expectedErr)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.expectedArch, classicStateMachine.ImageDef.Architecture)
+			asserter.AssertEqual(tc.expectedSer, classicStateMachine.series)
+			if tc.arch == "" {
+				asserter.AssertEqual(tc.expectedArch, classicStateMachine.DetectedArchitecture)
+			}
+			if tc.series == "" {
+				asserter.AssertEqual(tc.expectedSer, classicStateMachine.DetectedSeries)
+			}
+		})
+	}
+
+	t.Run("not_a_directory", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		classicStateMachine := &ClassicStateMachine{
+			Args: commands.ClassicArgs{ImagePath: filepath.Join(t.TempDir(), "missing")},
+		}
+		asserter.AssertErrContains(classicStateMachine.validateImageTree(), "is not a directory")
+	})
+}
@@ -0,0 +1,137 @@
+package statemachine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// lockFileSuffix names the advisory lock file taken next to the image tree
+// for the duration of a build. It is kept out of the tree so that it is
+// neither part of the image nor of the audit of the build.
+const lockFileSuffix = ".cedar.lock"
+
+// define some functions and variables that can be mocked by test cases
+var syscallFlock = syscall.Flock
+var lockPollInterval = 500 * time.Millisecond
+
+// errTreeLocked is returned when the lock is held by another process
+var errTreeLocked = errors.New("image tree is locked")
+
+// lockTree takes an exclusive lock on the image tree so that two cedar
+// invocations never work on the same tree at the same time. If the lock is
+// already held, it is retried until the wait duration expires.
+func (stateMachine *StateMachine) lockTree(imagePath string, wait time.Duration) error {
+	lockPath, err := sideFilePath(imagePath, lockFileSuffix)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(wait)
+	for {
+		lockFile, err := tryLockFile(lockPath)
+		if err == nil {
+			stateMachine.lockFile = lockFile
+			return nil
+		}
+		if !errors.Is(err, errTreeLocked) {
+			return err
+		}
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("Image tree %s is used by another cedar process (PID %s). "+
+				"Use --wait to wait for it to finish.", imagePath, lockHolder(lockPath))
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// unlockTree removes the lock file and releases the lock, if taken
+func (stateMachine *StateMachine) unlockTree() error {
+	if stateMachine.lockFile == nil {
+		return nil
+	}
+	lockFile := stateMachine.lockFile
+	stateMachine.lockFile = nil
+
+	return releaseLockFile(lockFile)
+}
+
+// releaseLockFile removes the lock file and releases the lock
+func releaseLockFile(lockFile *os.File) error {
+	// remove the file before releasing the lock, so a process waiting on it
+	// notices it locked a stale file and retries with a new one
+	err := osRemove(lockFile.Name())
+	closeErr := lockFile.Close()
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error removing lock file: %s", err.Error())
+	}
+	if closeErr != nil {
+		return fmt.Errorf("Error releasing lock file: %s", closeErr.Error())
+	}
+	return nil
+}
+
+// tryLockFile takes a non-blocking exclusive lock on the given file, creating
+// it if needed, and records the PID of the current process in it
+func tryLockFile(lockPath string) (*os.File, error) {
+	lockFile, err := osOpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening lock file: %s", err.Error())
+	}
+
+	err = syscallFlock(int(lockFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		lockFile.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, errTreeLocked
+		}
+		return nil, fmt.Errorf("Error locking %s: %s", lockPath, err.Error())
+	}
+
+	// the previous holder may have removed the file between our open and
+	// lock calls, in which case we locked a file nobody else will see
+	if !sameFile(lockFile, lockPath) {
+		lockFile.Close()
+		return nil, errTreeLocked
+	}
+
+	if err := lockFile.Truncate(0); err != nil {
+		lockFile.Close()
+		return nil, fmt.Errorf("Error truncating lock file: %s", err.Error())
+	}
+	if _, err := fmt.Fprintf(lockFile, "%d\n", os.Getpid()); err != nil {
+		lockFile.Close()
+		return nil, fmt.Errorf("Error writing to lock file: %s", err.Error())
+	}
+
+	return lockFile, nil
+}
+
+// sameFile checks that the opened file is still the one found at path
+func sameFile(f *os.File, path string) bool {
+	openedInfo, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	pathInfo, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(openedInfo, pathInfo)
+}
+
+// lockHolder returns the PID recorded in the lock file
+func lockHolder(lockPath string) string {
+	content, err := osReadFile(lockPath)
+	if err != nil {
+		return "unknown"
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return "unknown"
+	}
+	return strconv.Itoa(pid)
+}
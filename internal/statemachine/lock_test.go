@@ -0,0 +1,164 @@
+package statemachine
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/snapcore/snapd/osutil"
+
+	"operese/cedar/internal/helper"
+)
+
+// TestTryLockFile tests that the lock is exclusive and records the PID of its holder
+func TestTryLockFile(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	lockPath := filepath.Join(t.TempDir(), lockFileSuffix)
+
+	lockFile, err := tryLockFile(lockPath)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(strconv.Itoa(os.Getpid()), lockHolder(lockPath))
+
+	_, err = tryLockFile(lockPath)
+	if !errors.Is(err, errTreeLocked) {
+		t.Errorf("Expected the tree to be locked, got %v", err)
+	}
+
+	asserter.AssertErrNil(releaseLockFile(lockFile), true)
+	if osutil.FileExists(lockPath) {
+		t.Errorf("Lock file %s was not removed", lockPath)
+	}
+
+	lockFile, err = tryLockFile(lockPath)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertErrNil(releaseLockFile(lockFile), true)
+}
+
+// TestTryLockFileStale tests that a lock file removed by its previous holder
+// between the open and the lock is not considered locked by us
+func TestTryLockFileStale(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	lockPath := filepath.Join(t.TempDir(), lockFileSuffix)
+
+	syscallFlock = func(fd int, how int) error {
+		// the previous holder releases the lock
+		if err := os.Remove(lockPath); err != nil {
+			return err
+		}
+		return syscall.Flock(fd, how)
+	}
+	t.Cleanup(func() { syscallFlock = syscall.Flock })
+
+	_, err := tryLockFile(lockPath)
+	if !errors.Is(err, errTreeLocked) {
+		t.Errorf("Expected a stale lock file to be retried, got %v", err)
+	}
+
+	// the next attempt takes a new file
+	syscallFlock = syscall.Flock
+	lockFile, err := tryLockFile(lockPath)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertErrNil(releaseLockFile(lockFile), true)
+}
+
+// TestTryLockFileErrors tests the errors of the lock other than a lock held elsewhere
+func TestTryLockFileErrors(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	lockPath := filepath.Join(t.TempDir(), lockFileSuffix)
+
+	syscallFlock = func(int, int) error { return syscall.EBADF }
+	t.Cleanup(func() { syscallFlock = syscall.Flock })
+	_, err := tryLockFile(lockPath)
+	asserter.AssertErrContains(err, "Error locking")
+	if errors.Is(err, errTreeLocked) {
+		t.Errorf("Unexpected errTreeLocked for a failed flock")
+	}
+
+	_, err = tryLockFile(filepath.Join(lockPath, "missing", lockFileSuffix))
+	asserter.AssertErrContains(err, "Error opening lock file")
+}
+
+// TestReleaseLockFile tests that the lock file is removed before the lock is released
+func TestReleaseLockFile(t *testing.T) {
+	testCases := []struct {
+		name        string
+		removeErr   error
+		expectedErr string
+	}{
+		{"success", nil, ""},
+		{"already_removed", os.ErrNotExist, ""},
+		{"remove_fails", os.ErrPermission, "Error removing lock file"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			lockPath := filepath.Join(t.TempDir(), lockFileSuffix)
+			lockFile, err := tryLockFile(lockPath)
+			asserter.AssertErrNil(err, true)
+
+			locked := true
+			osRemove = func(path string) error {
+				// the lock must still be held when the file is removed
+				_, err := tryLockFile(path)
+				locked = errors.Is(err, errTreeLocked)
+				if tc.removeErr != nil {
+					return tc.removeErr
+				}
+				return os.Remove(path)
+			}
+			t.Cleanup(func() { osRemove = os.Remove })
+
+			err = releaseLockFile(lockFile)
+			if tc.expectedErr == "" {
+				asserter.AssertErrNil(err, true)
+			} else {
+				asserter.AssertErrContains(err, tc.expectedErr)
+			}
+			if !locked {
+				t.Errorf("The lock was released before the lock file was removed")
+			}
+		})
+	}
+}
+
+// TestLockTreeWait tests that a build gives up once the wait expires, and
+// takes the lock once it is released
+func TestLockTreeWait(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	imagePath := t.TempDir()
+	lockPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { lockPollInterval = 500 * time.Millisecond })
+
+	holder, err := tryLockFile(imagePath + lockFileSuffix)
+	asserter.AssertErrNil(err, true)
+
+	var stateMachine StateMachine
+	err = stateMachine.lockTree(imagePath, 30*time.Millisecond)
+	asserter.AssertErrContains(err, "is used by another cedar process (PID "+strconv.Itoa(os.Getpid())+")")
+
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		_ = releaseLockFile(holder)
+	}()
+	asserter.AssertErrNil(stateMachine.lockTree(imagePath, 5*time.Second), true)
+	// the lock is taken next to the tree, leaving the tree untouched
+	entries, err := os.ReadDir(imagePath)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(0, len(entries))
+	asserter.AssertErrNil(stateMachine.unlockTree(), true)
+}
+
+// TestLockHolder tests that a garbled lock file does not give a PID
+func TestLockHolder(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	lockPath := filepath.Join(t.TempDir(), lockFileSuffix)
+	asserter.AssertEqual("unknown", lockHolder(lockPath))
+	asserter.AssertErrNil(os.WriteFile(lockPath, []byte("garbage\n"), 0644), true)
+	asserter.AssertEqual("unknown", lockHolder(lockPath))
+	asserter.AssertErrNil(os.WriteFile(lockPath, []byte("42\n"), 0644), true)
+	asserter.AssertEqual("42", lockHolder(lockPath))
+}
@@ -6,6 +6,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"syscall"
 )
 
 type mountPoint struct {
@@ -16,12 +17,65 @@ type mountPoint struct {
 	typ      string
 	opts     []string
 	bind     bool
+	rbind    bool // recursive bind mount
+}
+
+// chrootMountPoints returns the mountpoints needed to run commands in the image
+// chroot. Pseudo filesystems cannot be mounted in a user namespace, so in
+// rootless mode the ones of the host are bind mounted instead.
+func chrootMountPoints(imagePath string, rootless bool) []*mountPoint {
+	if rootless {
+		mountPoints := []*mountPoint{}
+		for _, relpath := range []string{"/dev", "/proc", "/sys/kernel/security", "/sys/fs/cgroup"} {
+			mountPoints = append(mountPoints, &mountPoint{
+				src:      relpath,
+				basePath: imagePath,
+				relpath:  relpath,
+				rbind:    true,
+			})
+		}
+		return mountPoints
+	}
+
+	return []*mountPoint{
+		{
+			src:      "devtmpfs-build",
+			basePath: imagePath,
+			relpath:  "/dev",
+			typ:      "devtmpfs",
+		},
+		{
+			src:      "devpts-build",
+			basePath: imagePath,
+			relpath:  "/dev/pts",
+			typ:      "devpts",
+			opts:     []string{"nodev", "nosuid"},
+		},
+		{
+			src:      "proc-build",
+			basePath: imagePath,
+			relpath:  "/proc",
+			typ:      "proc",
+		},
+		{
+			src:      "none",
+			basePath: imagePath,
+			relpath:  "/sys/kernel/security",
+			typ:      "securityfs",
+		},
+		{
+			src:      "none",
+			basePath: imagePath,
+			relpath:  "/sys/fs/cgroup",
+			typ:      "cgroup2",
+		},
+	}
 }
 
 // getMountCmd returns mount/umount commands to mount the given mountpoint
 // If the mountpoint does not exist, it will be created.
 func (m *mountPoint) getMountCmd() (mountCmds, umountCmds []*exec.Cmd, err error) {
-	if m.bind && len(m.typ) > 0 {
+	if (m.bind || m.rbind) && len(m.typ) > 0 {
 		return nil, nil, fmt.Errorf("invalid mount arguments. Cannot use --bind and -t at the same time.")
 	}
 
@@ -36,6 +90,10 @@ func (m *mountPoint) getMountCmd() (mountCmds, umountCmds []*exec.Cmd, err error
 		mountCmd.Args = append(mountCmd.Args, "--bind")
 	}
 
+	if m.rbind {
+		mountCmd.Args = append(mountCmd.Args, "--rbind")
+	}
+
 	mountCmd.Args = append(mountCmd.Args, m.src)
 	if len(m.opts) > 0 {
 		mountCmd.Args = append(mountCmd.Args, "-o", strings.Join(m.opts, ","))
@@ -62,6 +120,35 @@ func getUnmountCmd(targetPath string) []*exec.Cmd {
 	}
 }
 
+// namespacedCmd wraps the given commands in a single shell invocation executed
+// in a new private mount namespace. Mounts done by these commands are never
+// propagated to the host and are released by the kernel as soon as the last
+// process of the namespace exits, even if cedar is killed.
+func namespacedCmd(cmds []*exec.Cmd) *exec.Cmd {
+	script := []string{"set -e"}
+	for _, cmd := range cmds {
+		script = append(script, shellJoin(cmd.Args))
+	}
+
+	nsCmd := execCommand("sh", "-c", strings.Join(script, "\n"))
+	// With CLONE_NEWNS, the runtime also remounts / as recursively private
+	// in the child before executing it
+	nsCmd.SysProcAttr = &syscall.SysProcAttr{
+		Unshareflags: syscall.CLONE_NEWNS,
+	}
+
+	return nsCmd
+}
+
+// shellJoin quotes every argument so the result can safely be interpreted by sh
+func shellJoin(args []string) string {
+	quoted := make([]string, 0, len(args))
+	for _, arg := range args {
+		quoted = append(quoted, "'"+strings.ReplaceAll(arg, "'", `'\''`)+"'")
+	}
+	return strings.Join(quoted, " ")
+}
+
 // teardownMount executed teardown commands after making sure every mountpoints matching the given path
 // are listed and will be properly unmounted
 func teardownMount(path string, mountPoints []*mountPoint, teardownCmds []*exec.Cmd, err error, debug bool) error {
@@ -147,7 +234,7 @@ func parseMounts(procMount string, path string) ([]*mountPoint, error) {
 		fields := strings.Fields(line)
 		mountPath := fields[1]
 
-		if (len(path) != 0 && !strings.HasPrefix(mountPath, path)) || strings.Compare(mountPath, path) == 0 {
+		if (len(path) != 0 && !isSubPath(mountPath, path)) || strings.Compare(mountPath, path) == 0 {
 			continue
 		}
 
@@ -162,3 +249,9 @@ func parseMounts(procMount string, path string) ([]*mountPoint, error) {
 
 	return mountPoints, nil
 }
+
+// isSubPath checks whether path is located in the parent directory, so that
+// "/foo" is not considered a parent of "/foobar"
+func isSubPath(path, parent string) bool {
+	return path == parent || strings.HasPrefix(path, strings.TrimSuffix(parent, "/")+"/")
+}
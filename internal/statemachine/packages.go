@@ -0,0 +1,169 @@
+package statemachine
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/strutil"
+)
+
+// debsDirInChroot is where local .deb packages are copied to be installed
+var debsDirInChroot = filepath.Join("var", "cache", "cedar-debs")
+
+// isLocalDeb returns whether an entry of the packages section is a local
+// .deb file rather than the name of a package to get from the archive
+func isLocalDeb(pkg string) bool {
+	return strings.HasSuffix(pkg, ".deb")
+}
+
+// resolveSnapListPath returns the path of a file referenced in the snap list.
+// Relative paths are relative to the directory of the snap list.
+func (classicStateMachine *ClassicStateMachine) resolveSnapListPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(classicStateMachine.Args.SnapList), path)
+}
+
+// validatePackages makes sure the local .deb packages of the snap list exist,
+// match their declared checksums and have different file names, as they are
+// all copied to the same directory of the image tree
+func (classicStateMachine *ClassicStateMachine) validatePackages() error {
+	checksums := classicStateMachine.ImageDef.PackageChecksums
+	for pkg := range checksums {
+		if !isLocalDeb(pkg) || !strutil.ListContains(classicStateMachine.Packages, pkg) {
+			return fmt.Errorf("Checksum given for %s, which is not a local package of the snap list", pkg)
+		}
+	}
+	fileNames := make(map[string]string)
+	for _, pkg := range classicStateMachine.Packages {
+		if !isLocalDeb(pkg) {
+			continue
+		}
+		debPath := classicStateMachine.resolveSnapListPath(pkg)
+		if other, found := fileNames[filepath.Base(debPath)]; found {
+			return fmt.Errorf("Packages %s and %s listed in the snap list have the same file name", other, pkg)
+		}
+		fileNames[filepath.Base(debPath)] = pkg
+		if !osutil.FileExists(debPath) {
+			return fmt.Errorf("Package file %s listed in the snap list does not exist", debPath)
+		}
+		if checksum, found := checksums[pkg]; found {
+			if err := verifySnapListFile(debPath, checksum); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// packageOverrides returns the versions of the packages that will be
+// installed in the image tree. The name and version of local .deb packages
+// are read from their control file, as their file name may not follow the
+// Debian conventions. The versions of the packages to get from the archive
+// are unknown and empty.
+func (classicStateMachine *ClassicStateMachine) packageOverrides() (map[string]string, error) {
+	overrides := make(map[string]string)
+	for _, pkg := range classicStateMachine.Packages {
+		if !isLocalDeb(pkg) {
+			overrides[pkg] = ""
+			continue
+		}
+		debPath := classicStateMachine.resolveSnapListPath(pkg)
+		name, version, err := debNameVersion(debPath)
+		if err != nil {
+			return nil, err
+		}
+		overrides[name] = version
+	}
+	return overrides, nil
+}
+
+// debNameVersion reads the name and the version of a .deb package
+func debNameVersion(debPath string) (name string, version string, err error) {
+	output, err := execCommand("dpkg-deb", "--field", debPath, "Package", "Version").Output()
+	if err != nil {
+		return "", "", fmt.Errorf("Error reading the control file of package %s: %s", debPath, err.Error())
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		switch key {
+		case "Package":
+			name = strings.TrimSpace(value)
+		case "Version":
+			version = strings.TrimSpace(value)
+		}
+	}
+	if name == "" || version == "" {
+		return "", "", fmt.Errorf("Package %s has no name or version in its control file", debPath)
+	}
+	return name, version, nil
+}
+
+var installPackagesState = stateFunc{"install_packages", (*StateMachine).installPackages}
+
+// installPackages installs the packages of the snap list in the image tree
+func (stateMachine *StateMachine) installPackages() (err error) {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+	imagePath := classicStateMachine.Args.ImagePath
+
+	debsDir := filepath.Join(imagePath, debsDirInChroot)
+	if err := osMkdirAll(debsDir, 0755); err != nil {
+		return fmt.Errorf("Error creating directory for the packages: %s", err.Error())
+	}
+	defer func() {
+		if removeErr := osRemoveAll(debsDir); removeErr != nil {
+			err = joinRestoreErr(err, fmt.Errorf("Error removing %s: %s", debsDir, removeErr.Error()))
+		}
+	}()
+
+	debs := make([]string, 0)
+	names := make([]string, 0)
+	for _, pkg := range stateMachine.Packages {
+		if !isLocalDeb(pkg) {
+			names = append(names, pkg)
+			continue
+		}
+		debPath := classicStateMachine.resolveSnapListPath(pkg)
+		debInChroot := filepath.Join(debsDirInChroot, filepath.Base(debPath))
+		if err := osutilCopyFile(debPath, filepath.Join(imagePath, debInChroot), osutil.CopyFlagDefault); err != nil {
+			return fmt.Errorf("Error copying package %s to the image tree: %s", debPath, err.Error())
+		}
+		debs = append(debs, "/"+debInChroot)
+	}
+
+	restore, err := classicStateMachine.guardChroot()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = restore(err)
+	}()
+
+	var installCmds []*exec.Cmd
+	if len(names) == 0 {
+		// local packages can be installed without reaching the archive
+		installCmds = append(installCmds,
+			execCommand("chroot", append([]string{imagePath, "dpkg", "--install"}, debs...)...),
+		)
+	} else {
+		installCmds = append(installCmds,
+			execCommand("chroot", imagePath, "apt-get", "update"),
+			// apt needs a path to tell local packages from package names
+			execCommand("chroot", append([]string{imagePath, "apt-get", "install", "--assume-yes",
+				"--no-install-recommends"}, append(names, debs...)...)...),
+		)
+	}
+
+	err = classicStateMachine.runInChroot(installCmds, []string{"DEBIAN_FRONTEND=noninteractive"})
+	if err != nil {
+		return fmt.Errorf("Error installing packages: %s", err.Error())
+	}
+	return nil
+}
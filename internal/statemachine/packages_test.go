@@ -0,0 +1,148 @@
+package statemachine
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"operese/cedar/internal/commands"
+	"operese/cedar/internal/helper"
+	"operese/cedar/internal/snaplist"
+)
+
+// TestResolveSnapListPath tests that relative paths are relative to the snap list
+func TestResolveSnapListPath(t *testing.T) {
+	classicStateMachine := &ClassicStateMachine{
+		Args: commands.ClassicArgs{SnapList: "/home/builder/images/snaplist.yaml"},
+	}
+	testCases := []struct {
+		path     string
+		expected string
+	}{
+		{"hook.sh", "/home/builder/images/hook.sh"},
+		{"debs/tool_1.0_amd64.deb", "/home/builder/images/debs/tool_1.0_amd64.deb"},
+		{"../shared/motd", "/home/builder/shared/motd"},
+		{"/opt/hooks/hook.sh", "/opt/hooks/hook.sh"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			asserter.AssertEqual(tc.expected, classicStateMachine.resolveSnapListPath(tc.path))
+		})
+	}
+}
+
+// mockDpkgDeb makes dpkg-deb print the given control fields of the packages
+func mockDpkgDeb(t *testing.T, controls map[string]string) {
+	t.Helper()
+	execCommand = func(name string, arg ...string) *exec.Cmd {
+		if name != "dpkg-deb" {
+			return exec.Command(name, arg...)
+		}
+		control, found := controls[arg[1]]
+		if !found {
+			return exec.Command("sh", "-c", "echo 'not a Debian format archive' >&2; exit 2")
+		}
+		return exec.Command("printf", "%s", control)
+	}
+	t.Cleanup(func() { execCommand = exec.Command })
+}
+
+// TestPackageOverrides tests that the name and version of local packages
+// are read from the packages themselves, whatever their file name
+func TestPackageOverrides(t *testing.T) {
+	mockDpkgDeb(t, map[string]string{
+		"/home/builder/images/debs/tool_1.2-3_amd64.deb": "Package: tool\nVersion: 1.2-3\n",
+		"/srv/debs/lib_1%3a2.0_arm64.deb":                "Package: lib\nVersion: 1:2.0\n",
+		"/home/builder/images/snapd.deb":                 "Package: snapd\nVersion: 2.63+24.04\n",
+		"/home/builder/images/incomplete.deb":            "Package: incomplete\n",
+	})
+	testCases := []struct {
+		name        string
+		packages    []string
+		expected    map[string]string
+		expectedErr string
+	}{
+		{"packages", []string{"debs/tool_1.2-3_amd64.deb", "/srv/debs/lib_1%3a2.0_arm64.deb", "snapd.deb", "curl"},
+			map[string]string{"tool": "1.2-3", "lib": "1:2.0", "snapd": "2.63+24.04", "curl": ""}, ""},
+		{"not_a_package", []string{"curl", "broken.deb"}, nil, "Error reading the control file of package /home/builder/images/broken.deb"},
+		{"no_version", []string{"incomplete.deb"}, nil, "has no name or version in its control file"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			classicStateMachine := &ClassicStateMachine{
+				Args: commands.ClassicArgs{SnapList: "/home/builder/images/snaplist.yaml"},
+			}
+			classicStateMachine.Packages = tc.packages
+			overrides, err := classicStateMachine.packageOverrides()
+			if tc.expectedErr != "" {
+				asserter.AssertErrContains(err, tc.expectedErr)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.expected, overrides)
+		})
+	}
+}
+
+// TestValidatePackages tests that local packages must exist and match their
+// declared checksums
+func TestValidatePackages(t *testing.T) {
+	snapListDir := t.TempDir()
+	err := os.WriteFile(filepath.Join(snapListDir, "tool.deb"), []byte("tool"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(filepath.Join(snapListDir, "other"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(snapListDir, "other", "tool.deb"), []byte("other tool"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toolSum, err := helper.HashFile(filepath.Join(snapListDir, "tool.deb"), helper.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name        string
+		packages    []string
+		checksums   map[string]string
+		expectedErr string
+	}{
+		{"no_checksum", []string{"tool.deb", "curl"}, nil, ""},
+		{"checksum", []string{"tool.deb"}, map[string]string{"tool.deb": "sha256:" + toolSum}, ""},
+		{"bare_checksum", []string{"tool.deb"}, map[string]string{"tool.deb": toolSum}, ""},
+		{"missing", []string{"missing.deb"}, nil, "does not exist"},
+		{"same_file_name", []string{"tool.deb", "curl", "other/tool.deb"}, nil,
+			"Packages tool.deb and other/tool.deb listed in the snap list have the same file name"},
+		{"listed_twice", []string{"tool.deb", "tool.deb"}, nil, "have the same file name"},
+		{"mismatch", []string{"tool.deb"}, map[string]string{"tool.deb": "sha256:" + strings.Repeat("0", 64)},
+			helper.ErrChecksumMismatch.Error()},
+		{"invalid_checksum", []string{"tool.deb"}, map[string]string{"tool.deb": "md5:abcd"}, "Invalid checksum for"},
+		{"archive_package", []string{"curl"}, map[string]string{"curl": toolSum},
+			"Checksum given for curl, which is not a local package of the snap list"},
+		{"unlisted_package", []string{"tool.deb"}, map[string]string{"other.deb": toolSum},
+			"Checksum given for other.deb, which is not a local package of the snap list"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			classicStateMachine := &ClassicStateMachine{
+				Args:     commands.ClassicArgs{SnapList: filepath.Join(snapListDir, "snaplist.yaml")},
+				ImageDef: snaplist.SnapList{PackageChecksums: tc.checksums},
+			}
+			classicStateMachine.Packages = tc.packages
+			err := classicStateMachine.validatePackages()
+			if tc.expectedErr != "" {
+				asserter.AssertErrContains(err, tc.expectedErr)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+		})
+	}
+}
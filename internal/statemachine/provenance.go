@@ -0,0 +1,286 @@
+package statemachine
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+
+	"operese/cedar/internal/helper"
+)
+
+const (
+	inTotoStatementType     = "https://in-toto.io/Statement/v1"
+	inTotoPayloadType       = "application/vnd.in-toto+json"
+	slsaProvenanceType      = "https://slsa.dev/provenance/v1"
+	provenanceBuildType     = "urn:cedar:build-type:classic:v1"
+	provenanceBuilderID     = "urn:cedar:builder"
+	provenanceSeedSubject   = "var/lib/snapd/seed"
+	provenanceSnapURIPrefix = "snap:"
+)
+
+// inTotoStatement is an in-toto statement with a SLSA provenance predicate
+type inTotoStatement struct {
+	Type          string               `json:"_type"`
+	Subject       []resourceDescriptor `json:"subject"`
+	PredicateType string               `json:"predicateType"`
+	Predicate     slsaProvenance       `json:"predicate"`
+}
+
+// resourceDescriptor describes an artefact by its digests
+type resourceDescriptor struct {
+	Name        string            `json:"name,omitempty"`
+	URI         string            `json:"uri,omitempty"`
+	Digest      map[string]string `json:"digest"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type slsaProvenance struct {
+	BuildDefinition slsaBuildDefinition `json:"buildDefinition"`
+	RunDetails      slsaRunDetails      `json:"runDetails"`
+}
+
+type slsaBuildDefinition struct {
+	BuildType            string                   `json:"buildType"`
+	ExternalParameters   provenanceExternalParams `json:"externalParameters"`
+	InternalParameters   provenanceInternalParams `json:"internalParameters"`
+	ResolvedDependencies []resourceDescriptor     `json:"resolvedDependencies"`
+}
+
+// provenanceExternalParams are the inputs of the build chosen by its user
+type provenanceExternalParams struct {
+	CommandLine []string           `json:"commandLine"`
+	SnapList    resourceDescriptor `json:"snapList"`
+}
+
+// provenanceInternalParams are the values of the build cedar resolved itself
+type provenanceInternalParams struct {
+	Architecture string `json:"architecture"`
+	Series       string `json:"series"`
+}
+
+type slsaRunDetails struct {
+	Builder  slsaBuilder  `json:"builder"`
+	Metadata slsaMetadata `json:"metadata"`
+}
+
+type slsaBuilder struct {
+	ID      string            `json:"id"`
+	Version map[string]string `json:"version"`
+}
+
+type slsaMetadata struct {
+	InvocationID string `json:"invocationId"`
+	StartedOn    string `json:"startedOn"`
+	FinishedOn   string `json:"finishedOn"`
+}
+
+// dsseEnvelope is a signed in-toto statement
+type dsseEnvelope struct {
+	PayloadType string          `json:"payloadType"`
+	Payload     string          `json:"payload"`
+	Signatures  []dsseSignature `json:"signatures"`
+}
+
+type dsseSignature struct {
+	KeyID string `json:"keyid"`
+	Sig   string `json:"sig"`
+}
+
+// loadProvenanceKey reads the PKCS #8 PEM private key used to sign the provenance
+func (classicStateMachine *ClassicStateMachine) loadProvenanceKey() error {
+	if classicStateMachine.ProvenanceKeyPath == "" {
+		return nil
+	}
+	if classicStateMachine.ProvenancePath == "" {
+		return fmt.Errorf("--provenance-key can only be used with --provenance")
+	}
+
+	content, err := osReadFile(classicStateMachine.ProvenanceKeyPath)
+	if err != nil {
+		return fmt.Errorf("Error reading provenance key: %s", err.Error())
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return fmt.Errorf("Error reading provenance key: %s is not a PEM file", classicStateMachine.ProvenanceKeyPath)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("Error parsing provenance key: %s", err.Error())
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("Error parsing provenance key: unsupported key type %T", key)
+	}
+	classicStateMachine.provenanceSigner = signer
+	return nil
+}
+
+var writeProvenanceState = stateFunc{"write_provenance", (*StateMachine).writeProvenance}
+
+// writeProvenance writes the in-toto provenance statement of the build,
+// signed in a DSSE envelope if a key was given
+func (stateMachine *StateMachine) writeProvenance() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+	statement, err := classicStateMachine.provenanceStatement()
+	if err != nil {
+		return err
+	}
+
+	if classicStateMachine.provenanceSigner == nil {
+		if err := writeJSONFile(classicStateMachine.ProvenancePath, statement); err != nil {
+			return fmt.Errorf("Error writing the provenance: %s", err.Error())
+		}
+		return nil
+	}
+
+	payload, err := json.Marshal(statement)
+	if err != nil {
+		return fmt.Errorf("Error encoding the provenance: %s", err.Error())
+	}
+	envelope, err := signDSSE(classicStateMachine.provenanceSigner, inTotoPayloadType, payload)
+	if err != nil {
+		return fmt.Errorf("Error signing the provenance: %s", err.Error())
+	}
+	if err := writeJSONFile(classicStateMachine.ProvenancePath, envelope); err != nil {
+		return fmt.Errorf("Error writing the provenance: %s", err.Error())
+	}
+	return nil
+}
+
+// provenanceStatement describes the build
+func (classicStateMachine *ClassicStateMachine) provenanceStatement() (*inTotoStatement, error) {
+	imagePath := classicStateMachine.Args.ImagePath
+	// the snaps are hashed along with the dependencies, so their digests are
+	// reused for the one of the seed
+	dependencies, err := classicStateMachine.provenanceDependencies()
+	if err != nil {
+		return nil, err
+	}
+	seedDigest, err := helper.HashDirReusing(filepath.Join(imagePath, provenanceSeedSubject), helper.SHA256,
+		classicStateMachine.seedDigests().sha256Digests())
+	if err != nil {
+		return nil, fmt.Errorf("Error hashing the seed: %s", err.Error())
+	}
+	snapListDigest, err := helper.HashFile(classicStateMachine.Args.SnapList, helper.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	return &inTotoStatement{
+		Type: inTotoStatementType,
+		Subject: []resourceDescriptor{{
+			Name:   provenanceSeedSubject,
+			Digest: map[string]string{"sha256": seedDigest},
+		}},
+		PredicateType: slsaProvenanceType,
+		Predicate: slsaProvenance{
+			BuildDefinition: slsaBuildDefinition{
+				BuildType: provenanceBuildType,
+				ExternalParameters: provenanceExternalParams{
+					CommandLine: classicStateMachine.CommandLine,
+					SnapList: resourceDescriptor{
+						Name:   classicStateMachine.Args.SnapList,
+						Digest: map[string]string{"sha256": snapListDigest},
+					},
+				},
+				InternalParameters: provenanceInternalParams{
+					Architecture: classicStateMachine.ImageDef.Architecture,
+					Series:       classicStateMachine.series,
+				},
+				ResolvedDependencies: dependencies,
+			},
+			RunDetails: slsaRunDetails{
+				Builder: slsaBuilder{
+					ID:      provenanceBuilderID,
+					Version: map[string]string{"cedar": classicStateMachine.Version},
+				},
+				Metadata: slsaMetadata{
+					InvocationID: uuid.NewString(),
+					StartedOn:    classicStateMachine.started.UTC().Format(time.RFC3339),
+					FinishedOn:   time.Now().UTC().Format(time.RFC3339),
+				},
+			},
+		},
+	}, nil
+}
+
+// provenanceDependencies describes the seeded snaps by their digests
+func (classicStateMachine *ClassicStateMachine) provenanceDependencies() ([]resourceDescriptor, error) {
+	digests := classicStateMachine.seedDigests()
+	seedSnaps, err := getSeedSnaps(classicStateMachine.Args.ImagePath, digests)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the seed: %s", err.Error())
+	}
+
+	dependencies := make([]resourceDescriptor, 0, len(seedSnaps))
+	for _, sn := range seedSnaps {
+		snapDigests, err := digests.get(sn.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		annotations := map[string]string{"revision": sn.SideInfo.Revision.String()}
+		if sn.Channel != "" {
+			annotations["channel"] = sn.Channel
+		}
+		dependencies = append(dependencies, resourceDescriptor{
+			Name: sn.SnapName(),
+			URI:  provenanceSnapURIPrefix + sn.SnapName(),
+			Digest: map[string]string{
+				"sha256":   snapDigests.sha256,
+				"sha3_384": snapDigests.sha3_384,
+			},
+			Annotations: annotations,
+		})
+	}
+
+	sort.Slice(dependencies, func(i, j int) bool { return dependencies[i].Name < dependencies[j].Name })
+	return dependencies, nil
+}
+
+// signDSSE signs a payload in a DSSE envelope. The key ID is the SHA256 of
+// the DER encoded public key.
+func signDSSE(signer crypto.Signer, payloadType string, payload []byte) (*dsseEnvelope, error) {
+	// the pre-authentication encoding of DSSE v1
+	pae := []byte(fmt.Sprintf("DSSEv1 %d %s %d ", len(payloadType), payloadType, len(payload)))
+	pae = append(pae, payload...)
+
+	var sig []byte
+	var err error
+	if _, isEd25519 := signer.(ed25519.PrivateKey); isEd25519 {
+		sig, err = signer.Sign(rand.Reader, pae, crypto.Hash(0))
+	} else {
+		digest := sha256.Sum256(pae)
+		sig, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	keyID := sha256.Sum256(publicKey)
+
+	return &dsseEnvelope{
+		PayloadType: payloadType,
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+		Signatures: []dsseSignature{{
+			KeyID: hex.EncodeToString(keyID[:]),
+			Sig:   base64.StdEncoding.EncodeToString(sig),
+		}},
+	}, nil
+}
@@ -0,0 +1,148 @@
+package statemachine
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"operese/cedar/internal/helper"
+)
+
+// TestSignDSSE tests that the DSSE envelopes are signed over the
+// pre-authentication encoding of the payload with each type of key
+func TestSignDSSE(t *testing.T) {
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating ed25519 key: %s", err.Error())
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating ECDSA key: %s", err.Error())
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error generating RSA key: %s", err.Error())
+	}
+
+	payload := []byte(`{"_type":"https://in-toto.io/Statement/v1"}`)
+	pae := []byte("DSSEv1 28 application/vnd.in-toto+json 43 ")
+	pae = append(pae, payload...)
+	digest := sha256.Sum256(pae)
+
+	testCases := []struct {
+		name   string
+		signer crypto.Signer
+		verify func(sig []byte) bool
+	}{
+		{"ed25519", ed25519Key, func(sig []byte) bool {
+			return ed25519.Verify(ed25519Key.Public().(ed25519.PublicKey), pae, sig)
+		}},
+		{"ecdsa", ecdsaKey, func(sig []byte) bool {
+			return ecdsa.VerifyASN1(&ecdsaKey.PublicKey, digest[:], sig)
+		}},
+		{"rsa", rsaKey, func(sig []byte) bool {
+			return rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, digest[:], sig) == nil
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			envelope, err := signDSSE(tc.signer, inTotoPayloadType, payload)
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(inTotoPayloadType, envelope.PayloadType)
+			asserter.AssertEqual(base64.StdEncoding.EncodeToString(payload), envelope.Payload)
+			if len(envelope.Signatures) != 1 {
+				t.Fatalf("Expected one signature, got %d", len(envelope.Signatures))
+			}
+
+			publicKey, err := x509.MarshalPKIXPublicKey(tc.signer.Public())
+			asserter.AssertErrNil(err, true)
+			keyID := sha256.Sum256(publicKey)
+			asserter.AssertEqual(hex.EncodeToString(keyID[:]), envelope.Signatures[0].KeyID)
+
+			sig, err := base64.StdEncoding.DecodeString(envelope.Signatures[0].Sig)
+			asserter.AssertErrNil(err, true)
+			if !tc.verify(sig) {
+				t.Errorf("Invalid signature %s", envelope.Signatures[0].Sig)
+			}
+		})
+	}
+}
+
+// TestLoadProvenanceKey tests reading the private key of --provenance-key
+func TestLoadProvenanceKey(t *testing.T) {
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating ed25519 key: %s", err.Error())
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(ed25519Key)
+	if err != nil {
+		t.Fatalf("Error encoding ed25519 key: %s", err.Error())
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating ECDSA key: %s", err.Error())
+	}
+	sec1, err := x509.MarshalECPrivateKey(ecdsaKey)
+	if err != nil {
+		t.Fatalf("Error encoding ECDSA key: %s", err.Error())
+	}
+
+	keyDir := t.TempDir()
+	keyFiles := map[string][]byte{
+		"pkcs8.pem": pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}),
+		"sec1.pem":  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1}),
+		"key.txt":   []byte("not a key"),
+	}
+	for name, content := range keyFiles {
+		if err := os.WriteFile(filepath.Join(keyDir, name), content, 0600); err != nil {
+			t.Fatalf("Error writing key: %s", err.Error())
+		}
+	}
+
+	testCases := []struct {
+		name        string
+		provenance  string
+		key         string
+		expectedErr string
+	}{
+		{"no_key", "provenance.json", "", ""},
+		{"pkcs8", "provenance.json", "pkcs8.pem", ""},
+		{"without_provenance", "", "pkcs8.pem", "--provenance-key can only be used with --provenance"},
+		{"missing", "provenance.json", "missing.pem", "Error reading provenance key"},
+		{"not_pem", "provenance.json", "key.txt", "is not a PEM file"},
+		{"not_pkcs8", "provenance.json", "sec1.pem", "Error parsing provenance key"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine ClassicStateMachine
+			stateMachine.ProvenancePath = tc.provenance
+			if tc.key != "" {
+				stateMachine.ProvenanceKeyPath = filepath.Join(keyDir, tc.key)
+			}
+			err := stateMachine.loadProvenanceKey()
+			if tc.expectedErr != "" {
+				asserter.AssertErrContains(err, tc.expectedErr)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+			if tc.key == "" {
+				asserter.AssertEqual(true, stateMachine.provenanceSigner == nil)
+				return
+			}
+			asserter.AssertEqual(true, ed25519Key.Equal(stateMachine.provenanceSigner))
+		})
+	}
+}
@@ -0,0 +1,307 @@
+package statemachine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/release"
+	"github.com/snapcore/snapd/store"
+
+	"operese/cedar/internal/helper"
+)
+
+// why a seeded snap is part of the image
+const (
+	snapReasonSnapList   = "snap-list"
+	snapReasonDefault    = "default"
+	snapReasonDependency = "dependency"
+)
+
+// Report describes a build, for audits of the produced images
+type Report struct {
+	CedarVersion string         `json:"cedar-version"`
+	Started      string         `json:"started"`
+	Finished     string         `json:"finished"`
+	Success      bool           `json:"success"`
+	Error        string         `json:"error,omitempty"`
+	SnapList     ReportSnapList `json:"snap-list"`
+	Host         ReportHost     `json:"host"`
+	Architecture string         `json:"architecture"`
+	Series       string         `json:"series"`
+	// DetectedArchitecture and DetectedSeries are set when the value was
+	// detected from the image tree because the snap list lacks it
+	DetectedArchitecture string        `json:"detected-architecture,omitempty"`
+	DetectedSeries       string        `json:"detected-series,omitempty"`
+	Store                ReportStore   `json:"store"`
+	Snaps                []*ReportSnap `json:"snaps"`
+	States               []ReportState `json:"states"`
+	// DiskUsage is set when the disk usage of the tree was checked
+	DiskUsage *DiskUsage `json:"disk-usage,omitempty"`
+}
+
+// ReportSnapList identifies the snap list the image was built from
+type ReportSnapList struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+// ReportHost describes the host the build ran on
+type ReportHost struct {
+	Hostname     string `json:"hostname"`
+	OS           string `json:"os"`
+	OSVersion    string `json:"os-version"`
+	Kernel       string `json:"kernel"`
+	Architecture string `json:"architecture"`
+	GoVersion    string `json:"go-version"`
+}
+
+// ReportStore lists the store endpoints the snaps and assertions were fetched from
+type ReportStore struct {
+	StoreURL      string `json:"store-url"`
+	AssertionsURL string `json:"assertions-url"`
+}
+
+// ReportSnap describes a snap of the seed
+type ReportSnap struct {
+	Name     string `json:"name"`
+	SnapID   string `json:"snap-id,omitempty"`
+	Revision string `json:"revision"`
+	Channel  string `json:"channel,omitempty"`
+	// SHA3_384 is the digest of the snap file, encoded like in the snap assertions
+	SHA3_384  string `json:"sha3-384"`
+	Size      uint64 `json:"size"`
+	Publisher string `json:"publisher,omitempty"`
+	// Reason is snap-list for the snaps listed in the snap list, default for
+	// the ones cedar always installs, and dependency for bases, snapd and
+	// default content providers
+	Reason string `json:"reason"`
+}
+
+// ReportState is a state that was run
+type ReportState struct {
+	Name string `json:"name"`
+	// Duration of the state, in seconds
+	Duration float64 `json:"duration"`
+	Success  bool    `json:"success"`
+}
+
+// stateRun records the run of a state for the report
+type stateRun struct {
+	name     string
+	duration time.Duration
+	err      error
+}
+
+// writeReport writes the report of the build to the path given with --report
+func (classicStateMachine *ClassicStateMachine) writeReport(buildErr error) error {
+	report, err := classicStateMachine.buildReport(buildErr)
+	if err != nil {
+		return fmt.Errorf("Error generating the build report: %s", err.Error())
+	}
+
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error encoding the build report: %s", err.Error())
+	}
+	if err := osWriteFile(classicStateMachine.ReportPath, append(content, '\n'), 0644); err != nil {
+		return fmt.Errorf("Error writing the build report: %s", err.Error())
+	}
+	return nil
+}
+
+// buildReport collects the information of the report
+func (classicStateMachine *ClassicStateMachine) buildReport(buildErr error) (*Report, error) {
+	snapListHash, err := helper.HashFile(classicStateMachine.Args.SnapList, helper.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{
+		CedarVersion: classicStateMachine.Version,
+		Started:      classicStateMachine.started.UTC().Format(time.RFC3339),
+		Finished:     time.Now().UTC().Format(time.RFC3339),
+		Success:      buildErr == nil,
+		SnapList: ReportSnapList{
+			Path:   classicStateMachine.Args.SnapList,
+			SHA256: snapListHash,
+		},
+		Host:                 hostReport(),
+		Architecture:         classicStateMachine.ImageDef.Architecture,
+		Series:               classicStateMachine.series,
+		DetectedArchitecture: classicStateMachine.DetectedArchitecture,
+		DetectedSeries:       classicStateMachine.DetectedSeries,
+		Store:                storeReport(),
+		Snaps:                make([]*ReportSnap, 0),
+		States:               make([]ReportState, 0, len(classicStateMachine.stateRuns)),
+		DiskUsage:            classicStateMachine.diskUsage,
+	}
+	if buildErr != nil {
+		report.Error = buildErr.Error()
+	}
+
+	for _, run := range classicStateMachine.stateRuns {
+		report.States = append(report.States, ReportState{
+			Name:     run.name,
+			Duration: run.duration.Seconds(),
+			Success:  run.err == nil,
+		})
+	}
+
+	report.Snaps, err = classicStateMachine.seedReport()
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// seedReport describes the snaps of the seed, if the image tree has one
+func (classicStateMachine *ClassicStateMachine) seedReport() ([]*ReportSnap, error) {
+	seedDir := filepath.Join(classicStateMachine.Args.ImagePath, "var", "lib", "snapd", "seed")
+	snaps := make([]*ReportSnap, 0)
+	if _, err := os.Stat(filepath.Join(seedDir, "seed.yaml")); err != nil {
+		// the build stopped before the seed was created
+		return snaps, nil
+	}
+
+	digests := classicStateMachine.seedDigests()
+	seedSnaps, err := getSeedSnaps(classicStateMachine.Args.ImagePath, digests)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the seed: %s", err.Error())
+	}
+	publishers, err := seedPublishers(filepath.Join(seedDir, "assertions"))
+	if err != nil {
+		return nil, err
+	}
+
+	snapListSnaps := make([]string, 0, len(classicStateMachine.ImageDef.Snaps))
+	for _, snap := range classicStateMachine.ImageDef.Snaps {
+		snapListSnaps = append(snapListSnaps, snap.SnapName)
+	}
+	defaultSnaps, _, err := parseSnapsAndChannels(classicStateMachine.Snaps)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sn := range seedSnaps {
+		snapDigests, err := digests.get(sn.Path)
+		if err != nil {
+			return nil, err
+		}
+		reportSnap := &ReportSnap{
+			Name:     sn.SnapName(),
+			SnapID:   sn.SideInfo.SnapID,
+			Revision: sn.SideInfo.Revision.String(),
+			Channel:  sn.Channel,
+			SHA3_384: snapDigests.assertionSHA3_384,
+			Size:     uint64(snapDigests.size),
+			Reason:   snapReasonDependency,
+		}
+		reportSnap.Publisher = publishers[sn.SideInfo.SnapID]
+		switch {
+		case helper.SliceHasElement(snapListSnaps, reportSnap.Name):
+			reportSnap.Reason = snapReasonSnapList
+		case helper.SliceHasElement(defaultSnaps, reportSnap.Name):
+			reportSnap.Reason = snapReasonDefault
+		}
+		snaps = append(snaps, reportSnap)
+	}
+
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].Name < snaps[j].Name })
+	return snaps, nil
+}
+
+// seedPublishers maps the snap IDs to the username of their publisher, read
+// from the snap-declaration and account assertions of the seed
+func seedPublishers(assertionsDir string) (map[string]string, error) {
+	files, err := osReadDir(assertionsDir)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the seed assertions: %s", err.Error())
+	}
+
+	snapPublishers := make(map[string]string)
+	usernames := make(map[string]string)
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		f, err := osOpen(filepath.Join(assertionsDir, file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("Error reading the seed assertions: %s", err.Error())
+		}
+		decoder := asserts.NewDecoder(f)
+		for {
+			assertion, err := decoder.Decode()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				f.Close()
+				return nil, fmt.Errorf("Error decoding seed assertions %s: %s", file.Name(), err.Error())
+			}
+			switch a := assertion.(type) {
+			case *asserts.SnapDeclaration:
+				snapPublishers[a.SnapID()] = a.PublisherID()
+			case *asserts.Account:
+				usernames[a.AccountID()] = a.Username()
+			}
+		}
+		f.Close()
+	}
+
+	// prefer the usernames, as the account IDs are opaque
+	for snapID, publisherID := range snapPublishers {
+		if username, found := usernames[publisherID]; found {
+			snapPublishers[snapID] = username
+		}
+	}
+	return snapPublishers, nil
+}
+
+// hostReport describes the host. Values that cannot be found are left empty,
+// as they must not fail the build.
+func hostReport() ReportHost {
+	host := ReportHost{
+		OS:           release.ReleaseInfo.ID,
+		OSVersion:    release.ReleaseInfo.VersionID,
+		Architecture: hostArchitecture(),
+		GoVersion:    runtime.Version(),
+	}
+	host.Hostname, _ = os.Hostname()
+
+	var uname syscall.Utsname
+	if err := syscall.Uname(&uname); err == nil {
+		kernelRelease := make([]byte, 0, len(uname.Release))
+		for _, c := range uname.Release {
+			if c == 0 {
+				break
+			}
+			kernelRelease = append(kernelRelease, byte(c))
+		}
+		host.Kernel = string(kernelRelease)
+	}
+	return host
+}
+
+// storeReport returns the store endpoints used by snapd, which honors
+// the environment variables pointing it to another store
+func storeReport() ReportStore {
+	config := store.DefaultConfig()
+	report := ReportStore{}
+	if config.StoreBaseURL != nil {
+		report.StoreURL = config.StoreBaseURL.String()
+	}
+	report.AssertionsURL = report.StoreURL
+	if config.AssertionsBaseURL != nil {
+		report.AssertionsURL = config.AssertionsBaseURL.String()
+	}
+	return report
+}
@@ -0,0 +1,115 @@
+package statemachine
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/asserts/assertstest"
+
+	"operese/cedar/internal/helper"
+)
+
+// writeAssertions writes the encoded assertions to a file
+func writeAssertions(t *testing.T, path string, assertions ...asserts.Assertion) {
+	t.Helper()
+	var content bytes.Buffer
+	encoder := asserts.NewEncoder(&content)
+	for _, assertion := range assertions {
+		if err := encoder.Encode(assertion); err != nil {
+			t.Fatalf("Error encoding assertion: %s", err.Error())
+		}
+	}
+	if err := os.WriteFile(path, content.Bytes(), 0644); err != nil {
+		t.Fatalf("Error writing assertions: %s", err.Error())
+	}
+}
+
+// TestSeedPublishers tests that the publishers of the snaps are read from
+// the assertions of the seed, preferring their username
+func TestSeedPublishers(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	privKey, _ := assertstest.GenerateKey(752)
+	signing := assertstest.NewSigningDB("canonical", privKey)
+	timestamp := time.Now().Format(time.RFC3339)
+
+	account := assertstest.NewAccount(signing, "acme", map[string]interface{}{"account-id": "acme-id"}, "")
+	declaration := func(snapID, snapName, publisherID string) asserts.Assertion {
+		assertion, err := signing.Sign(asserts.SnapDeclarationType, map[string]interface{}{
+			"series":       "16",
+			"snap-id":      snapID,
+			"snap-name":    snapName,
+			"publisher-id": publisherID,
+			"timestamp":    timestamp,
+		}, nil, "")
+		asserter.AssertErrNil(err, true)
+		return assertion
+	}
+
+	assertionsDir := t.TempDir()
+	writeAssertions(t, filepath.Join(assertionsDir, "acme.account"), account)
+	writeAssertions(t, filepath.Join(assertionsDir, "snaps.snap-declaration"),
+		declaration("hello-id", "hello", "acme-id"),
+		declaration("other-id", "other", "unknown-id"))
+	// directories are ignored
+	err := os.Mkdir(filepath.Join(assertionsDir, "subdir"), 0755)
+	asserter.AssertErrNil(err, true)
+
+	publishers, err := seedPublishers(assertionsDir)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(map[string]string{
+		"hello-id": "acme",
+		"other-id": "unknown-id",
+	}, publishers)
+}
+
+// TestSeedPublishersErrors tests the failures to read the assertions of the seed
+func TestSeedPublishersErrors(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+
+	_, err := seedPublishers(filepath.Join(t.TempDir(), "missing"))
+	asserter.AssertErrContains(err, "Error reading the seed assertions")
+
+	assertionsDir := t.TempDir()
+	err = os.WriteFile(filepath.Join(assertionsDir, "broken"), []byte("type: account\n"), 0644)
+	asserter.AssertErrNil(err, true)
+	_, err = seedPublishers(assertionsDir)
+	asserter.AssertErrContains(err, "Error decoding seed assertions broken")
+}
+
+// TestBuildReport tests the report of a build that stopped before the seed
+// was created
+func TestBuildReport(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	snapList := filepath.Join(t.TempDir(), "snaplist.yaml")
+	err := os.WriteFile(snapList, []byte("snaps: []\n"), 0644)
+	asserter.AssertErrNil(err, true)
+
+	var stateMachine ClassicStateMachine
+	stateMachine.Args.SnapList = snapList
+	stateMachine.Args.ImagePath = t.TempDir()
+	stateMachine.ImageDef.Architecture = "arm64"
+	stateMachine.stateRuns = []stateRun{
+		{name: "install_packages", duration: 1500 * time.Millisecond},
+		{name: "prepare_image", duration: 2 * time.Second, err: errors.New("Error preparing image")},
+	}
+
+	report, err := stateMachine.buildReport(errors.New("Error preparing image"))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(false, report.Success)
+	asserter.AssertEqual("Error preparing image", report.Error)
+	asserter.AssertEqual(ReportSnapList{
+		Path:   snapList,
+		SHA256: "de50e5dca79ff41416e9adb6ea9462d6475fd324f955ea27e0fb2ab09e244214",
+	}, report.SnapList)
+	asserter.AssertEqual("arm64", report.Architecture)
+	asserter.AssertEqual([]*ReportSnap{}, report.Snaps)
+	asserter.AssertEqual([]ReportState{
+		{Name: "install_packages", Duration: 1.5, Success: true},
+		{Name: "prepare_image", Duration: 2, Success: false},
+	}, report.States)
+}
@@ -0,0 +1,257 @@
+package statemachine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/snapcore/snapd/osutil"
+	"gopkg.in/yaml.v2"
+
+	"operese/cedar/internal/logger"
+)
+
+// loadSourceDateEpoch reads the SOURCE_DATE_EPOCH the reproducible mode
+// clamps the timestamps to
+func (classicStateMachine *ClassicStateMachine) loadSourceDateEpoch() error {
+	if !classicStateMachine.Reproducible {
+		return nil
+	}
+	value := osGetenv("SOURCE_DATE_EPOCH")
+	if value == "" {
+		return fmt.Errorf("--reproducible requires the SOURCE_DATE_EPOCH environment variable")
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return fmt.Errorf("Invalid SOURCE_DATE_EPOCH \"%s\", it must be a number of seconds since the epoch", value)
+	}
+	classicStateMachine.sourceDateEpoch = time.Unix(seconds, 0).UTC()
+	return nil
+}
+
+// snapshotReproducible records the paths of the image tree along with its
+// root, whose modification time changes with the entries of the top level
+func snapshotReproducible(imagePath string) (treeSnapshot, error) {
+	snapshot, err := snapshotTree(imagePath, auditScope, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Lstat(imagePath)
+	if err != nil {
+		return nil, fmt.Errorf("Error recording the content of the image tree: %s", err.Error())
+	}
+	root := &auditEntry{mode: info.Mode(), mtime: info.ModTime().UnixNano()}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		root.inode = stat.Ino
+	}
+	snapshot["."] = root
+	return snapshot, nil
+}
+
+// recordReproducibleBase records the state of the image tree before the build
+func (classicStateMachine *ClassicStateMachine) recordReproducibleBase() error {
+	base, err := snapshotReproducible(classicStateMachine.Args.ImagePath)
+	if err != nil {
+		return err
+	}
+	classicStateMachine.reproducibleBase = base
+	return nil
+}
+
+// changedSinceBase returns the paths of the image tree added or modified,
+// including directories whose entries changed, since recordReproducibleBase
+func (classicStateMachine *ClassicStateMachine) changedSinceBase() ([]string, error) {
+	current, err := snapshotReproducible(classicStateMachine.Args.ImagePath)
+	if err != nil {
+		return nil, err
+	}
+	sameMtime := func(before, after *auditEntry) bool {
+		return before.inode == after.inode && before.mtime == after.mtime
+	}
+	changed := make([]string, 0)
+	for _, path := range changedPaths(classicStateMachine.reproducibleBase, current, sameMtime) {
+		if _, found := current[path]; found {
+			changed = append(changed, path)
+		}
+	}
+	return changed, nil
+}
+
+var makeReproducibleState = stateFunc{"make_reproducible", (*StateMachine).makeReproducible}
+
+// makeReproducible removes from the image tree what differs between two
+// builds of the same snap list: the order of the seed, the timestamps of
+// the preseeded state and the modification times of what the build wrote.
+// The files of the tree the build did not change are left as they are.
+func (stateMachine *StateMachine) makeReproducible() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+	imagePath := classicStateMachine.Args.ImagePath
+	epoch := classicStateMachine.sourceDateEpoch
+
+	seedYaml := filepath.Join(imagePath, "var", "lib", "snapd", "seed", "seed.yaml")
+	if osutil.FileExists(seedYaml) {
+		if err := sortSeedYaml(seedYaml); err != nil {
+			return err
+		}
+	}
+	stateJSON := filepath.Join(imagePath, "var", "lib", "snapd", "state.json")
+	if osutil.FileExists(stateJSON) {
+		if err := clampStateTimestamps(stateJSON, epoch); err != nil {
+			return err
+		}
+	}
+
+	// last, as the previous steps modify files
+	changed, err := classicStateMachine.changedSinceBase()
+	if err != nil {
+		return err
+	}
+	clamped, err := helperClampPathMtimes(imagePath, changed, epoch)
+	if err != nil {
+		return err
+	}
+	logger.Debugf("Clamped the modification time of %d paths to %s", clamped, epoch.Format(time.RFC3339))
+	return nil
+}
+
+// sortSeedYaml sorts the snaps of seed.yaml by name
+func sortSeedYaml(seedYaml string) error {
+	content, err := osReadFile(seedYaml)
+	if err != nil {
+		return fmt.Errorf("Error reading seed.yaml: %s", err.Error())
+	}
+	var seed yaml.MapSlice
+	if err := yaml.Unmarshal(content, &seed); err != nil {
+		return fmt.Errorf("Error parsing seed.yaml: %s", err.Error())
+	}
+
+	for _, item := range seed {
+		if item.Key != "snaps" {
+			continue
+		}
+		snaps, ok := item.Value.([]interface{})
+		if !ok {
+			return fmt.Errorf("Error parsing seed.yaml: snaps is not a list")
+		}
+		sort.SliceStable(snaps, func(i, j int) bool {
+			return seedSnapName(snaps[i]) < seedSnapName(snaps[j])
+		})
+	}
+
+	sorted, err := yaml.Marshal(seed)
+	if err != nil {
+		return fmt.Errorf("Error writing seed.yaml: %s", err.Error())
+	}
+	if err := osWriteFile(seedYaml, sorted, 0644); err != nil {
+		return fmt.Errorf("Error writing seed.yaml: %s", err.Error())
+	}
+	return nil
+}
+
+// seedSnapName returns the name of a snap entry of seed.yaml
+func seedSnapName(entry interface{}) string {
+	fields, ok := entry.(yaml.MapSlice)
+	if !ok {
+		return ""
+	}
+	for _, field := range fields {
+		if field.Key == "name" {
+			name, _ := field.Value.(string)
+			return name
+		}
+	}
+	return ""
+}
+
+// clampStateTimestamps replaces the timestamps of the snapd state that are
+// later than epoch with epoch
+func clampStateTimestamps(stateJSON string, epoch time.Time) error {
+	content, err := osReadFile(stateJSON)
+	if err != nil {
+		return fmt.Errorf("Error reading state.json: %s", err.Error())
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	// keep the numbers as they are written, they are not all float64
+	decoder.UseNumber()
+	var state interface{}
+	if err := decoder.Decode(&state); err != nil {
+		return fmt.Errorf("Error parsing state.json: %s", err.Error())
+	}
+
+	clamped, err := json.Marshal(clampTimestamps(state, epoch))
+	if err != nil {
+		return fmt.Errorf("Error writing state.json: %s", err.Error())
+	}
+	if err := osWriteFile(stateJSON, clamped, 0600); err != nil {
+		return fmt.Errorf("Error writing state.json: %s", err.Error())
+	}
+	return nil
+}
+
+// stateTimestampKeys are the keys of the snapd state whose values are the
+// time of the build: the times of the changes, tasks, warnings and notices,
+// and the times snapd stores in the data of the state and of the snaps
+var stateTimestampKeys = map[string]bool{
+	"spawn-time":                  true,
+	"ready-time":                  true,
+	"at-time":                     true,
+	"first-added":                 true,
+	"last-added":                  true,
+	"last-shown":                  true,
+	"first-occurred":              true,
+	"last-occurred":               true,
+	"last-repeated":               true,
+	"last-notice-timestamp":       true,
+	"seed-time":                   true,
+	"preseed-time":                true,
+	"last-refresh":                true,
+	"last-refresh-hints":          true,
+	"start-of-operation-time":     true,
+	"last-refresh-time":           true,
+	"refresh-inhibited-time":      true,
+	"last-component-refresh-time": true,
+}
+
+// clampTimestamps walks a decoded JSON value and clamps the timestamps of
+// stateTimestampKeys that are later than epoch. Other strings are left as
+// they are, even when they look like timestamps.
+func clampTimestamps(value interface{}, epoch time.Time) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			if stateTimestampKeys[key] {
+				v[key] = clampTimestamp(item, epoch)
+			} else {
+				v[key] = clampTimestamps(item, epoch)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = clampTimestamps(item, epoch)
+		}
+	}
+	return value
+}
+
+// clampTimestamp clamps an RFC 3339 timestamp, or the timestamps of a map
+// like last-component-refresh-time, to epoch
+func clampTimestamp(value interface{}, epoch time.Time) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = clampTimestamp(item, epoch)
+		}
+	case string:
+		timestamp, err := time.Parse(time.RFC3339Nano, v)
+		if err == nil && timestamp.After(epoch) {
+			return epoch.Format(time.RFC3339Nano)
+		}
+	}
+	return value
+}
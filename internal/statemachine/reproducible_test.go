@@ -0,0 +1,220 @@
+package statemachine
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"operese/cedar/internal/helper"
+)
+
+// TestLoadSourceDateEpoch tests reading SOURCE_DATE_EPOCH in reproducible mode
+func TestLoadSourceDateEpoch(t *testing.T) {
+	testCases := []struct {
+		name         string
+		reproducible bool
+		value        string
+		expected     time.Time
+		expectedErr  string
+	}{
+		{"not_reproducible", false, "", time.Time{}, ""},
+		{"epoch", true, "1700000000", time.Unix(1700000000, 0).UTC(), ""},
+		{"unset", true, "", time.Time{}, "--reproducible requires the SOURCE_DATE_EPOCH environment variable"},
+		{"not_a_number", true, "2023-11-14", time.Time{}, "Invalid SOURCE_DATE_EPOCH \"2023-11-14\""},
+		{"negative", true, "-1", time.Time{}, "Invalid SOURCE_DATE_EPOCH \"-1\""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			osGetenv = func(key string) string {
+				if key == "SOURCE_DATE_EPOCH" {
+					return tc.value
+				}
+				return ""
+			}
+			t.Cleanup(func() {
+				osGetenv = os.Getenv
+			})
+
+			var stateMachine ClassicStateMachine
+			stateMachine.Reproducible = tc.reproducible
+			err := stateMachine.loadSourceDateEpoch()
+			if tc.expectedErr != "" {
+				asserter.AssertErrContains(err, tc.expectedErr)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.expected, stateMachine.sourceDateEpoch)
+		})
+	}
+}
+
+// TestClampTimestamps tests that only the timestamps of the known keys
+// of the snapd state are clamped
+func TestClampTimestamps(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	epoch := time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC)
+	clamped := "2023-11-14T22:13:20Z"
+	later := "2024-05-01T10:00:00.123456789+02:00"
+	earlier := "2020-01-01T00:00:00Z"
+
+	state := map[string]interface{}{
+		"data": map[string]interface{}{
+			"seed-time":     later,
+			"last-refresh":  earlier,
+			"refresh-label": later,
+			"snaps": map[string]interface{}{
+				"hello": map[string]interface{}{
+					"last-refresh-time": later,
+					"last-component-refresh-time": map[string]interface{}{
+						"hello+comp": later,
+					},
+					"version": later,
+				},
+			},
+		},
+		"changes": map[string]interface{}{
+			"1": map[string]interface{}{
+				"spawn-time": later,
+				"ready-time": later,
+				"summary":    later,
+				"task-ids":   []interface{}{"1", later},
+			},
+		},
+		"last-notice-timestamp": later,
+	}
+
+	asserter.AssertEqual(map[string]interface{}{
+		"data": map[string]interface{}{
+			"seed-time":     clamped,
+			"last-refresh":  earlier,
+			"refresh-label": later,
+			"snaps": map[string]interface{}{
+				"hello": map[string]interface{}{
+					"last-refresh-time": clamped,
+					"last-component-refresh-time": map[string]interface{}{
+						"hello+comp": clamped,
+					},
+					"version": later,
+				},
+			},
+		},
+		"changes": map[string]interface{}{
+			"1": map[string]interface{}{
+				"spawn-time": clamped,
+				"ready-time": clamped,
+				"summary":    later,
+				"task-ids":   []interface{}{"1", later},
+			},
+		},
+		"last-notice-timestamp": clamped,
+	}, clampTimestamps(state, epoch))
+}
+
+// TestClampStateTimestamps tests that state.json is rewritten with its
+// numbers as they were written
+func TestClampStateTimestamps(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	epoch := time.Unix(1700000000, 0).UTC()
+	stateJSON := filepath.Join(t.TempDir(), "state.json")
+	content := `{"data":{"seed-time":"2024-05-01T10:00:00Z"},"last-change-id":12345678901234567890}`
+	err := os.WriteFile(stateJSON, []byte(content), 0600)
+	asserter.AssertErrNil(err, true)
+
+	err = clampStateTimestamps(stateJSON, epoch)
+	asserter.AssertErrNil(err, true)
+	clamped, err := os.ReadFile(stateJSON)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(`{"data":{"seed-time":"2023-11-14T22:13:20Z"},"last-change-id":12345678901234567890}`, string(clamped))
+
+	err = os.WriteFile(stateJSON, []byte("{"), 0600)
+	asserter.AssertErrNil(err, true)
+	err = clampStateTimestamps(stateJSON, epoch)
+	asserter.AssertErrContains(err, "Error parsing state.json")
+}
+
+// TestSortSeedYaml tests that the snaps of seed.yaml are sorted by name and
+// the rest of the seed is kept
+func TestSortSeedYaml(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	seedYaml := filepath.Join(t.TempDir(), "seed.yaml")
+	content := `snaps:
+- name: snapd
+  channel: latest/stable
+  file: snapd_21759.snap
+- name: core22
+  channel: latest/stable
+  file: core22_1380.snap
+- name: hello
+  channel: latest/edge
+  file: hello_42.snap
+`
+	err := os.WriteFile(seedYaml, []byte(content), 0644)
+	asserter.AssertErrNil(err, true)
+
+	err = sortSeedYaml(seedYaml)
+	asserter.AssertErrNil(err, true)
+	sorted, err := os.ReadFile(seedYaml)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(`snaps:
+- name: core22
+  channel: latest/stable
+  file: core22_1380.snap
+- name: hello
+  channel: latest/edge
+  file: hello_42.snap
+- name: snapd
+  channel: latest/stable
+  file: snapd_21759.snap
+`, string(sorted))
+
+	err = os.WriteFile(seedYaml, []byte("snaps: snapd\n"), 0644)
+	asserter.AssertErrNil(err, true)
+	err = sortSeedYaml(seedYaml)
+	asserter.AssertErrContains(err, "snaps is not a list")
+}
+
+// TestMakeReproducibleChangedOnly tests that only the modification times of
+// the paths written since the start of the build are clamped, and that the
+// lock of the tree does not change them again
+func TestMakeReproducibleChangedOnly(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	imagePath := t.TempDir()
+	epoch := time.Unix(1700000000, 0)
+	later := epoch.Add(time.Hour)
+	writeTestTreeFile(t, imagePath, "etc/untouched", "untouched")
+	for _, path := range []string{"etc/untouched", "etc", imagePath} {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(imagePath, path)
+		}
+		asserter.AssertErrNil(os.Chtimes(path, later, later), true)
+	}
+
+	var classicStateMachine ClassicStateMachine
+	classicStateMachine.parent = &classicStateMachine
+	classicStateMachine.Args.ImagePath = imagePath
+	classicStateMachine.sourceDateEpoch = epoch
+	asserter.AssertErrNil(classicStateMachine.recordReproducibleBase(), true)
+
+	writeTestTreeFile(t, imagePath, "usr/bin/written", "written")
+	asserter.AssertErrNil(classicStateMachine.makeReproducible(), true)
+	asserter.AssertErrNil(classicStateMachine.lockTree(imagePath, 0), true)
+	asserter.AssertErrNil(classicStateMachine.unlockTree(), true)
+
+	testCases := map[string]time.Time{
+		".":               epoch,
+		"usr":             epoch,
+		"usr/bin":         epoch,
+		"usr/bin/written": epoch,
+		"etc":             later,
+		"etc/untouched":   later,
+	}
+	for path, expected := range testCases {
+		info, err := os.Lstat(filepath.Join(imagePath, path))
+		asserter.AssertErrNil(err, true)
+		if !info.ModTime().Equal(expected) {
+			t.Errorf("Expected the modification time of %s to be %s but got %s", path, expected, info.ModTime())
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// rootlessEnv is set in the environment of the cedar process re-executed
+// in a user namespace
+const rootlessEnv = "CEDAR_ROOTLESS_CHILD"
+
+// rootlessSyncFDEnv is the file descriptor the re-executed process reads
+// from to wait for its ID mappings to be written
+const rootlessSyncFDEnv = "CEDAR_ROOTLESS_SYNC_FD"
+
+// the files listing the subordinate IDs users can map in user namespaces
+var subUIDPath = "/etc/subuid"
+var subGIDPath = "/etc/subgid"
+
+// subIDRange is a range of subordinate IDs of /etc/subuid or /etc/subgid
+type subIDRange struct {
+	start int
+	count int
+}
+
+// userNamespaceSysctls lists the kernel settings that can prevent unprivileged
+// users from creating user namespaces, with the value blocking them
+var userNamespaceSysctls = []struct {
+	path    string
+	blocked string
+	hint    string
+}{
+	{
+		path:    "/proc/sys/kernel/unprivileged_userns_clone",
+		blocked: "0",
+		hint:    "unprivileged user namespaces are disabled, run \"sysctl kernel.unprivileged_userns_clone=1\" as root to enable them",
+	},
+	{
+		path:    "/proc/sys/user/max_user_namespaces",
+		blocked: "0",
+		hint:    "user namespaces are disabled, run \"sysctl user.max_user_namespaces=15000\" as root to enable them",
+	},
+	{
+		path:    "/proc/sys/kernel/apparmor_restrict_unprivileged_userns",
+		blocked: "1",
+		hint:    "AppArmor restricts unprivileged user namespaces, run \"sysctl kernel.apparmor_restrict_unprivileged_userns=0\" as root or install an AppArmor profile allowing cedar to use them",
+	},
+}
+
+// InRootlessNamespace returns whether the current process is the cedar
+// process re-executed by StartRootless
+func InRootlessNamespace() bool {
+	return osGetenv(rootlessEnv) == "1"
+}
+
+// CheckUserNamespaces verifies that the current user can create a user
+// namespace and explains why not otherwise
+func CheckUserNamespaces() error {
+	for _, sysctl := range userNamespaceSysctls {
+		value, err := osReadFile(sysctl.path)
+		if err != nil {
+			// the setting does not exist on this kernel
+			continue
+		}
+		if strings.TrimSpace(string(value)) == sysctl.blocked {
+			return fmt.Errorf("Cannot run rootless: %s", sysctl.hint)
+		}
+	}
+
+	for _, tool := range []string{"newuidmap", "newgidmap"} {
+		if _, err := execLookPath(tool); err != nil {
+			return fmt.Errorf("Cannot run rootless: %s was not found, install the uidmap package", tool)
+		}
+	}
+	if _, _, err := currentSubIDRanges(); err != nil {
+		return err
+	}
+
+	// the kernel could still refuse for other reasons (seccomp, LSM...),
+	// so actually try to create one
+	probe := execCommand("true")
+	probe.SysProcAttr = userNamespaceAttr()
+	if err := probe.Run(); err != nil {
+		return fmt.Errorf("Cannot run rootless: unable to create a user namespace (%s). "+
+			"Run cedar as root instead.", err.Error())
+	}
+	return nil
+}
+
+// parseSubIDRanges returns the ranges of the user, given by name or ID, in
+// the content of /etc/subuid or /etc/subgid
+func parseSubIDRanges(content string, name string, id int) []subIDRange {
+	ranges := make([]subIDRange, 0)
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Split(strings.TrimSpace(line), ":")
+		if len(fields) != 3 || (fields[0] != name && fields[0] != strconv.Itoa(id)) {
+			continue
+		}
+		start, err := strconv.Atoi(fields[1])
+		if err != nil || start < 0 {
+			continue
+		}
+		count, err := strconv.Atoi(fields[2])
+		if err != nil || count <= 0 {
+			continue
+		}
+		ranges = append(ranges, subIDRange{start: start, count: count})
+	}
+	return ranges
+}
+
+// currentSubIDRanges returns the subordinate UID and GID ranges of the
+// current user, and fails naming the missing ones
+func currentSubIDRanges() (uids []subIDRange, gids []subIDRange, err error) {
+	currentUser, err := userCurrent()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error looking up the current user: %s", err.Error())
+	}
+	uid := os.Getuid()
+	// missing files are the same as files without ranges
+	subUIDs, _ := osReadFile(subUIDPath)
+	subGIDs, _ := osReadFile(subGIDPath)
+	uids = parseSubIDRanges(string(subUIDs), currentUser.Username, uid)
+	gids = parseSubIDRanges(string(subGIDs), currentUser.Username, uid)
+
+	missing := make([]string, 0, 2)
+	if len(uids) == 0 {
+		missing = append(missing, "subordinate UIDs in "+subUIDPath)
+	}
+	if len(gids) == 0 {
+		missing = append(missing, "subordinate GIDs in "+subGIDPath)
+	}
+	if len(missing) > 0 {
+		return nil, nil, fmt.Errorf("Cannot run rootless: user %s has no range of %s, which are needed "+
+			"to preserve the ownership of the files of the image tree. Add them as root with "+
+			"\"usermod --add-subuids 100000-165535 --add-subgids 100000-165535 %s\"",
+			currentUser.Username, strings.Join(missing, " and no range of "), currentUser.Username)
+	}
+	return uids, gids, nil
+}
+
+// idMapArgs returns the arguments of newuidmap or newgidmap mapping root in
+// the namespace of the process to id, and the next IDs to the ranges
+func idMapArgs(pid int, id int, ranges []subIDRange) []string {
+	args := []string{strconv.Itoa(pid), "0", strconv.Itoa(id), "1"}
+	next := 1
+	for _, r := range ranges {
+		args = append(args, strconv.Itoa(next), strconv.Itoa(r.start), strconv.Itoa(r.count))
+		next += r.count
+	}
+	return args
+}
+
+// StartRootless starts cedar again with the given arguments in new user and
+// mount namespaces. The current user is mapped to root, so files created as
+// root in the namespace belong to the current user on the host, matching the
+// ownership of a tree unpacked by this user. The subordinate IDs of the user
+// are mapped to the other users and groups, so the ownership of the files of
+// the tree is preserved. extraFiles are inherited like with exec.Cmd.
+func StartRootless(args []string, extraFiles []*os.File) (*exec.Cmd, error) {
+	uids, gids, err := currentSubIDRanges()
+	if err != nil {
+		return nil, err
+	}
+	syncReader, syncWriter, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("Error creating pipe: %s", err.Error())
+	}
+	defer syncReader.Close()
+	defer syncWriter.Close()
+
+	//nolint:gosec,G204
+	cmd := execCommand("/proc/self/exe", args...)
+	cmd.ExtraFiles = append(extraFiles, syncReader)
+	cmd.Env = append(os.Environ(), rootlessEnv+"=1",
+		fmt.Sprintf("%s=%d", rootlessSyncFDEnv, 2+len(cmd.ExtraFiles)))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS,
+		// the parent forwards signals itself, so keep the child out of the
+		// terminal's process group to avoid delivering them twice
+		Setpgid: true,
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Error starting cedar in a user namespace: %s", err.Error())
+	}
+
+	// the mappings can only be written by the setuid newuidmap and
+	// newgidmap once the namespace exists
+	mapCmds := []*exec.Cmd{
+		execCommand("newuidmap", idMapArgs(cmd.Process.Pid, os.Getuid(), uids)...),
+		execCommand("newgidmap", idMapArgs(cmd.Process.Pid, os.Getgid(), gids)...),
+	}
+	for _, mapCmd := range mapCmds {
+		if output, err := mapCmd.CombinedOutput(); err != nil {
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+			reason := strings.TrimSpace(string(output))
+			if reason == "" {
+				reason = err.Error()
+			}
+			return nil, fmt.Errorf("Error mapping the IDs of the user namespace with \"%s\": %s",
+				mapCmd.String(), reason)
+		}
+	}
+
+	// tell the child it can go on
+	if _, err := syncWriter.Write([]byte{1}); err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return nil, fmt.Errorf("Error starting cedar in a user namespace: %s", err.Error())
+	}
+	return cmd, nil
+}
+
+// WaitForIDMappings blocks the process started by StartRootless until its
+// ID mappings are written, and checks it is root in its namespace
+func WaitForIDMappings() error {
+	fd, err := strconv.Atoi(osGetenv(rootlessSyncFDEnv))
+	if err != nil {
+		return fmt.Errorf("Invalid %s: %s", rootlessSyncFDEnv, err.Error())
+	}
+	syncReader := os.NewFile(uintptr(fd), "rootless-sync")
+	defer syncReader.Close()
+
+	buf := make([]byte, 1)
+	if n, _ := syncReader.Read(buf); n != 1 {
+		return fmt.Errorf("The ID mappings of the user namespace were not written")
+	}
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("Not root in the user namespace, uid is %d", os.Geteuid())
+	}
+	return nil
+}
+
+// userNamespaceAttr returns the attributes needed to start a process in new
+// user and mount namespaces with only the current user and group mapped to
+// root, enough for the probes of the host checks
+func userNamespaceAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS,
+		UidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: os.Getuid(), Size: 1},
+		},
+		GidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: os.Getgid(), Size: 1},
+		},
+		// required to write the gid map as an unprivileged user
+		GidMappingsEnableSetgroups: false,
+	}
+}
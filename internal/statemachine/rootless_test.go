@@ -0,0 +1,94 @@
+package statemachine
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"operese/cedar/internal/helper"
+)
+
+var cmpOptsSubIDRange = []cmp.Option{cmp.AllowUnexported(subIDRange{})}
+
+// TestParseSubIDRanges tests that the ranges of a user are found by name or ID
+func TestParseSubIDRanges(t *testing.T) {
+	content := `root:1000000:65536
+builder:100000:65536
+# comment
+1001:200000:1000
+builder:300000:10
+broken:abc:10
+builder:400000:0
+`
+	testCases := []struct {
+		name     string
+		user     string
+		id       int
+		expected []subIDRange
+	}{
+		{"by_name", "builder", 2000, []subIDRange{{100000, 65536}, {300000, 10}}},
+		{"by_id", "other", 1001, []subIDRange{{200000, 1000}}},
+		{"invalid", "broken", 2000, []subIDRange{}},
+		{"missing", "nobody", 65534, []subIDRange{}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			asserter.AssertEqual(tc.expected, parseSubIDRanges(content, tc.user, tc.id), cmpOptsSubIDRange...)
+		})
+	}
+}
+
+// TestIdMapArgs tests that root maps to the user and the next IDs to its ranges
+func TestIdMapArgs(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	asserter.AssertEqual(
+		[]string{"42", "0", "1000", "1", "1", "100000", "65536", "65537", "300000", "10"},
+		idMapArgs(42, 1000, []subIDRange{{100000, 65536}, {300000, 10}}))
+}
+
+// TestCurrentSubIDRanges tests that the missing ranges are named in the error
+func TestCurrentSubIDRanges(t *testing.T) {
+	dir := t.TempDir()
+	subUIDPath = filepath.Join(dir, "subuid")
+	subGIDPath = filepath.Join(dir, "subgid")
+	userCurrent = func() (*user.User, error) {
+		return &user.User{Username: "builder", Uid: strconv.Itoa(os.Getuid())}, nil
+	}
+	t.Cleanup(func() {
+		subUIDPath = "/etc/subuid"
+		subGIDPath = "/etc/subgid"
+		userCurrent = user.Current
+	})
+
+	testCases := []struct {
+		name        string
+		subUIDs     string
+		subGIDs     string
+		expectedErr string
+	}{
+		{"both", "builder:100000:65536\n", "builder:100000:65536\n", ""},
+		{"no_uids", "", "builder:100000:65536\n", "has no range of subordinate UIDs in " + subUIDPath + ", which"},
+		{"no_gids", "builder:100000:65536\n", "other:100000:65536\n", "has no range of subordinate GIDs in " + subGIDPath},
+		{"none", "", "", "subordinate UIDs in " + subUIDPath + " and no range of subordinate GIDs"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			asserter.AssertErrNil(os.WriteFile(subUIDPath, []byte(tc.subUIDs), 0644), true)
+			asserter.AssertErrNil(os.WriteFile(subGIDPath, []byte(tc.subGIDs), 0644), true)
+			uids, gids, err := currentSubIDRanges()
+			if tc.expectedErr != "" {
+				asserter.AssertErrContains(err, tc.expectedErr)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual([]subIDRange{{100000, 65536}}, uids, cmpOptsSubIDRange...)
+			asserter.AssertEqual([]subIDRange{{100000, 65536}}, gids, cmpOptsSubIDRange...)
+		})
+	}
+}
@@ -0,0 +1,397 @@
+package statemachine
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/snapcore/snapd/snap"
+	"github.com/snapcore/snapd/snap/snapfile"
+	"github.com/snapcore/snapd/store"
+
+	"operese/cedar/internal/logger"
+)
+
+// spdxNoAssertion is the SPDX value for an unknown field
+const spdxNoAssertion = "NOASSERTION"
+
+// sbomSnap is a seeded snap, as described in the SBOMs
+type sbomSnap struct {
+	name      string
+	version   string
+	revision  string
+	channel   string
+	snapType  snap.Type
+	publisher string
+	license   string
+	sha256    string
+	sha3_384  string
+	// the bases and default content providers of the snap
+	dependsOn []string
+}
+
+var writeSBOMState = stateFunc{"write_sbom", (*StateMachine).writeSBOM}
+
+// writeSBOM writes the SPDX and CycloneDX documents describing the seeded snaps
+func (stateMachine *StateMachine) writeSBOM() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+	snaps, err := classicStateMachine.sbomSnaps()
+	if err != nil {
+		return err
+	}
+
+	if classicStateMachine.SPDXPath != "" {
+		document := classicStateMachine.spdxDocument(snaps)
+		if err := writeJSONFile(classicStateMachine.SPDXPath, document); err != nil {
+			return fmt.Errorf("Error writing the SPDX SBOM: %s", err.Error())
+		}
+	}
+	if classicStateMachine.CycloneDXPath != "" {
+		document := classicStateMachine.cycloneDXDocument(snaps)
+		if err := writeJSONFile(classicStateMachine.CycloneDXPath, document); err != nil {
+			return fmt.Errorf("Error writing the CycloneDX SBOM: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// sbomSnaps collects the description of the seeded snaps from the snap
+// files, the seed assertions and the store
+func (classicStateMachine *ClassicStateMachine) sbomSnaps() ([]*sbomSnap, error) {
+	seedDir := filepath.Join(classicStateMachine.Args.ImagePath, "var", "lib", "snapd", "seed")
+	digests := classicStateMachine.seedDigests()
+	seedSnaps, err := getSeedSnaps(classicStateMachine.Args.ImagePath, digests)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the seed: %s", err.Error())
+	}
+	publishers, err := seedPublishers(filepath.Join(seedDir, "assertions"))
+	if err != nil {
+		return nil, err
+	}
+
+	snapStore := store.New(nil, nil)
+	snaps := make([]*sbomSnap, 0, len(seedSnaps))
+	for _, sn := range seedSnaps {
+		container, err := snapfile.Open(sn.Path)
+		if err != nil {
+			return nil, fmt.Errorf("Error opening snap %s: %s", sn.SnapName(), err.Error())
+		}
+		info, err := snap.ReadInfoFromSnapFile(container, sn.SideInfo)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading the metadata of snap %s: %s", sn.SnapName(), err.Error())
+		}
+
+		snapDigests, err := digests.get(sn.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		entry := &sbomSnap{
+			name:      sn.SnapName(),
+			version:   info.Version,
+			revision:  sn.SideInfo.Revision.String(),
+			channel:   sn.Channel,
+			snapType:  info.Type(),
+			publisher: publishers[sn.SideInfo.SnapID],
+			license:   info.License,
+			sha256:    snapDigests.sha256,
+			sha3_384:  snapDigests.sha3_384,
+			dependsOn: snapDependencies(info),
+		}
+		// the license of the snap.yaml is optional, the store has the one
+		// declared by the publisher
+		if sn.SideInfo.SnapID != "" {
+			storeInfo, err := snapStore.SnapInfo(classicStateMachine.ctx, store.SnapSpec{Name: entry.name}, nil)
+			if err == nil && storeInfo.License != "" {
+				entry.license = storeInfo.License
+			} else if err != nil {
+				logger.Debugf("Could not get the store metadata of snap %s: %s", entry.name, err.Error())
+			}
+		}
+		snaps = append(snaps, entry)
+	}
+
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].name < snaps[j].name })
+	return snaps, nil
+}
+
+// snapDependencies returns the base and default content providers of a snap
+func snapDependencies(info *snap.Info) []string {
+	dependencies := make([]string, 0)
+	switch {
+	case info.Base != "":
+		dependencies = append(dependencies, info.Base)
+	case info.Type() == snap.TypeApp:
+		// snaps without base use the core snap
+		dependencies = append(dependencies, "core")
+	}
+
+	plugs := make([]*snap.PlugInfo, 0, len(info.Plugs))
+	for _, plug := range info.Plugs {
+		plugs = append(plugs, plug)
+	}
+	providers := make([]string, 0)
+	for provider := range snap.DefaultContentProviders(plugs) {
+		if provider != info.SnapName() {
+			providers = append(providers, provider)
+		}
+	}
+	sort.Strings(providers)
+	return append(dependencies, providers...)
+}
+
+// writeJSONFile writes an indented JSON document
+func writeJSONFile(path string, document interface{}) error {
+	content, err := json.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return err
+	}
+	return osWriteFile(path, append(content, '\n'), 0644)
+}
+
+// spdxDocument is an SPDX 2.3 document
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	Name                  string         `json:"name"`
+	SPDXID                string         `json:"SPDXID"`
+	VersionInfo           string         `json:"versionInfo"`
+	Supplier              string         `json:"supplier"`
+	DownloadLocation      string         `json:"downloadLocation"`
+	FilesAnalyzed         bool           `json:"filesAnalyzed"`
+	LicenseConcluded      string         `json:"licenseConcluded"`
+	LicenseDeclared       string         `json:"licenseDeclared"`
+	CopyrightText         string         `json:"copyrightText"`
+	PrimaryPackagePurpose string         `json:"primaryPackagePurpose"`
+	Checksums             []spdxChecksum `json:"checksums"`
+	Comment               string         `json:"comment"`
+}
+
+type spdxChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// spdxID returns the SPDX identifier of a snap. Snap names only contain
+// characters allowed in identifiers.
+func spdxID(snapName string) string {
+	return "SPDXRef-Snap-" + snapName
+}
+
+// spdxDocument returns the SPDX description of the seeded snaps
+func (classicStateMachine *ClassicStateMachine) spdxDocument(snaps []*sbomSnap) *spdxDocument {
+	name := filepath.Base(classicStateMachine.Args.ImagePath)
+	document := &spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              name,
+		DocumentNamespace: fmt.Sprintf("https://spdx.org/spdxdocs/cedar-%s-%s", name, uuid.NewString()),
+		CreationInfo: spdxCreationInfo{
+			Created:  time.Now().UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: cedar-" + classicStateMachine.Version},
+		},
+		Packages:      make([]spdxPackage, 0, len(snaps)),
+		Relationships: make([]spdxRelationship, 0),
+	}
+
+	seeded := make(map[string]bool)
+	for _, entry := range snaps {
+		seeded[entry.name] = true
+	}
+	for _, entry := range snaps {
+		supplier := spdxNoAssertion
+		if entry.publisher != "" {
+			supplier = "Organization: " + entry.publisher
+		}
+		license := spdxNoAssertion
+		if entry.license != "" {
+			license = entry.license
+		}
+		purpose := "APPLICATION"
+		if entry.snapType == snap.TypeBase || entry.snapType == snap.TypeOS {
+			purpose = "OPERATING-SYSTEM"
+		}
+		comment := "revision " + entry.revision
+		if entry.channel != "" {
+			comment += " from channel " + entry.channel
+		}
+
+		document.Packages = append(document.Packages, spdxPackage{
+			Name:                  entry.name,
+			SPDXID:                spdxID(entry.name),
+			VersionInfo:           entry.version,
+			Supplier:              supplier,
+			DownloadLocation:      spdxNoAssertion,
+			LicenseConcluded:      spdxNoAssertion,
+			LicenseDeclared:       license,
+			CopyrightText:         spdxNoAssertion,
+			PrimaryPackagePurpose: purpose,
+			Checksums: []spdxChecksum{
+				{Algorithm: "SHA256", ChecksumValue: entry.sha256},
+				{Algorithm: "SHA3-384", ChecksumValue: entry.sha3_384},
+			},
+			Comment: comment,
+		})
+		document.Relationships = append(document.Relationships, spdxRelationship{
+			SPDXElementID:      document.SPDXID,
+			RelationshipType:   "DESCRIBES",
+			RelatedSPDXElement: spdxID(entry.name),
+		})
+		for _, dependency := range entry.dependsOn {
+			// a missing dependency is reported by snapd, not by the SBOM
+			if !seeded[dependency] {
+				continue
+			}
+			document.Relationships = append(document.Relationships, spdxRelationship{
+				SPDXElementID:      spdxID(entry.name),
+				RelationshipType:   "DEPENDS_ON",
+				RelatedSPDXElement: spdxID(dependency),
+			})
+		}
+	}
+	return document
+}
+
+// cycloneDXDocument is a CycloneDX 1.5 document
+type cycloneDXDocument struct {
+	BOMFormat    string                `json:"bomFormat"`
+	SpecVersion  string                `json:"specVersion"`
+	SerialNumber string                `json:"serialNumber"`
+	Version      int                   `json:"version"`
+	Metadata     cycloneDXMetadata     `json:"metadata"`
+	Components   []cycloneDXComponent  `json:"components"`
+	Dependencies []cycloneDXDependency `json:"dependencies"`
+}
+
+type cycloneDXMetadata struct {
+	Timestamp string             `json:"timestamp"`
+	Tools     cycloneDXTools     `json:"tools"`
+	Component cycloneDXComponent `json:"component"`
+}
+
+type cycloneDXTools struct {
+	Components []cycloneDXComponent `json:"components"`
+}
+
+type cycloneDXComponent struct {
+	Type       string              `json:"type"`
+	BOMRef     string              `json:"bom-ref,omitempty"`
+	Name       string              `json:"name"`
+	Version    string              `json:"version,omitempty"`
+	Publisher  string              `json:"publisher,omitempty"`
+	Licenses   []cycloneDXLicense  `json:"licenses,omitempty"`
+	Hashes     []cycloneDXHash     `json:"hashes,omitempty"`
+	Properties []cycloneDXProperty `json:"properties,omitempty"`
+}
+
+type cycloneDXLicense struct {
+	Expression string `json:"expression"`
+}
+
+type cycloneDXHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+type cycloneDXProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type cycloneDXDependency struct {
+	Ref       string   `json:"ref"`
+	DependsOn []string `json:"dependsOn"`
+}
+
+// cycloneDXRef returns the reference of a snap in the CycloneDX document
+func cycloneDXRef(snapName string) string {
+	return "snap:" + snapName
+}
+
+// cycloneDXDocument returns the CycloneDX description of the seeded snaps
+func (classicStateMachine *ClassicStateMachine) cycloneDXDocument(snaps []*sbomSnap) *cycloneDXDocument {
+	document := &cycloneDXDocument{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: "urn:uuid:" + uuid.NewString(),
+		Version:      1,
+		Metadata: cycloneDXMetadata{
+			Timestamp: time.Now().UTC().Format(time.RFC3339),
+			Tools: cycloneDXTools{Components: []cycloneDXComponent{
+				{Type: "application", Name: "cedar", Version: classicStateMachine.Version},
+			}},
+			Component: cycloneDXComponent{
+				Type: "operating-system",
+				Name: filepath.Base(classicStateMachine.Args.ImagePath),
+			},
+		},
+		Components:   make([]cycloneDXComponent, 0, len(snaps)),
+		Dependencies: make([]cycloneDXDependency, 0, len(snaps)),
+	}
+
+	seeded := make(map[string]bool)
+	for _, entry := range snaps {
+		seeded[entry.name] = true
+	}
+	for _, entry := range snaps {
+		componentType := "application"
+		if entry.snapType == snap.TypeBase || entry.snapType == snap.TypeOS {
+			componentType = "operating-system"
+		}
+		component := cycloneDXComponent{
+			Type:      componentType,
+			BOMRef:    cycloneDXRef(entry.name),
+			Name:      entry.name,
+			Version:   entry.version,
+			Publisher: entry.publisher,
+			Hashes: []cycloneDXHash{
+				{Alg: "SHA-256", Content: entry.sha256},
+				{Alg: "SHA3-384", Content: entry.sha3_384},
+			},
+			Properties: []cycloneDXProperty{
+				{Name: "cedar:snap:revision", Value: entry.revision},
+				{Name: "cedar:snap:type", Value: string(entry.snapType)},
+			},
+		}
+		if entry.license != "" {
+			component.Licenses = []cycloneDXLicense{{Expression: entry.license}}
+		}
+		if entry.channel != "" {
+			component.Properties = append(component.Properties, cycloneDXProperty{Name: "cedar:snap:channel", Value: entry.channel})
+		}
+		document.Components = append(document.Components, component)
+
+		dependency := cycloneDXDependency{Ref: cycloneDXRef(entry.name), DependsOn: make([]string, 0)}
+		for _, dependsOn := range entry.dependsOn {
+			if seeded[dependsOn] {
+				dependency.DependsOn = append(dependency.DependsOn, cycloneDXRef(dependsOn))
+			}
+		}
+		document.Dependencies = append(document.Dependencies, dependency)
+	}
+	return document
+}
@@ -0,0 +1,180 @@
+package statemachine
+
+import (
+	"testing"
+
+	"github.com/snapcore/snapd/snap"
+
+	"operese/cedar/internal/helper"
+)
+
+// testSBOMSnaps are seeded snaps: hello depends on core22 and on a content
+// provider that is not part of the seed
+var testSBOMSnaps = []*sbomSnap{
+	{
+		name:     "core22",
+		version:  "20240111",
+		revision: "1122",
+		snapType: snap.TypeBase,
+		sha256:   "core22-sha256",
+		sha3_384: "core22-sha3-384",
+	},
+	{
+		name:      "hello",
+		version:   "2.10",
+		revision:  "42",
+		channel:   "latest/stable",
+		snapType:  snap.TypeApp,
+		publisher: "canonical",
+		license:   "GPL-3.0",
+		sha256:    "hello-sha256",
+		sha3_384:  "hello-sha3-384",
+		dependsOn: []string{"core22", "gtk-common-themes"},
+	},
+}
+
+// TestSnapDependencies tests that the bases and default content providers
+// of snaps are their dependencies
+func TestSnapDependencies(t *testing.T) {
+	testCases := []struct {
+		name     string
+		snapYaml string
+		expected []string
+	}{
+		{"base", "name: hello\nbase: core22\n", []string{"core22"}},
+		{"no_base", "name: hello\n", []string{"core"}},
+		{"base_snap", "name: core22\ntype: base\n", []string{}},
+		{
+			"content_providers",
+			`name: hello
+base: core22
+plugs:
+  gtk-3-themes:
+    interface: content
+    target: $SNAP/data-dir/themes
+    default-provider: gtk-common-themes
+  icon-themes:
+    interface: content
+    target: $SNAP/data-dir/icons
+    default-provider: gtk-common-themes:icon-themes
+  self:
+    interface: content
+    target: $SNAP/self
+    default-provider: hello
+  kde:
+    interface: content
+    target: $SNAP/kf5
+    default-provider: kde-frameworks-5-core18
+`,
+			[]string{"core22", "gtk-common-themes", "kde-frameworks-5-core18"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			info, err := snap.InfoFromSnapYaml([]byte(tc.snapYaml))
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.expected, snapDependencies(info))
+		})
+	}
+}
+
+// TestSPDXDocument tests the packages and relationships of the SPDX SBOM
+func TestSPDXDocument(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine ClassicStateMachine
+	stateMachine.Args.ImagePath = "/tmp/noble-tree"
+	stateMachine.Version = "1.2"
+
+	document := stateMachine.spdxDocument(testSBOMSnaps)
+	asserter.AssertEqual("noble-tree", document.Name)
+	asserter.AssertEqual([]string{"Tool: cedar-1.2"}, document.CreationInfo.Creators)
+	asserter.AssertEqual([]spdxPackage{
+		{
+			Name:                  "core22",
+			SPDXID:                "SPDXRef-Snap-core22",
+			VersionInfo:           "20240111",
+			Supplier:              spdxNoAssertion,
+			DownloadLocation:      spdxNoAssertion,
+			LicenseConcluded:      spdxNoAssertion,
+			LicenseDeclared:       spdxNoAssertion,
+			CopyrightText:         spdxNoAssertion,
+			PrimaryPackagePurpose: "OPERATING-SYSTEM",
+			Checksums: []spdxChecksum{
+				{Algorithm: "SHA256", ChecksumValue: "core22-sha256"},
+				{Algorithm: "SHA3-384", ChecksumValue: "core22-sha3-384"},
+			},
+			Comment: "revision 1122",
+		},
+		{
+			Name:                  "hello",
+			SPDXID:                "SPDXRef-Snap-hello",
+			VersionInfo:           "2.10",
+			Supplier:              "Organization: canonical",
+			DownloadLocation:      spdxNoAssertion,
+			LicenseConcluded:      spdxNoAssertion,
+			LicenseDeclared:       "GPL-3.0",
+			CopyrightText:         spdxNoAssertion,
+			PrimaryPackagePurpose: "APPLICATION",
+			Checksums: []spdxChecksum{
+				{Algorithm: "SHA256", ChecksumValue: "hello-sha256"},
+				{Algorithm: "SHA3-384", ChecksumValue: "hello-sha3-384"},
+			},
+			Comment: "revision 42 from channel latest/stable",
+		},
+	}, document.Packages)
+	asserter.AssertEqual([]spdxRelationship{
+		{SPDXElementID: "SPDXRef-DOCUMENT", RelationshipType: "DESCRIBES", RelatedSPDXElement: "SPDXRef-Snap-core22"},
+		{SPDXElementID: "SPDXRef-DOCUMENT", RelationshipType: "DESCRIBES", RelatedSPDXElement: "SPDXRef-Snap-hello"},
+		{SPDXElementID: "SPDXRef-Snap-hello", RelationshipType: "DEPENDS_ON", RelatedSPDXElement: "SPDXRef-Snap-core22"},
+	}, document.Relationships)
+}
+
+// TestCycloneDXDocument tests the components and dependencies of the
+// CycloneDX SBOM
+func TestCycloneDXDocument(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine ClassicStateMachine
+	stateMachine.Args.ImagePath = "/tmp/noble-tree"
+	stateMachine.Version = "1.2"
+
+	document := stateMachine.cycloneDXDocument(testSBOMSnaps)
+	asserter.AssertEqual(cycloneDXComponent{Type: "operating-system", Name: "noble-tree"}, document.Metadata.Component)
+	asserter.AssertEqual([]cycloneDXComponent{
+		{
+			Type:    "operating-system",
+			BOMRef:  "snap:core22",
+			Name:    "core22",
+			Version: "20240111",
+			Hashes: []cycloneDXHash{
+				{Alg: "SHA-256", Content: "core22-sha256"},
+				{Alg: "SHA3-384", Content: "core22-sha3-384"},
+			},
+			Properties: []cycloneDXProperty{
+				{Name: "cedar:snap:revision", Value: "1122"},
+				{Name: "cedar:snap:type", Value: "base"},
+			},
+		},
+		{
+			Type:      "application",
+			BOMRef:    "snap:hello",
+			Name:      "hello",
+			Version:   "2.10",
+			Publisher: "canonical",
+			Licenses:  []cycloneDXLicense{{Expression: "GPL-3.0"}},
+			Hashes: []cycloneDXHash{
+				{Alg: "SHA-256", Content: "hello-sha256"},
+				{Alg: "SHA3-384", Content: "hello-sha3-384"},
+			},
+			Properties: []cycloneDXProperty{
+				{Name: "cedar:snap:revision", Value: "42"},
+				{Name: "cedar:snap:type", Value: "app"},
+				{Name: "cedar:snap:channel", Value: "latest/stable"},
+			},
+		},
+	}, document.Components)
+	asserter.AssertEqual([]cycloneDXDependency{
+		{Ref: "snap:core22", DependsOn: []string{}},
+		{Ref: "snap:hello", DependsOn: []string{"snap:core22"}},
+	}, document.Dependencies)
+}
@@ -0,0 +1,146 @@
+package statemachine
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"operese/cedar/internal/commands"
+	"operese/cedar/internal/helper"
+	"operese/cedar/internal/snaplist"
+)
+
+// testStates are the states of a build used to test --skip and --only
+var testStates = []stateFunc{
+	{"install_packages", nil},
+	{"prepare_image", nil},
+	{"write_manifest", nil},
+	{"preseed_image", nil},
+	{"clean_rootfs", nil},
+}
+
+// stateNames returns the names of the states of the state machine
+func stateNames(stateMachine *StateMachine) []string {
+	names := make([]string, 0, len(stateMachine.states))
+	for _, state := range stateMachine.states {
+		names = append(names, state.name)
+	}
+	return names
+}
+
+// TestValidateSkipOnly tests the combinations of --skip, --only, --until and --thru
+func TestValidateSkipOnly(t *testing.T) {
+	testCases := []struct {
+		name        string
+		flags       commands.StateMachineOpts
+		expectedErr string
+	}{
+		{"skip", commands.StateMachineOpts{Skip: []string{"install_packages", "clean_rootfs"}}, ""},
+		{"only", commands.StateMachineOpts{Only: "write_manifest"}, ""},
+		{"skip_and_until", commands.StateMachineOpts{Skip: []string{"install_packages"}, Until: "clean_rootfs"}, ""},
+		{"only_and_skip", commands.StateMachineOpts{Only: "write_manifest", Skip: []string{"prepare_image"}}, "--only cannot be used with"},
+		{"only_and_thru", commands.StateMachineOpts{Only: "write_manifest", Thru: "clean_rootfs"}, "--only cannot be used with"},
+		{"unknown_skip", commands.StateMachineOpts{Skip: []string{"make_coffee"}}, "state make_coffee is not a valid state name"},
+		{"unknown_only", commands.StateMachineOpts{Only: "make_coffee"}, "state make_coffee is not a valid state name"},
+		{"skip_until", commands.StateMachineOpts{Skip: []string{"preseed_image"}, Until: "preseed_image"}, "cannot be both skipped and used with --until or --thru"},
+		{"skip_thru", commands.StateMachineOpts{Skip: []string{"preseed_image"}, Thru: "preseed_image"}, "cannot be both skipped and used with --until or --thru"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			flags := tc.flags
+			stateMachine := &StateMachine{states: testStates, stateMachineFlags: &flags}
+			err := stateMachine.validateSkipOnly()
+			if tc.expectedErr != "" {
+				asserter.AssertErrContains(err, tc.expectedErr)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+		})
+	}
+}
+
+// TestApplySkipOnly tests that only the selected states are kept, in order
+func TestApplySkipOnly(t *testing.T) {
+	testCases := []struct {
+		name            string
+		flags           commands.StateMachineOpts
+		expected        []string
+		expectedPartial bool
+	}{
+		{"none", commands.StateMachineOpts{}, []string{"install_packages", "prepare_image", "write_manifest", "preseed_image", "clean_rootfs"}, false},
+		{"skip", commands.StateMachineOpts{Skip: []string{"install_packages", "preseed_image"}}, []string{"prepare_image", "write_manifest", "clean_rootfs"}, true},
+		{"skip_later", commands.StateMachineOpts{Skip: []string{"preseed_image"}}, []string{"install_packages", "prepare_image", "write_manifest", "clean_rootfs"}, false},
+		{"only", commands.StateMachineOpts{Only: "write_manifest"}, []string{"write_manifest"}, true},
+		{"only_first", commands.StateMachineOpts{Only: "install_packages"}, []string{"install_packages"}, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			flags := tc.flags
+			stateMachine := &StateMachine{states: append([]stateFunc{}, testStates...), stateMachineFlags: &flags}
+			stateMachine.applySkipOnly()
+			asserter.AssertEqual(tc.expected, stateNames(stateMachine))
+			asserter.AssertEqual(tc.expectedPartial, stateMachine.partialRun)
+		})
+	}
+}
+
+// TestCheckPrerequisites tests that the states running without the ones they
+// depend on find what they need in the image tree
+func TestCheckPrerequisites(t *testing.T) {
+	testCases := []struct {
+		name        string
+		flags       commands.StateMachineOpts
+		artefacts   []string
+		expectedErr string
+	}{
+		{"full_build", commands.StateMachineOpts{}, nil, ""},
+		{"only_manifest_without_seed", commands.StateMachineOpts{Only: "write_manifest"}, nil,
+			"State write_manifest cannot run without prepare_image: var/lib/snapd/seed/seed.yaml was not found"},
+		{"only_manifest_with_seed", commands.StateMachineOpts{Only: "write_manifest"},
+			[]string{"var/lib/snapd/seed/seed.yaml"}, ""},
+		{"skip_prepare_without_seed", commands.StateMachineOpts{Skip: []string{"prepare_image"}}, nil,
+			"cannot run without prepare_image"},
+		{"only_post_preseed_hooks_without_state", commands.StateMachineOpts{Only: "post_preseed_hooks"},
+			[]string{"var/lib/snapd/seed/seed.yaml"}, "State post_preseed_hooks cannot run without preseed_image"},
+		{"only_post_preseed_hooks_with_state", commands.StateMachineOpts{Only: "post_preseed_hooks"},
+			[]string{"var/lib/snapd/state.json"}, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			imagePath := t.TempDir()
+			for _, artefact := range tc.artefacts {
+				path := filepath.Join(imagePath, artefact)
+				asserter.AssertErrNil(os.MkdirAll(filepath.Dir(path), 0755), true)
+				asserter.AssertErrNil(os.WriteFile(path, nil, 0644), true)
+			}
+
+			flags := tc.flags
+			classicStateMachine := &ClassicStateMachine{
+				Args:         commands.ClassicArgs{ImagePath: imagePath},
+				Preseed:      true,
+				ManifestPath: filepath.Join(t.TempDir(), "manifest"),
+				ImageDef: snaplist.SnapList{
+					SetDefaultLocale: helper.BoolPtr(false),
+					Hooks: &snaplist.Hooks{
+						PostPreseed: []*snaplist.Hook{{Script: "post.sh"}},
+					},
+				},
+			}
+			classicStateMachine.parent = classicStateMachine
+			classicStateMachine.stateMachineFlags = &flags
+			asserter.AssertErrNil(classicStateMachine.calculateStates(), true)
+			asserter.AssertErrNil(classicStateMachine.validateSkipOnly(), true)
+			classicStateMachine.applySkipOnly()
+
+			err := classicStateMachine.checkPrerequisites()
+			if tc.expectedErr != "" {
+				asserter.AssertErrContains(err, tc.expectedErr)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+		})
+	}
+}
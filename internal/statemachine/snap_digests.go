@@ -0,0 +1,116 @@
+package statemachine
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/seed"
+	"github.com/snapcore/snapd/snap"
+	"github.com/snapcore/snapd/timings"
+	"golang.org/x/crypto/sha3"
+)
+
+// snapDigests are the digests of a snap file of the seed
+type snapDigests struct {
+	size    int64
+	modTime time.Time
+	sha256  string
+	// sha3_384 is hex encoded, like sha256
+	sha3_384 string
+	// assertionSHA3_384 is the sha3-384 digest encoded like in the snap assertions
+	assertionSHA3_384 string
+}
+
+// snapDigestCache holds the digests of the snap files of the seed, keyed by
+// their path. The seed is loaded by the manifest, the report, the SBOMs and
+// the provenance, which share the cache so each snap is only read once per
+// build. An entry is computed again if the size or the modification time of
+// its file changed.
+type snapDigestCache map[string]*snapDigests
+
+// get returns the digests of a snap file, computing them if needed
+func (cache snapDigestCache) get(path string) (*snapDigests, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error hashing snap %s: %s", path, err.Error())
+	}
+	if digests, found := cache[path]; found && digests.size == info.Size() && digests.modTime.Equal(info.ModTime()) {
+		return digests, nil
+	}
+
+	f, err := osOpen(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error hashing snap %s: %s", path, err.Error())
+	}
+	defer f.Close()
+	sha256Hasher := sha256.New()
+	sha3Hasher := sha3.New384()
+	if _, err := io.Copy(io.MultiWriter(sha256Hasher, sha3Hasher), f); err != nil {
+		return nil, fmt.Errorf("Error hashing snap %s: %s", path, err.Error())
+	}
+	assertionDigest, err := asserts.EncodeDigest(crypto.SHA3_384, sha3Hasher.Sum(nil))
+	if err != nil {
+		return nil, fmt.Errorf("Error hashing snap %s: %s", path, err.Error())
+	}
+
+	digests := &snapDigests{
+		size:              info.Size(),
+		modTime:           info.ModTime(),
+		sha256:            hex.EncodeToString(sha256Hasher.Sum(nil)),
+		sha3_384:          hex.EncodeToString(sha3Hasher.Sum(nil)),
+		assertionSHA3_384: assertionDigest,
+	}
+	cache[path] = digests
+	return digests, nil
+}
+
+// sha256Digests returns the sha256 digests of the cached snap files that
+// did not change since they were hashed
+func (cache snapDigestCache) sha256Digests() map[string]string {
+	digests := make(map[string]string, len(cache))
+	for path, entry := range cache {
+		info, err := os.Stat(path)
+		if err == nil && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+			digests[path] = entry.sha256
+		}
+	}
+	return digests
+}
+
+// seedDigests returns the cache of the digests of the seeded snaps
+func (classicStateMachine *ClassicStateMachine) seedDigests() snapDigestCache {
+	if classicStateMachine.snapDigests == nil {
+		classicStateMachine.snapDigests = make(snapDigestCache)
+	}
+	return classicStateMachine.snapDigests
+}
+
+// snapDigestHandler loads the snaps of a seed with the digests of the cache,
+// instead of letting snapd hash them again
+type snapDigestHandler struct {
+	cache snapDigestCache
+}
+
+var _ seed.ContainerHandler = snapDigestHandler{}
+
+// HandleAndDigestAssertedContainer returns the digest of an asserted snap
+func (handler snapDigestHandler) HandleAndDigestAssertedContainer(cpi snap.ContainerPlaceInfo, path string,
+	tm timings.Measurer) (newPath string, snapSHA3_384 string, snapSize uint64, err error) {
+	digests, err := handler.cache.get(path)
+	if err != nil {
+		return "", "", 0, err
+	}
+	return "", digests.assertionSHA3_384, uint64(digests.size), nil
+}
+
+// HandleUnassertedContainer leaves unasserted snaps as they are
+func (handler snapDigestHandler) HandleUnassertedContainer(cpi snap.ContainerPlaceInfo, path string,
+	tm timings.Measurer) (newPath string, err error) {
+	return "", nil
+}
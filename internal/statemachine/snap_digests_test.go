@@ -0,0 +1,59 @@
+package statemachine
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/snapcore/snapd/asserts"
+
+	"operese/cedar/internal/helper"
+)
+
+// TestSnapDigestCache tests that a snap file is read once for all its
+// digests, and read again once it changed
+func TestSnapDigestCache(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	snapPath := filepath.Join(t.TempDir(), "hello_42.snap")
+	asserter.AssertErrNil(os.WriteFile(snapPath, []byte("hello"), 0644), true)
+
+	opened := 0
+	osOpen = func(name string) (*os.File, error) {
+		opened++
+		return os.Open(name)
+	}
+	t.Cleanup(func() { osOpen = os.Open })
+
+	cache := make(snapDigestCache)
+	handler := snapDigestHandler{cache: cache}
+	_, assertionDigest, size, err := handler.HandleAndDigestAssertedContainer(nil, snapPath, nil)
+	asserter.AssertErrNil(err, true)
+	digests, err := cache.get(snapPath)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(1, opened)
+
+	expectedAssertionDigest, expectedSize, err := asserts.SnapFileSHA3_384(snapPath)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(expectedAssertionDigest, assertionDigest)
+	asserter.AssertEqual(expectedSize, size)
+	expectedSHA256, err := helper.HashFile(snapPath, helper.SHA256)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(expectedSHA256, digests.sha256)
+	expectedSHA3_384, err := helper.HashFile(snapPath, helper.SHA3_384)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(expectedSHA3_384, digests.sha3_384)
+	asserter.AssertEqual(map[string]string{snapPath: expectedSHA256}, cache.sha256Digests())
+
+	// a rewritten snap is hashed again, and its old digest is not reused
+	asserter.AssertErrNil(os.WriteFile(snapPath, []byte("world"), 0644), true)
+	later := time.Now().Add(time.Hour)
+	asserter.AssertErrNil(os.Chtimes(snapPath, later, later), true)
+	asserter.AssertEqual(0, len(cache.sha256Digests()))
+	digests, err = cache.get(snapPath)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(2, opened)
+	expectedSHA256, err = helper.HashFile(snapPath, helper.SHA256)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(expectedSHA256, digests.sha256)
+}
@@ -3,10 +3,13 @@
 package statemachine
 
 import (
+	"context"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"os/user"
 	"path/filepath"
 	"time"
 
@@ -14,6 +17,7 @@ import (
 	"github.com/snapcore/snapd/gadget"
 	"github.com/snapcore/snapd/gadget/quantity"
 	"github.com/snapcore/snapd/image"
+	"github.com/snapcore/snapd/image/preseed"
 	"github.com/snapcore/snapd/osutil"
 	"github.com/snapcore/snapd/osutil/mkfs"
 	"github.com/snapcore/snapd/seed"
@@ -21,6 +25,7 @@ import (
 
 	"operese/cedar/internal/commands"
 	"operese/cedar/internal/helper"
+	"operese/cedar/internal/logger"
 )
 
 const (
@@ -38,6 +43,13 @@ var helperCheckEmptyFields = helper.CheckEmptyFields
 var helperCheckTags = helper.CheckTags
 var helperBackupAndCopyResolvConf = helper.BackupAndCopyResolvConf
 var helperRestoreResolvConf = helper.RestoreResolvConf
+var helperRestoreBackup = helper.RestoreBackup
+var helperBackupReplace = helper.BackupReplace
+var helperResolveInRoot = helper.ResolveInRoot
+var helperRunScript = helper.RunScript
+var helperRunCmdContext = helper.RunCmdContext
+var helperClampPathMtimes = helper.ClampPathMtimes
+var helperDu = helper.Du
 var osReadDir = os.ReadDir
 var osReadFile = os.ReadFile
 var osWriteFile = os.WriteFile
@@ -52,10 +64,12 @@ var osRename = os.Rename
 var osCreate = os.Create
 var osTruncate = os.Truncate
 var osGetenv = os.Getenv
+var userCurrent = user.Current
 var osSetenv = os.Setenv
 var osutilCopyFile = osutil.CopyFile
 var osutilCopySpecialFile = osutil.CopySpecialFile
 var execCommand = exec.Command
+var execLookPath = exec.LookPath
 var mkfsMakeWithContent = mkfs.MakeWithContent
 var mkfsMake = mkfs.Make
 var diskfsCreate = diskfs.Create
@@ -65,12 +79,18 @@ var imagePrepare = image.Prepare
 var gojsonschemaValidate = gojsonschema.Validate
 var filepathRel = filepath.Rel
 
+// ErrInterrupted is returned when the build was cancelled before completion,
+// usually because cedar received a signal
+var ErrInterrupted = errors.New("build interrupted")
+
 // SmInterface allows different image types to implement their own setup/run/teardown functions
 type SmInterface interface {
 	Setup() error
 	Run() error
 	Teardown() error
 	SetCommonOpts(commonOpts *commands.CommonOpts, stateMachineOpts *commands.StateMachineOpts)
+	SetContext(ctx context.Context)
+	SetEvents(events *EventWriter)
 	SetSeries() error
 }
 
@@ -93,6 +113,26 @@ type StateMachine struct {
 
 	series string
 
+	// cancelled when the build must stop, e.g. when a signal was received
+	ctx context.Context
+
+	// held for the whole build to get exclusive access to the image tree
+	lockFile *os.File
+
+	// where the progress events are emitted, if requested
+	events *EventWriter
+
+	// when the states started running and how each one went, for the report
+	started   time.Time
+	stateRuns []stateRun
+
+	// records the changes made to the image tree, if requested
+	audit *treeAudit
+
+	// set when --skip or --only removed the first state, so the image tree
+	// may already contain what an earlier run added
+	partialRun bool
+
 	// The flags that were passed in on the command line
 	commonFlags       *commands.CommonOpts
 	stateMachineFlags *commands.StateMachineOpts
@@ -120,6 +160,14 @@ type StateMachine struct {
 	Snaps    []string
 }
 
+// RouteSnapdOutput sends what the snapd libraries print to the logger. Their
+// progress is only printed with --verbose or --debug.
+func RouteSnapdOutput() {
+	image.Stdout = logger.Writer(logger.LevelVerbose)
+	image.Stderr = logger.Writer(logger.LevelWarning)
+	preseed.Stdout = logger.Writer(logger.LevelVerbose)
+}
+
 // SetCommonOpts stores the common options for all image types in the struct
 func (stateMachine *StateMachine) SetCommonOpts(commonOpts *commands.CommonOpts,
 	stateMachineOpts *commands.StateMachineOpts) {
@@ -127,23 +175,28 @@ func (stateMachine *StateMachine) SetCommonOpts(commonOpts *commands.CommonOpts,
 	stateMachine.stateMachineFlags = stateMachineOpts
 }
 
+// SetContext sets the context used to cancel the running state
+// and its child processes
+func (stateMachine *StateMachine) SetContext(ctx context.Context) {
+	stateMachine.ctx = ctx
+}
+
 // displayStates print the calculated states
 func (s *StateMachine) displayStates() {
-	if !s.commonFlags.Debug && !s.commonFlags.DryRun {
-		return
-	}
-
+	// the states are part of the result of a dry run
+	logf := logger.Debugf
 	verb := "will"
 	if s.commonFlags.DryRun {
+		logf = logger.Infof
 		verb = "would"
 	}
-	fmt.Printf("\nFollowing states %s be executed:\n", verb)
+	logf("Following states %s be executed:", verb)
 
 	for i, state := range s.states {
 		if state.name == s.stateMachineFlags.Until {
 			break
 		}
-		fmt.Printf("[%d] %s\n", i, state.name)
+		logf("[%d] %s", i, state.name)
 
 		if state.name == s.stateMachineFlags.Thru {
 			break
@@ -153,7 +206,7 @@ func (s *StateMachine) displayStates() {
 	if s.commonFlags.DryRun {
 		return
 	}
-	fmt.Println("\nContinuing")
+	logf("Continuing")
 }
 
 // Run iterates through the state functions, stopping when appropriate based on --until and --thru
@@ -161,6 +214,10 @@ func (stateMachine *StateMachine) Run() error {
 	if stateMachine.commonFlags.DryRun {
 		return nil
 	}
+	if stateMachine.ctx == nil {
+		stateMachine.ctx = context.Background()
+	}
+	stateMachine.started = time.Now()
 	// iterate through the states
 	for i := 0; i < len(stateMachine.states); i++ {
 		stateFunc := stateMachine.states[i]
@@ -168,15 +225,31 @@ func (stateMachine *StateMachine) Run() error {
 		if stateFunc.name == stateMachine.stateMachineFlags.Until {
 			break
 		}
-		if !stateMachine.commonFlags.Quiet {
-			fmt.Printf("[%d] %s\n", stateMachine.StepsTaken, stateFunc.name)
+		if stateMachine.ctx.Err() != nil {
+			return fmt.Errorf("%w before state %s", ErrInterrupted, stateFunc.name)
 		}
+		logger.Infof("[%d] %s", stateMachine.StepsTaken, stateFunc.name)
+		stateMachine.events.Emit(Event{Type: EventStateStarted, State: stateFunc.name})
 		start := time.Now()
 		err := stateFunc.function(stateMachine)
-		if stateMachine.commonFlags.Debug {
-			fmt.Printf("duration: %v\n", time.Since(start))
+		duration := time.Since(start)
+		if auditErr := stateMachine.audit.recordState(stateFunc.name); auditErr != nil && err == nil {
+			err = auditErr
+		}
+		logger.Debugf("duration: %v", duration)
+		stateMachine.stateRuns = append(stateMachine.stateRuns, stateRun{name: stateFunc.name, duration: duration, err: err})
+		success := err == nil
+		finished := Event{Type: EventStateFinished, State: stateFunc.name, Duration: duration.Seconds(), Success: &success}
+		if err != nil {
+			finished.Error = err.Error()
 		}
+		stateMachine.events.Emit(finished)
 		if err != nil {
+			if stateMachine.ctx.Err() != nil {
+				// the state was stopped halfway through, so its error is
+				// most likely only a consequence of the interruption
+				return fmt.Errorf("%w during state %s: %s", ErrInterrupted, stateFunc.name, err.Error())
+			}
 			return err
 		}
 		stateMachine.StepsTaken++
@@ -184,11 +257,11 @@ func (stateMachine *StateMachine) Run() error {
 			break
 		}
 	}
-	fmt.Println("Build successful")
+	logger.Infof("Build successful")
 	return nil
 }
 
 // Teardown handles anything else that needs to happen after the states have finished running
 func (stateMachine *StateMachine) Teardown() error {
-	return nil
+	return stateMachine.unlockTree()
 }